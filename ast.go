@@ -3,63 +3,231 @@ package itf
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"strings"
+	"unicode"
 )
 
+// maxLineSize bounds the length of an input line; bufio.Scanner's default
+// of 64KiB is exceeded by minified code.
+const maxLineSize = 16 << 20
+
 type CodeBlock struct {
-	Hint    string
+	Hint string
+	// Lang is the first word of the fence info string; the rest, such as
+	// Pandoc attributes, is kept in Attrs.
 	Lang    string
+	Attrs   string
 	Content string
+	// Start and End are byte offsets into the source covering the whole
+	// block, fences included, so it can be replaced in place. StartLine and
+	// EndLine are the same span as 1-based, inclusive line numbers.
+	Start     int
+	End       int
+	StartLine int
+	EndLine   int
+}
+
+type ParseOptions struct {
+	// IndentedBlocks recognizes 4-space indented code blocks, but only when
+	// they follow a blank line and a backtick-quoted path hint, to avoid
+	// false positives.
+	IndentedBlocks bool
+	// Partial makes ExtractCodeBlocksWithOptions return the blocks read
+	// before a *ParseError along with it, instead of none.
+	Partial bool
+}
+
+// ParseError reports input that could not be read, such as a line longer
+// than maxLineSize. Line is the 1-based line it occurred on.
+type ParseError struct {
+	Line int
+	Err  error
 }
 
+func (e *ParseError) Error() string { return fmt.Sprintf("line %d: %v", e.Line, e.Err) }
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
 func ExtractCodeBlocks(source []byte) ([]CodeBlock, error) {
+	return ExtractCodeBlocksWithOptions(source, ParseOptions{})
+}
+
+func ExtractCodeBlocksWithOptions(source []byte, opts ParseOptions) ([]CodeBlock, error) {
 	var blocks []CodeBlock
+	err := StreamCodeBlocks(bytes.NewReader(source), opts, func(b CodeBlock) error {
+		blocks = append(blocks, b)
+		return nil
+	})
+	var pe *ParseError
+	if err != nil && !(opts.Partial && errors.As(err, &pe)) {
+		return nil, err
+	}
+	return blocks, err
+}
+
+// StreamCodeBlocks scans r and calls emit for each code block as soon as it
+// is complete, so large inputs never need to be held in memory at once. An
+// error from emit stops the scan and is returned.
+func StreamCodeBlocks(r io.Reader, opts ParseOptions, emit func(CodeBlock) error) error {
 	var currentBlock *CodeBlock
+	var content strings.Builder
 	var fenceChar byte
 	var fenceCount int
 	var lastNonEmptyLine string
+	var indented *CodeBlock
+	var indentedLines []string
+	prevBlank := true
+	offset, lineStart, indentedEnd := 0, 0, 0
+	lineNo, indentedEndLine := 0, 0
+
+	flushIndented := func() error {
+		for len(indentedLines) > 0 && indentedLines[len(indentedLines)-1] == "" {
+			indentedLines = indentedLines[:len(indentedLines)-1]
+		}
+		indented.Content = strings.Join(indentedLines, "\n") + "\n"
+		indented.End = indentedEnd
+		indented.EndLine = indentedEndLine
+		b := *indented
+		indented, indentedLines = nil, nil
+		lastNonEmptyLine = ""
+		return emit(b)
+	}
 
-	scanner := bufio.NewScanner(bytes.NewReader(source))
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineSize)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if token != nil {
+			lineStart = offset
+			offset += advance
+			lineNo++
+		}
+		return advance, token, err
+	})
 	for scanner.Scan() {
 		line := scanner.Text()
 
+		if indented != nil {
+			if body, ok := dedentCodeLine(line); ok {
+				indentedLines = append(indentedLines, body)
+				if body != "" {
+					indentedEnd, indentedEndLine = offset, lineNo
+				}
+				continue
+			}
+			if err := flushIndented(); err != nil {
+				return err
+			}
+		}
+
 		if currentBlock == nil {
+			if opts.IndentedBlocks && prevBlank && isQuotedPathHint(lastNonEmptyLine) {
+				if body, ok := dedentCodeLine(line); ok && body != "" {
+					indented = &CodeBlock{Hint: lastNonEmptyLine, Start: lineStart, StartLine: lineNo}
+					indentedLines = []string{body}
+					indentedEnd, indentedEndLine = offset, lineNo
+					continue
+				}
+			}
+
 			char, count, ok := parseOpeningFence(line)
 			if ok {
 				fenceChar = char
 				fenceCount = count
+				content.Reset()
+				lang, attrs := parseInfoString(line[count:])
 				currentBlock = &CodeBlock{
-					Lang: strings.TrimSpace(line[count:]),
-					Hint: lastNonEmptyLine,
+					Lang:      lang,
+					Attrs:     attrs,
+					Hint:      lastNonEmptyLine,
+					Start:     lineStart,
+					StartLine: lineNo,
 				}
 				continue
 			}
 
-			if trimmed := strings.TrimSpace(line); trimmed != "" {
+			trimmed := strings.TrimSpace(line)
+			if trimmed != "" {
 				lastNonEmptyLine = trimmed
 			}
+			prevBlank = trimmed == ""
 			continue
 		}
 
 		if isClosingFence(line, fenceChar, fenceCount) {
-			blocks = append(blocks, *currentBlock)
+			currentBlock.Content = content.String()
+			currentBlock.End, currentBlock.EndLine = offset, lineNo
+			b := *currentBlock
 			currentBlock = nil
 			lastNonEmptyLine = ""
+			if err := emit(b); err != nil {
+				return err
+			}
 			continue
 		}
 
-		currentBlock.Content += line + "\n"
+		content.WriteString(line)
+		content.WriteByte('\n')
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, err
+		return &ParseError{Line: lineNo + 1, Err: err}
 	}
 
 	if currentBlock != nil {
-		blocks = append(blocks, *currentBlock)
+		currentBlock.Content = content.String()
+		currentBlock.End, currentBlock.EndLine = offset, lineNo
+		if err := emit(*currentBlock); err != nil {
+			return err
+		}
+	}
+	if indented != nil {
+		return flushIndented()
 	}
+	return nil
+}
+
+// parseInfoString splits a fence info string at its first space or tab into
+// the language and the remaining attributes. A Pandoc attribute block such
+// as {.go .numberLines} takes its language from the first class.
+func parseInfoString(info string) (string, string) {
+	info = strings.TrimSpace(info)
+	if strings.HasPrefix(info, "{") {
+		for _, f := range strings.Fields(strings.Trim(info, "{}")) {
+			if lang, ok := strings.CutPrefix(f, "."); ok {
+				return lang, info
+			}
+		}
+		return "", info
+	}
+	i := strings.IndexFunc(info, unicode.IsSpace)
+	if i < 0 {
+		return info, ""
+	}
+	return info[:i], strings.TrimSpace(info[i:])
+}
 
-	return blocks, nil
+func isQuotedPathHint(hint string) bool {
+	h, _ := hintIntent(hint)
+	h = strings.Trim(strings.TrimLeft(h, "# "), "*")
+	return len(h) > 2 && h[0] == '`' && h[len(h)-1] == '`' && ExtractPathFromHint(h) != ""
+}
+
+// dedentCodeLine strips exactly one level of code block indentation (four
+// spaces or a tab). Blank lines are accepted as part of the block.
+func dedentCodeLine(line string) (string, bool) {
+	switch {
+	case strings.HasPrefix(line, "    "):
+		return line[4:], true
+	case strings.HasPrefix(line, "\t"):
+		return line[1:], true
+	case strings.TrimSpace(line) == "":
+		return "", true
+	}
+	return "", false
 }
 
 func parseOpeningFence(line string) (byte, int, bool) {
@@ -0,0 +1,246 @@
+package itf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// largeBlock returns a document holding one fenced block of n lines, and
+// the content the block must parse to.
+func largeBlock(n int) (doc, content string) {
+	var sb strings.Builder
+	for i := range n {
+		fmt.Fprintf(&sb, "\tfmt.Println(%d) // some generated code\n", i)
+	}
+	content = sb.String()
+	return "`big.go`\n```go\n" + content + "```\n", content
+}
+
+func TestCodeBlockContent(t *testing.T) {
+	big, bigContent := largeBlock(100000)
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{name: "one line", input: "```go\nx := 1\n```\n", want: []string{"x := 1\n"}},
+		{name: "empty block", input: "```go\n```\n", want: []string{""}},
+		{name: "blank lines kept", input: "```\n\na\n\n\nb\n\n```\n", want: []string{"\na\n\n\nb\n\n"}},
+		{name: "CRLF line endings dropped", input: "```\r\na\r\nb\r\n```\r\n", want: []string{"a\nb\n"}},
+		{name: "unterminated block", input: "```\na\nb", want: []string{"a\nb\n"}},
+		{name: "second block starts empty", input: "```\na\n```\n```\nb\n```\n", want: []string{"a\n", "b\n"}},
+		{name: "inner fence of a longer one", input: "````md\n```go\nx\n```\n````\n", want: []string{"```go\nx\n```\n"}},
+		{name: "multi-megabyte block", input: big, want: []string{bigContent}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := ExtractCodeBlocks([]byte(tc.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != len(tc.want) {
+				t.Fatalf("got %d blocks, want %d", len(blocks), len(tc.want))
+			}
+			for i, b := range blocks {
+				if b.Content != tc.want[i] {
+					t.Errorf("block %d content differs: got %d bytes, want %d", i, len(b.Content), len(tc.want[i]))
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkExtractCodeBlocksLargeBlock parses a single 200,000-line, about
+// 9MB, block. Content built with += took about a minute here.
+func BenchmarkExtractCodeBlocksLargeBlock(b *testing.B) {
+	doc, _ := largeBlock(200000)
+	src := []byte(doc)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := ExtractCodeBlocks(src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestInfoString(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		info        string
+		lang, attrs string
+	}{
+		{name: "language only", info: "go", lang: "go"},
+		{name: "no info string"},
+		{name: "attributes after a space", info: "go {.line-numbers}", lang: "go", attrs: "{.line-numbers}"},
+		{name: "attributes after a tab", info: "go\t{.line-numbers}", lang: "go", attrs: "{.line-numbers}"},
+		{name: "several spaces and tabs", info: " python \t title=\"a.py\" ", lang: "python", attrs: `title="a.py"`},
+		{name: "Pandoc attribute block", info: "{.go .numberLines}", lang: "go", attrs: "{.go .numberLines}"},
+		{name: "Pandoc block without a class", info: "{#id}", attrs: "{#id}"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := ExtractCodeBlocks([]byte("```" + tc.info + "\nx\n```\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != 1 {
+				t.Fatalf("got %d blocks, want 1", len(blocks))
+			}
+			if b := blocks[0]; b.Lang != tc.lang || b.Attrs != tc.attrs {
+				t.Errorf("lang %q, attrs %q; want %q, %q", b.Lang, b.Attrs, tc.lang, tc.attrs)
+			}
+		})
+	}
+
+	t.Run("attributed diff block applies", func(t *testing.T) {
+		inProject(t)
+		writeFile(t, "a.txt", "one\n")
+		mustRun(t, Config{}, "```diff\t{.numberLines}\n--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-one\n+two\n```\n")
+		if got := readFile(t, "a.txt"); got != "two\n" {
+			t.Errorf("a.txt = %q", got)
+		}
+	})
+}
+
+func TestIndentedBlocks(t *testing.T) {
+	const body = "    func f() {\n        return\n    }\n"
+	for _, tc := range []struct {
+		name     string
+		input    string
+		indented bool
+		hint     string // "" when no block may be found
+		content  string
+	}{
+		{name: "path hint and a blank line", indented: true, input: "`a.go`\n\n" + body + "\nAfter.\n",
+			hint: "`a.go`", content: "func f() {\n    return\n}\n"},
+		{name: "tab indentation", indented: true, input: "`a.go`\n\n\tx := 1\n\t\ty := 2\n",
+			hint: "`a.go`", content: "x := 1\n\ty := 2\n"},
+		{name: "blank lines inside are kept, trailing ones dropped", indented: true, input: "`a.go`\n\n    a\n\n    b\n\n\n",
+			hint: "`a.go`", content: "a\n\nb\n"},
+		{name: "off without the option", input: "`a.go`\n\n" + body},
+		{name: "no path hint", indented: true, input: "Some prose.\n\n" + body},
+		{name: "no blank line after the hint", indented: true, input: "`a.go`\n" + body},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := ExtractCodeBlocksWithOptions([]byte(tc.input), ParseOptions{IndentedBlocks: tc.indented})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.hint == "" {
+				if len(blocks) > 0 {
+					t.Errorf("found %d blocks, want none", len(blocks))
+				}
+				return
+			}
+			if len(blocks) != 1 {
+				t.Fatalf("found %d blocks, want 1", len(blocks))
+			}
+			if b := blocks[0]; b.Hint != tc.hint || b.Content != tc.content {
+				t.Errorf("hint %q, content %q; want %q, %q", b.Hint, b.Content, tc.hint, tc.content)
+			}
+		})
+	}
+
+	t.Run("applies to the hinted path", func(t *testing.T) {
+		inProject(t)
+		mustRun(t, Config{IndentedBlocks: true}, "`a.go`\n\n"+body)
+		if got := readFile(t, "a.go"); got != "func f() {\n    return\n}\n" {
+			t.Errorf("a.go = %q", got)
+		}
+	})
+}
+
+func TestBlockOffsets(t *testing.T) {
+	type span struct {
+		text               string // the source between Start and End
+		startLine, endLine int
+	}
+	for _, tc := range []struct {
+		name     string
+		input    string
+		indented bool
+		want     []span
+	}{
+		{name: "two blocks among prose",
+			input: "Intro\n\n`a.go`\n```go\nx\n```\nMiddle\n~~~\ny\nz\n~~~\nEnd\n",
+			want:  []span{{"```go\nx\n```\n", 4, 6}, {"~~~\ny\nz\n~~~\n", 8, 11}}},
+		{name: "CRLF line endings",
+			input: "a\r\n```\r\nx\r\n```\r\nb\r\n",
+			want:  []span{{"```\r\nx\r\n```\r\n", 2, 4}}},
+		{name: "no final newline",
+			input: "```\nx\n```",
+			want:  []span{{"```\nx\n```", 1, 3}}},
+		{name: "unterminated block runs to the end",
+			input: "a\n```\nx\ny\n",
+			want:  []span{{"```\nx\ny\n", 2, 4}}},
+		{name: "indented block ends at its last line", indented: true,
+			input: "`a.go`\n\n    x\n    y\n\nAfter\n",
+			want:  []span{{"    x\n    y\n", 3, 4}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := ExtractCodeBlocksWithOptions([]byte(tc.input), ParseOptions{IndentedBlocks: tc.indented})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != len(tc.want) {
+				t.Fatalf("got %d blocks, want %d", len(blocks), len(tc.want))
+			}
+			for i, b := range blocks {
+				got := span{tc.input[b.Start:b.End], b.StartLine, b.EndLine}
+				if got != tc.want[i] {
+					t.Errorf("block %d spans %+v, want %+v", i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPartialParse(t *testing.T) {
+	// Two valid blocks, then a line longer than the scanner accepts
+	input := "`a.txt`\n```\nA\n```\n`b.txt`\n```\nB\n```\n\n" + strings.Repeat("x", maxLineSize+1) + "\n`c.txt`\n```\nC\n```\n"
+
+	t.Run("extraction", func(t *testing.T) {
+		for _, partial := range []bool{false, true} {
+			blocks, err := ExtractCodeBlocksWithOptions([]byte(input), ParseOptions{Partial: partial})
+			var pe *ParseError
+			if !errors.As(err, &pe) || pe.Line != 10 {
+				t.Fatalf("partial %v: error %v, want a *ParseError on line 10", partial, err)
+			}
+			if want := map[bool]int{false: 0, true: 2}[partial]; len(blocks) != want {
+				t.Errorf("partial %v: got %d blocks, want %d", partial, len(blocks), want)
+			}
+		}
+	})
+
+	t.Run("without --partial-parse nothing is applied", func(t *testing.T) {
+		inProject(t)
+		if _, err := runItf(t, Config{}, input); err == nil {
+			t.Fatal("no error")
+		}
+		for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("%s exists: %v", p, err)
+			}
+		}
+	})
+
+	t.Run("--partial-parse applies the blocks before the error", func(t *testing.T) {
+		inProject(t)
+		s := mustRun(t, Config{PartialParse: true}, input)
+		if got := readFile(t, "a.txt") + readFile(t, "b.txt"); got != "A\nB\n" {
+			t.Errorf("a.txt and b.txt = %q", got)
+		}
+		if _, err := os.Stat("c.txt"); !os.IsNotExist(err) {
+			t.Errorf("c.txt, after the error, exists: %v", err)
+		}
+		if len(s.Warnings) != 1 || !strings.Contains(s.Warnings[0], "line 10") || !strings.Contains(s.Warnings[0], "the blocks after it were not read") {
+			t.Errorf("warnings %q", s.Warnings)
+		}
+		mustRun(t, Config{Undo: true}, "")
+		if _, err := os.Stat("a.txt"); !os.IsNotExist(err) {
+			t.Errorf("a.txt survived the undo: %v", err)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package itf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ChunksDir     = "chunks"
+	recipeSuffix  = ".chunks"
+	minChunkSize  = 2 << 10
+	maxChunkSize  = 64 << 10
+	chunkBoundary = 1<<13 - 1
+)
+
+// gear holds the per-byte values of the rolling hash; it is derived from
+// sha256 so chunk boundaries are the same on every machine.
+var gear = func() (g [256]uint64) {
+	for i := range g {
+		sum := sha256.Sum256([]byte{byte(i)})
+		g[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+	return g
+}()
+
+// splitChunks cuts content where a rolling hash of the preceding bytes hits
+// a boundary, so an edit only changes the chunks around it and the rest are
+// shared with other versions. Chunks average about 8KiB.
+func splitChunks(content []byte) [][]byte {
+	var chunks [][]byte
+	for len(content) > 0 {
+		n := len(content)
+		if n > minChunkSize {
+			var h uint64
+			end := min(n, maxChunkSize)
+			n = end
+			for i := minChunkSize; i < end; i++ {
+				h = h<<1 + gear[content[i]]
+				if h&chunkBoundary == 0 {
+					n = i + 1
+					break
+				}
+			}
+		}
+		chunks = append(chunks, content[:n])
+		content = content[n:]
+	}
+	return chunks
+}
+
+// WriteChunkedBlob stores content as chunks shared by all blobs plus a recipe
+// listing them, in place of a whole blob. ReadBlob reassembles it.
+func WriteChunkedBlob(dir string, hash string, content []byte) error {
+	var recipe strings.Builder
+	for _, c := range splitChunks(content) {
+		sum := sha256.Sum256(c)
+		h := hex.EncodeToString(sum[:])
+		path := chunkPath(dir, h)
+		if !chunkIntact(path, h) {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := writeCompressed(path, c); err != nil {
+				return err
+			}
+		}
+		recipe.WriteString(h + "\n")
+	}
+	path := BlobPath(dir, hash) + recipeSuffix
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(recipe.String()), 0644)
+}
+
+func chunkIntact(path, hash string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	c, err := decompress(data)
+	return err == nil && sha256Hex(c) == hash
+}
+
+func chunkPath(dir string, hash string) string {
+	return filepath.Join(dir, ChunksDir, hash[:2], hash[2:])
+}
+
+// readChunkedBlob reassembles the blob for hash from its recipe.
+func readChunkedBlob(dir string, hash string) ([]byte, error) {
+	recipe, err := os.ReadFile(BlobPath(dir, hash) + recipeSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	for _, h := range strings.Fields(string(recipe)) {
+		if len(h) != sha256.Size*2 {
+			return nil, fmt.Errorf("blob %s: invalid chunk %q", hash, h)
+		}
+		data, err := os.ReadFile(chunkPath(dir, h))
+		if err != nil {
+			return nil, fmt.Errorf("blob %s: %w", hash, err)
+		}
+		c, err := decompress(data)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(c)
+	}
+	return b.Bytes(), nil
+}
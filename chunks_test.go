@@ -0,0 +1,90 @@
+package itf
+
+import (
+	"bytes"
+	"io/fs"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// randomBytes returns n bytes that are the same on every run.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.NewChaCha8([32]byte{1}).Read(b)
+	return b
+}
+
+func countChunks(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(filepath.Join(dir, ChunksDir), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestChunkedBlobRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content []byte
+	}{
+		{name: "empty", content: []byte{}},
+		{name: "smaller than a chunk", content: []byte("package main\n")},
+		{name: "text", content: bytes.Repeat([]byte("a line of source code\n"), 20000)},
+		{name: "random megabyte", content: randomBytes(1 << 20)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			hash := sha256Hex(tc.content)
+			if err := WriteChunkedBlob(dir, hash, tc.content); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadBlob(dir, hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tc.content) {
+				t.Errorf("read back %d bytes, wrote %d", len(got), len(tc.content))
+			}
+			chunks := splitChunks(tc.content)
+			for i, c := range chunks {
+				if len(c) > maxChunkSize || i < len(chunks)-1 && len(c) < minChunkSize {
+					t.Errorf("chunk %d of %d has %d bytes", i, len(chunks), len(c))
+				}
+			}
+		})
+	}
+}
+
+func TestChunkedBlobDedup(t *testing.T) {
+	dir := t.TempDir()
+	first := randomBytes(512 << 10)
+	// The same content with a few bytes inserted in the middle
+	second := slices.Concat(first[:200<<10], []byte("an edit"), first[200<<10:])
+
+	if err := WriteChunkedBlob(dir, sha256Hex(first), first); err != nil {
+		t.Fatal(err)
+	}
+	before := countChunks(t, dir)
+	if err := WriteChunkedBlob(dir, sha256Hex(second), second); err != nil {
+		t.Fatal(err)
+	}
+	added := countChunks(t, dir) - before
+	if added > 2 {
+		t.Errorf("a small edit added %d of %d chunks", added, before)
+	}
+	for _, content := range [][]byte{first, second} {
+		got, err := ReadBlob(dir, sha256Hex(content))
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("blob not read back after dedup: %v", err)
+		}
+	}
+}
@@ -1,21 +1,96 @@
 package itf
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"runtime/debug"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type CLIConfig struct {
-	OutputDiffFix bool
-	Undo          bool
-	Redo          bool
-	NoAnimation   bool
-	Extensions    []string
-	Completion    string
-	Files         []string
+	OutputDiffFix          bool
+	Undo                   bool
+	Redo                   bool
+	NoAnimation            bool
+	Extensions             []string
+	Completion             string
+	CompletionInstall      string
+	PrintConfig            bool
+	ShellFunction          string
+	Doctor                 bool
+	Files                  []string
+	Langs                  []string
+	Message                string
+	ListHistory            bool
+	TrashDir               string
+	NoHistory              bool
+	AdditionsOnly          bool
+	DryRun                 bool
+	Print0                 bool
+	IndentedBlocks         bool
+	Base64                 bool
+	ShowStateDelta         bool
+	Owner                  string
+	Group                  string
+	IgnoreWhitespace       bool
+	AllowOutsideRoot       bool
+	TrimTrailingWhitespace bool
+	Restore                string
+	StrictIndent           bool
+	LooseMatch             bool
+	WriteManifest          bool
+	RewriteDiffFix         bool
+	Reindent               bool
+	Squash                 int
+	Explain                string
+	ChainRenames           bool
+	DiffPrefix             string
+	MaxFiles               int
+	Force                  bool
+	BackupState            bool
+	RestoreState           string
+	SummaryOut             string
+	Verify                 bool
+	ProgressPlain          bool
+	Reset                  bool
+	Yes                    bool
+	Only                   string
+	FilesFrom              string
+	Output                 string
+	Grep                   string
+	ExportHistory          string
+	ImportHistory          string
+	RestoreTrashed         bool
+	DiffLast               bool
+	DiffAlgorithm          string
+	Template               bool
+	Vars                   []string
+	NoBackupExtensions     []string
+	ConflictMarkers        bool
+	FromGitDiff            bool
+	ChunkedBlobs           bool
+	SearchWindow           int
+	SavePatch              string
+	LintIndent             bool
+	Resume                 bool
+	RevertDiff             bool
+	PruneTrash             bool
+	PartialParse           bool
+	InvalidUTF8            string
+	Patch                  bool
+	Quiet                  bool
+	Watch                  bool
+	WatchInterval          time.Duration
 }
 
 var cfg = &CLIConfig{}
@@ -32,58 +107,434 @@ Example: pbpaste | itf -e py`,
 			return handleCompletion(cmd)
 		}
 
+		if cfg.CompletionInstall != "" {
+			return installCompletion(cmd, cfg.CompletionInstall)
+		}
+
+		if cfg.ShellFunction != "" {
+			fn, err := ShellFunction(cfg.ShellFunction, pasteCommand())
+			if err != nil {
+				return err
+			}
+			fmt.Print(fn)
+			return nil
+		}
+
+		if err := ApplyTheme(os.Getenv("ITF_COLORS")); err != nil {
+			return fmt.Errorf("ITF_COLORS: %w", err)
+		}
+
+		if cfg.Doctor {
+			return runDoctor(cmd)
+		}
+
 		if cfg.Undo && cfg.Redo {
 			return fmt.Errorf("error: --undo and --redo are mutually exclusive")
 		}
 
 		normalizeExtensions()
+		if cfg.FilesFrom != "" {
+			files, err := readFileList(cfg.FilesFrom)
+			if err != nil {
+				return err
+			}
+			cfg.Files = append(cfg.Files, files...)
+		}
+		diffPrefix, err := parseDiffPrefix(cfg.DiffPrefix)
+		if err != nil {
+			return err
+		}
+		vars, err := parseVars(cfg.Vars)
+		if err != nil {
+			return err
+		}
 
 		itfCfg := &Config{
-			OutputDiffFix: cfg.OutputDiffFix,
-			Undo:          cfg.Undo,
-			Redo:          cfg.Redo,
-			Extensions:    cfg.Extensions,
-			Files:         cfg.Files,
+			OutputDiffFix:          cfg.OutputDiffFix,
+			Undo:                   cfg.Undo,
+			Redo:                   cfg.Redo,
+			Extensions:             cfg.Extensions,
+			Files:                  cfg.Files,
+			Langs:                  cfg.Langs,
+			Message:                cfg.Message,
+			ListHistory:            cfg.ListHistory,
+			TrashDir:               cfg.TrashDir,
+			NoHistory:              cfg.NoHistory,
+			AdditionsOnly:          cfg.AdditionsOnly,
+			DryRun:                 cfg.DryRun,
+			IndentedBlocks:         cfg.IndentedBlocks,
+			Base64:                 cfg.Base64,
+			ShowStateDelta:         cfg.ShowStateDelta,
+			Owner:                  cfg.Owner,
+			Group:                  cfg.Group,
+			IgnoreWhitespace:       cfg.IgnoreWhitespace,
+			AllowOutsideRoot:       cfg.AllowOutsideRoot,
+			TrimTrailingWhitespace: cfg.TrimTrailingWhitespace,
+			Restore:                cfg.Restore,
+			StrictIndent:           cfg.StrictIndent,
+			LooseMatch:             cfg.LooseMatch,
+			WriteManifest:          cfg.WriteManifest,
+			RewriteDiffFix:         cfg.RewriteDiffFix,
+			Reindent:               cfg.Reindent,
+			Squash:                 cfg.Squash,
+			Explain:                cfg.Explain,
+			ChainRenames:           cfg.ChainRenames,
+			DiffPrefix:             diffPrefix,
+			MaxFiles:               cfg.MaxFiles,
+			Force:                  cfg.Force,
+			BackupState:            cfg.BackupState,
+			RestoreState:           cfg.RestoreState,
+			Verify:                 cfg.Verify,
+			Reset:                  cfg.Reset,
+			Only:                   cfg.Only,
+			Grep:                   cfg.Grep,
+			ExportHistory:          cfg.ExportHistory,
+			ImportHistory:          cfg.ImportHistory,
+			RestoreTrashed:         cfg.RestoreTrashed,
+			DiffLast:               cfg.DiffLast,
+			Template:               cfg.Template || len(vars) > 0,
+			Vars:                   vars,
+			NoBackupExtensions:     cfg.NoBackupExtensions,
+			ConflictMarkers:        cfg.ConflictMarkers,
+			FromGitDiff:            cfg.FromGitDiff,
+			ChunkedBlobs:           cfg.ChunkedBlobs,
+			SearchWindow:           cfg.SearchWindow,
+			SavePatch:              cfg.SavePatch,
+			LintIndent:             cfg.LintIndent,
+			Resume:                 cfg.Resume,
+			RevertDiff:             cfg.RevertDiff,
+			PruneTrash:             cfg.PruneTrash,
+			PartialParse:           cfg.PartialParse,
+			InvalidUTF8:            cfg.InvalidUTF8,
+			DiffAlgorithm:          cfg.DiffAlgorithm,
+		}
+
+		if cfg.PrintConfig {
+			return printConfig(cmd, itfCfg)
+		}
+
+		if cfg.Reset && !cfg.Force && !cfg.Yes {
+			if err := confirmReset(); err != nil {
+				return err
+			}
 		}
 
 		app, err := NewApp(itfCfg)
 		if err != nil {
 			return fmt.Errorf("failed to initialize application: %w", err)
 		}
+		// Piped input leaves no terminal to ask on, so every hunk applies
+		if cfg.Patch && isTerminal(os.Stdin) {
+			app.SetHunkSelector(promptHunk(bufio.NewReader(os.Stdin)))
+		}
 
-		if cfg.OutputDiffFix {
-			_, err := app.Execute()
-			return err
+		if cfg.Watch {
+			fmt.Fprintln(os.Stderr, "Watching the clipboard; press Ctrl-C to stop")
+			return app.Watch(cmd.Context(), cfg.WatchInterval, func(s Summary, err error) {
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Error:", err)
+					return
+				}
+				fmt.Print(FormatSummary(s))
+			})
+		}
+
+		switch cfg.Output {
+		case "", "text":
+		case "tap":
+			summary, err := app.ExecuteContext(cmd.Context())
+			if err != nil {
+				return err
+			}
+			fmt.Print(FormatTAP(summary))
+			if err := writeSummaryOut(summary); err != nil {
+				return err
+			}
+			return exitWithOutcome(cmd, summary)
+		default:
+			return fmt.Errorf("invalid --output %q: want text or tap", cfg.Output)
+		}
+
+		if cfg.Print0 {
+			summary, err := app.ExecuteContext(cmd.Context())
+			if err != nil {
+				return err
+			}
+			fmt.Print(FormatPaths0(summary))
+			// Failures go to stderr, and make the exit status non-zero
+			fmt.Fprint(os.Stderr, formatFailures(summary))
+			if err := writeSummaryOut(summary); err != nil {
+				return err
+			}
+			return exitWithOutcome(cmd, summary)
+		}
+
+		if cfg.OutputDiffFix || cfg.RewriteDiffFix || cfg.ListHistory || cfg.Squash > 0 || cfg.Explain != "" || cfg.RestoreState != "" || cfg.Reset || cfg.ExportHistory != "" || cfg.ImportHistory != "" || cfg.DiffLast || cfg.PruneTrash {
+			summary, err := app.ExecuteContext(cmd.Context())
+			if err != nil {
+				return err
+			}
+			if !cfg.Quiet {
+				fmt.Print(FormatSummary(summary))
+			}
+			return writeSummaryOut(summary)
 		}
 
 		ui := NewTUI(app, cfg.NoAnimation)
-		return ui.Run()
+		ui.Quiet, ui.SummaryOut, ui.ProgressPlain = cfg.Quiet, cfg.SummaryOut, cfg.ProgressPlain
+		summary, err := ui.Run(cmd.Context())
+		if err != nil {
+			return err
+		}
+		return exitWithOutcome(cmd, summary)
 	},
 }
 
+// confirmReset asks on the terminal before --reset discards all history.
+// Without a terminal to ask on, --force or --yes is required.
+func confirmReset() error {
+	if !isTerminal(os.Stdin) {
+		return fmt.Errorf("--reset removes all history; rerun with --force to confirm")
+	}
+	fmt.Fprint(os.Stderr, "Remove all itf history, blobs and trash for this project? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+		return fmt.Errorf("reset cancelled")
+	}
+	return nil
+}
+
+// promptHunk asks on the terminal whether to apply each diff hunk, as
+// git add -p does.
+func promptHunk(in *bufio.Reader) HunkSelector {
+	return func(path string, n, total int, text string) bool {
+		fmt.Fprintf(os.Stderr, "%s (hunk %d/%d)\n%s\nApply this hunk? [y/N] ", path, n, total, text)
+		answer, _ := in.ReadString('\n')
+		a := strings.ToLower(strings.TrimSpace(answer))
+		return a == "y" || a == "yes"
+	}
+}
+
+func writeSummaryOut(s Summary) error {
+	if cfg.SummaryOut == "" {
+		return nil
+	}
+	return WriteSummaryFile(cfg.SummaryOut, s)
+}
+
+// exitWithOutcome turns a non-success outcome into an ExitCodeError. The
+// summary has already been printed, so cobra is told not to report it again.
+func exitWithOutcome(cmd *cobra.Command, s Summary) error {
+	code := ExitCode(s)
+	if code == ExitOK {
+		return nil
+	}
+	cmd.SilenceErrors = true
+	cmd.SilenceUsage = true
+	return &ExitCodeError{Code: code}
+}
+
+// runDoctor prints the self-check and fails if a critical check did.
+func runDoctor(cmd *cobra.Command) error {
+	checks := RunDoctor()
+	fmt.Print(FormatDoctor(checks))
+	for _, c := range checks {
+		if c.Critical && !c.OK {
+			cmd.SilenceErrors = true
+			cmd.SilenceUsage = true
+			return &ExitCodeError{Code: ExitError}
+		}
+	}
+	return nil
+}
+
 func handleCompletion(cmd *cobra.Command) error {
-	switch cfg.Completion {
+	return writeCompletion(cmd, cfg.Completion, os.Stdout)
+}
+
+func writeCompletion(cmd *cobra.Command, shell string, w io.Writer) error {
+	switch shell {
 	case "bash":
-		return cmd.Root().GenBashCompletion(os.Stdout)
+		return cmd.Root().GenBashCompletion(w)
 	case "zsh":
-		return cmd.Root().GenZshCompletion(os.Stdout)
+		return cmd.Root().GenZshCompletion(w)
 	case "fish":
-		return cmd.Root().GenFishCompletion(os.Stdout, true)
+		return cmd.Root().GenFishCompletion(w, true)
 	case "powershell":
-		return cmd.Root().GenPowerShellCompletionWithDesc(os.Stdout)
+		return cmd.Root().GenPowerShellCompletionWithDesc(w)
 	default:
-		return fmt.Errorf("unsupported shell for completion: %s", cfg.Completion)
+		return fmt.Errorf("unsupported shell for completion: %s", shell)
+	}
+}
+
+// installCompletion writes the completion script where shell loads it from
+// and reports the path.
+func installCompletion(cmd *cobra.Command, shell string) error {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	path, note, err := completionInstallPath(shell, home, os.Getenv)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	if err := writeCompletion(cmd, shell, &b); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Installed %s completion to %s\n", shell, path)
+	if note != "" {
+		fmt.Println(note)
+	}
+	return nil
+}
+
+// completionInstallPath returns the conventional per-user completion file
+// for shell, plus a note on what the user still has to do.
+func completionInstallPath(shell, home string, getenv func(string) string) (string, string, error) {
+	xdg := func(env, fallback string) string {
+		if dir := getenv(env); dir != "" {
+			return dir
+		}
+		return filepath.Join(home, fallback)
+	}
+
+	switch shell {
+	case "bash":
+		dir := xdg("XDG_DATA_HOME", filepath.Join(".local", "share"))
+		return filepath.Join(dir, "bash-completion", "completions", "itf"),
+			"Start a new shell to load it (requires the bash-completion package).", nil
+	case "zsh":
+		return filepath.Join(home, ".zfunc", "_itf"),
+			"Add 'fpath=(~/.zfunc $fpath); autoload -U compinit; compinit' to ~/.zshrc if it is not there, then start a new shell.", nil
+	case "fish":
+		dir := xdg("XDG_CONFIG_HOME", ".config")
+		return filepath.Join(dir, "fish", "completions", "itf.fish"), "", nil
 	}
+	return "", "", fmt.Errorf("unsupported shell for completion install: %s", shell)
+}
+
+// envFlags maps flags to the environment variables that supply their
+// defaults.
+var envFlags = map[string]string{
+	"trash-dir": "ITF_TRASH_DIR",
+	"extension": "ITF_EXTENSIONS",
+	"file":      "ITF_FILES",
+}
+
+// addEnvFlags registers the flags listed in envFlags, taking their defaults
+// from the environment; a flag given on the command line replaces its
+// default.
+func addEnvFlags(fs *pflag.FlagSet, c *CLIConfig) {
+	fs.StringSliceVarP(&c.Extensions, "extension", "e", envList("ITF_EXTENSIONS"), "Filter by extension (env ITF_EXTENSIONS)")
+	fs.StringSliceVarP(&c.Files, "file", "f", envList("ITF_FILES"), "Filter by files (env ITF_FILES)")
+	fs.StringVar(&c.TrashDir, "trash-dir", os.Getenv("ITF_TRASH_DIR"), "Directory for deleted files (env ITF_TRASH_DIR)")
+}
+
+// envList reads a comma-separated list from the environment, ignoring empty
+// items.
+func envList(name string) []string {
+	list := []string{}
+	for item := range strings.SplitSeq(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// printConfig dumps the resolved Config as JSON, with each flag's source:
+// "flag" when given on the command line, "env" when taken from the
+// environment, otherwise "default".
+func printConfig(cmd *cobra.Command, c *Config) error {
+	sources := make(map[string]string)
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		switch {
+		case f.Changed:
+			sources[f.Name] = "flag"
+		case envFlags[f.Name] != "" && os.Getenv(envFlags[f.Name]) != "":
+			sources[f.Name] = "env"
+		default:
+			sources[f.Name] = "default"
+		}
+	})
+
+	out, err := json.MarshalIndent(struct {
+		Config  *Config
+		Sources map[string]string
+	}{c, sources}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// parseDiffPrefix reads --diff-prefix: "OLD,NEW", or "none" for diffs
+// without path prefixes. Empty keeps the a/ and b/ default.
+func parseDiffPrefix(s string) (*DiffPrefix, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "none":
+		return &DiffPrefix{}, nil
+	}
+	oldPrefix, newPrefix, ok := strings.Cut(s, ",")
+	if !ok {
+		return nil, fmt.Errorf("--diff-prefix must be OLD,NEW or none, got %q", s)
+	}
+	return &DiffPrefix{Old: oldPrefix, New: newPrefix}, nil
 }
 
 func normalizeExtensions() {
-	for i, ext := range cfg.Extensions {
-		if len(ext) > 0 && ext[0] != '.' {
-			cfg.Extensions[i] = "." + ext
+	for _, exts := range [][]string{cfg.Extensions, cfg.NoBackupExtensions} {
+		for i, ext := range exts {
+			if len(ext) > 0 && ext[0] != '.' {
+				exts[i] = "." + ext
+			}
 		}
 	}
 }
 
+// readFileList reads one path per line, skipping blank lines and lines
+// starting with #.
+func readFileList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --files-from: %w", err)
+	}
+	var files []string
+	for line := range strings.SplitSeq(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+	}
+	return files, nil
+}
+
+// parseVars turns repeated --var key=value flags into a map; a later key
+// replaces an earlier one.
+func parseVars(flags []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, f := range flags {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --var %q: want key=value", f)
+		}
+		vars[key] = value
+	}
+	return vars, nil
+}
+
 func getVersion() string {
 	info, ok := debug.ReadBuildInfo()
 	if !ok || info.Main.Version == "" {
@@ -94,17 +545,85 @@ func getVersion() string {
 }
 
 func init() {
+	rootCmd.Flags().StringVar(&cfg.ShellFunction, "install-shell-function", "", "Print an itfp helper that pipes the clipboard into itf (bash, zsh, fish, powershell)")
+	rootCmd.Flags().BoolVar(&cfg.Doctor, "doctor", false, "Check git, nvim, the clipboard and the state directory, then exit")
+	rootCmd.Flags().BoolVar(&cfg.PrintConfig, "print-config", false, "Print the resolved configuration as JSON and exit")
 	rootCmd.Flags().StringVar(&cfg.Completion, "completion", "", "Generate completion script")
+	rootCmd.Flags().StringVar(&cfg.CompletionInstall, "completion-install", "", "Install the completion script for this shell (bash, zsh, fish)")
+	rootCmd.Flags().BoolVar(&cfg.Watch, "watch", false, "Poll the clipboard and apply its content whenever it changes")
+	rootCmd.Flags().DurationVar(&cfg.WatchInterval, "watch-interval", time.Second, "Clipboard polling interval for --watch")
+	rootCmd.Flags().BoolVar(&cfg.DiffLast, "diff-last", false, "Diff each file of the last operation against what itf wrote, showing edits made since")
+	rootCmd.Flags().StringVar(&cfg.DiffAlgorithm, "diff-algorithm", DiffMyers, "Algorithm for generated diffs: myers or patience")
+	rootCmd.Flags().BoolVar(&cfg.Template, "template", false, "Expand file blocks as Go templates using the --var values")
+	rootCmd.Flags().StringArrayVar(&cfg.Vars, "var", nil, "Template variable as key=value, for {{.key}} (repeatable; implies --template)")
+	rootCmd.Flags().StringVar(&cfg.Explain, "explain", "", "Explain how the input would affect this path, without writing")
 	rootCmd.Flags().BoolVarP(&cfg.OutputDiffFix, "output-diff-fix", "o", false, "Print corrected diff")
+	rootCmd.Flags().BoolVar(&cfg.RewriteDiffFix, "rewrite-diff-fix", false, "Print the input with each diff block replaced by its corrected version")
 	rootCmd.Flags().BoolVar(&cfg.NoAnimation, "no-animation", false, "Disable spinner")
-	rootCmd.Flags().StringSliceVarP(&cfg.Extensions, "extension", "e", []string{}, "Filter by extension")
-	rootCmd.Flags().StringSliceVarP(&cfg.Files, "file", "f", []string{}, "Filter by files")
+	addEnvFlags(rootCmd.Flags(), cfg)
+	rootCmd.Flags().StringVar(&cfg.FilesFrom, "files-from", "", "Read more --file paths from a file, one per line")
+	rootCmd.Flags().StringSliceVar(&cfg.Langs, "lang", []string{}, "Filter file blocks by fence language")
 	rootCmd.Flags().BoolVarP(&cfg.Undo, "undo", "u", false, "Undo last op")
 	rootCmd.Flags().BoolVarP(&cfg.Redo, "redo", "r", false, "Redo last op")
+	rootCmd.Flags().IntVar(&cfg.Squash, "squash", 0, "Merge the last N history entries into one")
+	rootCmd.Flags().BoolVar(&cfg.Verify, "verify", false, "Re-read each written file and fail it if the content differs")
+	rootCmd.Flags().StringVar(&cfg.Output, "output", "text", "Summary format: text or tap")
+	rootCmd.Flags().StringVar(&cfg.SummaryOut, "summary-out", "", "Also write the summary as plain text to this file")
+	rootCmd.Flags().BoolVar(&cfg.ProgressPlain, "progress-plain", false, "Print progress as PROGRESS lines on stderr (default when stdout is not a terminal)")
+	rootCmd.Flags().BoolVarP(&cfg.Quiet, "quiet", "q", false, "Print nothing to the terminal")
+	rootCmd.Flags().StringVar(&cfg.Grep, "grep", "", "Apply only file and diff blocks whose content matches this regexp")
+	rootCmd.Flags().StringVar(&cfg.Only, "only", "", "Apply only one action type: write, rename or delete")
+	rootCmd.Flags().BoolVar(&cfg.Reset, "reset", false, "Remove all history, blobs and trash for this project (asks first unless --force)")
+	rootCmd.Flags().BoolVarP(&cfg.Yes, "yes", "y", false, "Confirm --reset without asking, like --force")
+	rootCmd.Flags().StringSliceVar(&cfg.NoBackupExtensions, "no-backup-ext", nil, "Do not keep undo copies of files ending in these extensions (e.g. min.js,lock)")
+	rootCmd.Flags().BoolVar(&cfg.BackupState, "backup-state", false, "Back up the history before --squash, --prune-trash or an apply drops entries from it")
+	rootCmd.Flags().StringVar(&cfg.RestoreState, "restore-state", "", "Replace the history with a backup made by --backup-state")
+	rootCmd.Flags().StringVar(&cfg.ExportHistory, "export-history", "", "Write the history and the file contents it refers to into one portable file")
+	rootCmd.Flags().StringVar(&cfg.ImportHistory, "import-history", "", "Replace the history with a file written by --export-history")
+	rootCmd.Flags().BoolVar(&cfg.RestoreTrashed, "restore-trashed", false, "Restore a file deleted by itf before a block recreates or patches it, keeping its history")
+	rootCmd.Flags().StringVar(&cfg.Restore, "restore", "", "Restore a file deleted by itf without undoing the whole operation")
+	rootCmd.Flags().StringVarP(&cfg.Message, "message", "m", "", "Label recorded with this operation")
+	rootCmd.Flags().BoolVar(&cfg.ListHistory, "list-history", false, "List recorded operations")
+	rootCmd.Flags().BoolVarP(&cfg.DryRun, "dry-run", "n", false, "Show what would change without writing")
+	rootCmd.Flags().BoolVarP(&cfg.Print0, "print0", "0", false, "Print affected paths separated by NUL, failed ones to stderr; changes are applied unless --dry-run")
+	rootCmd.Flags().BoolVar(&cfg.RevertDiff, "revert-diff", false, "Apply each diff block in reverse, undoing a patch applied earlier")
+	rootCmd.Flags().BoolVar(&cfg.FromGitDiff, "from-git-diff", false, "Read the input as raw git diff output rather than markdown")
+	rootCmd.Flags().BoolVar(&cfg.ChunkedBlobs, "chunked-blobs", false, "Store new undo copies as chunks shared between similar versions")
+	rootCmd.Flags().BoolVar(&cfg.Base64, "base64", false, "Decode base64-encoded input before parsing")
+	rootCmd.Flags().BoolVar(&cfg.PartialParse, "partial-parse", false, "Apply the blocks read before a line that cannot be parsed instead of failing")
+	rootCmd.Flags().BoolVar(&cfg.IndentedBlocks, "indented-blocks", false, "Also parse 4-space indented code blocks after a path hint")
+	rootCmd.Flags().BoolVar(&cfg.TrimTrailingWhitespace, "trim-trailing-whitespace", false, "Strip trailing spaces and tabs from written lines")
+	rootCmd.Flags().BoolVar(&cfg.Reindent, "reindent", false, "Re-indent added diff lines to match the file's indentation unit")
+	rootCmd.Flags().StringVar(&cfg.DiffPrefix, "diff-prefix", "", "Diff path prefixes as OLD,NEW (e.g. i/,w/), or none (default a/,b/)")
+	rootCmd.Flags().BoolVar(&cfg.ChainRenames, "chain-renames", false, "Treat rename lines with more than two paths as chained moves")
+	rootCmd.Flags().StringVar(&cfg.InvalidUTF8, "invalid-utf8", "", "Check written content for invalid UTF-8: warn, or replace it with U+FFFD")
+	rootCmd.Flags().BoolVar(&cfg.LintIndent, "lint-indent", false, "Warn when a written Go or Python file mixes tabs and spaces in its indentation")
+	rootCmd.Flags().BoolVar(&cfg.LooseMatch, "loose-match", false, "Retry unmatched diff context with whitespace, indentation included, collapsed")
+	rootCmd.Flags().BoolVar(&cfg.StrictIndent, "strict-indent", false, "Keep leading whitespace exact in --loose-match and --reindent matching")
+	rootCmd.Flags().BoolVar(&cfg.Patch, "patch", false, "Ask for each diff hunk whether to apply it (clipboard input only)")
+	rootCmd.Flags().BoolVar(&cfg.ConflictMarkers, "conflict-markers", false, "Write diffs that do not match with conflict markers around the closest lines")
+	rootCmd.Flags().BoolVar(&cfg.IgnoreWhitespace, "ignore-whitespace", false, "Skip diff hunks that only change whitespace")
+	rootCmd.Flags().BoolVar(&cfg.AdditionsOnly, "additions-only", false, "Apply only added lines from diffs, keeping removed lines")
+	rootCmd.Flags().StringVar(&cfg.Owner, "owner", "", "Chown written files to this user (Unix)")
+	rootCmd.Flags().StringVar(&cfg.Group, "group", "", "Chown written files to this group (Unix)")
+	rootCmd.Flags().BoolVar(&cfg.ShowStateDelta, "show-state-delta", false, "Print how the undo history changed (to stderr)")
+	rootCmd.Flags().BoolVar(&cfg.AllowOutsideRoot, "allow-outside-root", false, "Allow changes to paths outside the project root")
+	rootCmd.Flags().IntVar(&cfg.SearchWindow, "search-window", 0, "Match diff hunks within N lines of their declared line before searching the whole file (0 = whole file)")
+	rootCmd.Flags().IntVar(&cfg.MaxFiles, "max-files", 0, "Refuse to apply when more than N files would be touched (0 = unlimited)")
+	rootCmd.Flags().BoolVar(&cfg.Resume, "resume", false, "Finish an apply of the same input that was interrupted")
+	rootCmd.Flags().BoolVar(&cfg.Force, "force", false, "Apply even when --max-files is exceeded; let renames replace existing files; start over an interrupted apply; confirm --reset")
+	rootCmd.Flags().StringVar(&cfg.SavePatch, "save-patch", "", "Write the changes made by this run to a patch file usable with git apply")
+	rootCmd.Flags().BoolVar(&cfg.WriteManifest, "write-manifest", false, "Write .itf/last-manifest.json mapping changed paths to their blobs")
+	rootCmd.Flags().BoolVar(&cfg.NoHistory, "no-history", false, "Apply without recording undo history")
+	rootCmd.Flags().BoolVar(&cfg.PruneTrash, "prune-trash", false, "Remove trashed files that no undo in the history needs")
 
 	rootCmd.SetHelpCommand(&cobra.Command{Hidden: true})
 }
 
 func Execute() error {
-	return rootCmd.Execute()
+	return ExecuteContext(context.Background())
+}
+
+func ExecuteContext(ctx context.Context) error {
+	return rootCmd.ExecuteContext(ctx)
 }
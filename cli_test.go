@@ -0,0 +1,133 @@
+package itf
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func TestExitCodes(t *testing.T) {
+	const twoFiles = "`a.txt`\n```\nA\n```\n`b.txt`\n```\nB\n```\n"
+	for _, tc := range []struct {
+		name  string
+		cfg   Config
+		input string
+		want  int
+	}{
+		{name: "success", input: twoFiles, want: ExitOK},
+		{name: "hard error", cfg: Config{MaxFiles: 1}, input: twoFiles, want: ExitError},
+		{name: "partial failure", input: twoFiles + "```diff\n--- a/c.txt\n+++ b/c.txt\n@@ -1 +1 @@\n-missing\n+C\n```\n", want: ExitPartialFailure},
+		{name: "nothing to do", input: "No code blocks here.\n", want: ExitNothingToDo},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "c.txt", "c\n")
+			s, err := runItf(t, tc.cfg, tc.input)
+			if err == nil {
+				err = exitWithOutcome(&cobra.Command{}, s)
+			}
+			if got := ExitCodeOf(err); got != tc.want {
+				t.Errorf("exit code %d, want %d (error %v, summary %+v)", got, tc.want, err, s)
+			}
+		})
+	}
+}
+
+func TestCompletionInstallPath(t *testing.T) {
+	const home = "/home/u"
+	for _, tc := range []struct {
+		shell string
+		env   map[string]string
+		want  string
+		note  bool
+	}{
+		{shell: "bash", want: "/home/u/.local/share/bash-completion/completions/itf", note: true},
+		{shell: "bash", env: map[string]string{"XDG_DATA_HOME": "/data"}, want: "/data/bash-completion/completions/itf", note: true},
+		{shell: "zsh", want: "/home/u/.zfunc/_itf", note: true},
+		{shell: "fish", want: "/home/u/.config/fish/completions/itf.fish"},
+		{shell: "fish", env: map[string]string{"XDG_CONFIG_HOME": "/conf"}, want: "/conf/fish/completions/itf.fish"},
+	} {
+		path, note, err := completionInstallPath(tc.shell, home, func(k string) string { return tc.env[k] })
+		if err != nil {
+			t.Fatalf("%s %v: %v", tc.shell, tc.env, err)
+		}
+		if path != filepath.FromSlash(tc.want) {
+			t.Errorf("%s %v: path %q, want %q", tc.shell, tc.env, path, tc.want)
+		}
+		if (note != "") != tc.note {
+			t.Errorf("%s %v: note %q", tc.shell, tc.env, note)
+		}
+	}
+	if _, _, err := completionInstallPath("powershell", home, func(string) string { return "" }); err == nil {
+		t.Error("powershell: no error for an unsupported shell")
+	}
+}
+
+func TestFilesFrom(t *testing.T) {
+	inProject(t)
+	writeFile(t, "allow.txt", "# files itf may touch\na.txt\n\n  sub/b.txt  \r\n#c.txt\n")
+	files, err := readFileList("allow.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.txt", "sub/b.txt"}; !slices.Equal(files, want) {
+		t.Fatalf("files %q, want %q", files, want)
+	}
+
+	// Added to a -f path, the list limits what is written
+	mustRun(t, Config{Files: append([]string{"d.txt"}, files...)},
+		"`a.txt`\n```\nA\n```\n`sub/b.txt`\n```\nB\n```\n`c.txt`\n```\nC\n```\n`d.txt`\n```\nD\n```\n")
+	for p, want := range map[string]bool{"a.txt": true, "sub/b.txt": true, "c.txt": false, "d.txt": true} {
+		if _, err := os.Stat(p); (err == nil) != want {
+			t.Errorf("%s: written %v, want %v", p, err == nil, want)
+		}
+	}
+
+	if _, err := readFileList("missing.txt"); err == nil || !strings.Contains(err.Error(), "--files-from") {
+		t.Errorf("error %v, want one naming --files-from", err)
+	}
+}
+
+func TestEnvDefaults(t *testing.T) {
+	env := map[string]string{"ITF_EXTENSIONS": "go, py,,", "ITF_FILES": "a.go,b.go", "ITF_TRASH_DIR": "/tmp/trash"}
+	for _, tc := range []struct {
+		name      string
+		env       map[string]string
+		args      []string
+		wantExts  []string
+		wantFiles []string
+		wantTrash string
+	}{
+		{name: "environment defaults", env: env,
+			wantExts: []string{".go", ".py"}, wantFiles: []string{"a.go", "b.go"}, wantTrash: "/tmp/trash"},
+		{name: "flags override them", env: env, args: []string{"-e", "md", "-f", "c.go", "--trash-dir", "bin"},
+			wantExts: []string{".md"}, wantFiles: []string{"c.go"}, wantTrash: "bin"},
+		{name: "a flag overrides only its own variable", env: env, args: []string{"-f", "c.go"},
+			wantExts: []string{".go", ".py"}, wantFiles: []string{"c.go"}, wantTrash: "/tmp/trash"},
+		{name: "neither", wantExts: []string{}, wantFiles: []string{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range envFlags {
+				t.Setenv(name, tc.env[name])
+			}
+			saved := cfg
+			t.Cleanup(func() { cfg = saved })
+			cfg = &CLIConfig{}
+			fs := pflag.NewFlagSet("itf", pflag.ContinueOnError)
+			addEnvFlags(fs, cfg)
+			if err := fs.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+			normalizeExtensions()
+			if !slices.Equal(cfg.Extensions, tc.wantExts) || !slices.Equal(cfg.Files, tc.wantFiles) || cfg.TrashDir != tc.wantTrash {
+				t.Errorf("extensions %q, files %q, trash %q; want %q, %q, %q",
+					cfg.Extensions, cfg.Files, cfg.TrashDir, tc.wantExts, tc.wantFiles, tc.wantTrash)
+			}
+		})
+	}
+}
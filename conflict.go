@@ -0,0 +1,122 @@
+package itf
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	conflictStart = "<<<<<<< current"
+	conflictMid   = "======="
+	conflictEnd   = ">>>>>>> diff"
+)
+
+// HunkMatchError reports a diff hunk, numbered from 1, whose lines were not
+// found in the file. Start and End give the lines, 1-based and inclusive,
+// that look most like the hunk, or 0 when none of its lines occur.
+type HunkMatchError struct {
+	Hunk       int
+	Start, End int
+}
+
+func (e *HunkMatchError) Error() string {
+	if e.Start == 0 {
+		return fmt.Sprintf("hunk %d does not match", e.Hunk)
+	}
+	return fmt.Sprintf("hunk %d does not match (closest: lines %d-%d)", e.Hunk, e.Start, e.End)
+}
+
+// closestRegion slides a window the size of block over source from
+// startLine and returns the one with the most lines equal to block's, as
+// compared with whitespace runs collapsed. Blank lines do not count.
+func closestRegion(source, block []string, startLine int, mode matchMode) (int, int) {
+	if len(block) == 0 || len(source) == 0 {
+		return 0, 0
+	}
+	norm := mode.normalize
+	size := min(len(block), len(source))
+	best, bestScore := 0, 0
+	for i := max(0, startLine-1); i+size <= len(source); i++ {
+		score := 0
+		for j := range size {
+			if b := norm(block[j]); b != "" && norm(source[i+j]) == b {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if bestScore == 0 {
+		return 0, 0
+	}
+	return best + 1, best + size
+}
+
+// applyWithConflicts applies the hunks of raw that match source and, for each
+// one that does not, wraps the closest region in git-style conflict markers
+// with the hunk's version below the divider. It returns the merged lines and
+// the number of conflicts, or ok false when some hunk resembles nothing in
+// source.
+func applyWithConflicts(source []string, raw, path string, cfg *Config) (merged []string, conflicts int, ok bool) {
+	mode := newMatchMode(path, cfg)
+	eol := ""
+	if len(source) > 0 && strings.HasSuffix(source[0], "\r") {
+		eol = "\r"
+	}
+	marker := func(l string) string { return l + eol }
+	// newSide lists the lines h leaves in place of source[at:]
+	newSide := func(h []string, at int) []string {
+		var lines []string
+		for _, l := range h {
+			switch {
+			case strings.HasPrefix(l, "+"):
+				lines = append(lines, strings.TrimSuffix(l[1:], "\r")+eol)
+			case strings.HasPrefix(l, " "):
+				if at < len(source) {
+					lines = append(lines, source[at])
+				}
+				at++
+			default:
+				at++
+			}
+		}
+		return lines
+	}
+
+	src := newSourceIndex(source, mode)
+	cursor, last := 0, 0
+	hunks, starts := parseHunks(raw)
+	for n, h := range hunks {
+		if cfg.IgnoreWhitespace && isWhitespaceOnlyHunk(h) {
+			continue
+		}
+		if os, me := locateHunk(src, h, last, starts[n], cfg); os != -1 {
+			merged = append(merged, source[cursor:os-1]...)
+			merged = append(merged, newSide(h, os-1)...)
+			cursor, last = me, me
+			continue
+		}
+
+		block, _, _ := getTargetBlock(h)
+		start, end := closestRegion(source, block, last+1, mode)
+		if start == 0 {
+			return nil, 0, false
+		}
+		var theirs []string
+		for _, l := range h {
+			if !strings.HasPrefix(l, "-") {
+				theirs = append(theirs, strings.TrimSuffix(l[1:], "\r")+eol)
+			}
+		}
+		merged = append(merged, source[cursor:start-1]...)
+		merged = append(merged, marker(conflictStart))
+		merged = append(merged, source[start-1:end]...)
+		merged = append(merged, marker(conflictMid))
+		merged = append(merged, theirs...)
+		merged = append(merged, marker(conflictEnd))
+		cursor, last = end, end
+		conflicts++
+	}
+	return append(merged, source[cursor:]...), conflicts, true
+}
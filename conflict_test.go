@@ -0,0 +1,70 @@
+package itf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestApplyWithConflicts(t *testing.T) {
+	source := []string{"func f() {", "\tx := 1", "\treturn x", "}", "", "func g() {", "\treturn 2", "}"}
+	for _, tc := range []struct {
+		name      string
+		diff      string
+		want      []string
+		conflicts int
+		ok        bool
+	}{
+		{name: "a near miss is wrapped in markers",
+			diff: "@@ -1,4 +1,4 @@\n func f() {\n-\tx := 10\n+\tx := 2\n \treturn x\n }\n",
+			want: []string{conflictStart, "func f() {", "\tx := 1", "\treturn x", "}", conflictMid, "func f() {", "\tx := 2", "\treturn x", "}", conflictEnd,
+				"", "func g() {", "\treturn 2", "}"},
+			conflicts: 1, ok: true},
+		{name: "a matching hunk applies beside a near miss",
+			diff: "@@ -1,3 +1,3 @@\n func f() {\n-\tx := 1\n+\tx := 3\n \treturn x\n@@ -6,3 +6,3 @@\n func g() {\n-\treturn 20\n+\treturn 4\n }\n",
+			want: []string{"func f() {", "\tx := 3", "\treturn x", "}", "",
+				conflictStart, "func g() {", "\treturn 2", "}", conflictMid, "func g() {", "\treturn 4", "}", conflictEnd},
+			conflicts: 1, ok: true},
+		{name: "a hunk like nothing in the file fails",
+			diff: "@@ -1,2 +1,2 @@\n-unrelated\n+other\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, n, ok := applyWithConflicts(source, tc.diff, "f.go", &Config{})
+			if ok != tc.ok || n != tc.conflicts {
+				t.Fatalf("conflicts %d, ok %v; want %d, %v", n, ok, tc.conflicts, tc.ok)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("merged:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestConflictMarkers(t *testing.T) {
+	const source = "func f() {\n\tx := 1\n\treturn x\n}\n"
+	const input = "```diff\n--- a/f.go\n+++ b/f.go\n@@ -1,4 +1,4 @@\n func f() {\n-\tx := 10\n+\tx := 2\n \treturn x\n }\n```\n"
+	for _, tc := range []struct {
+		name    string
+		markers bool
+		want    string
+	}{
+		{name: "with --conflict-markers", markers: true,
+			want: conflictStart + "\n" + source + conflictMid + "\nfunc f() {\n\tx := 2\n\treturn x\n}\n" + conflictEnd + "\n"},
+		{name: "without it the diff fails", want: source},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "f.go", source)
+			s := mustRun(t, Config{ConflictMarkers: tc.markers}, input)
+			if got := readFile(t, "f.go"); got != tc.want {
+				t.Errorf("f.go:\n%s\nwant:\n%s", got, tc.want)
+			}
+			if failed := slices.Contains(s.Failed, "f.go"); failed == tc.markers {
+				t.Errorf("failed %q", s.Failed)
+			}
+			if tc.markers && !slices.ContainsFunc(s.Warnings, func(w string) bool { return strings.Contains(w, "wrote 1 conflict(s) to resolve") }) {
+				t.Errorf("warnings %q do not report the conflict", s.Warnings)
+			}
+		})
+	}
+}
@@ -2,6 +2,10 @@ package itf
 
 import (
 	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -25,21 +29,163 @@ func getTargetBlock(diff []string) (block []string, deletedOnly []string, delete
 	return block, deletedOnly, deletedOnlyOffset
 }
 
-func matchBlock(source, block []string, startLine int) (int, int) {
+// indentSignificant lists the extensions of languages where indentation is
+// part of the syntax.
+var indentSignificant = map[string]bool{
+	".py":     true,
+	".pyi":    true,
+	".yaml":   true,
+	".yml":    true,
+	".nim":    true,
+	".coffee": true,
+	".haml":   true,
+	".pug":    true,
+	".sass":   true,
+}
+
+// matchMode is how the lines of one file are compared with a diff's.
+type matchMode struct {
+	// fuzzy adds a second pass with whitespace runs collapsed
+	fuzzy bool
+	// keepIndent keeps leading whitespace exact in that pass
+	keepIndent bool
+}
+
+// newMatchMode picks the matching for path. Files in indentation-significant
+// languages get a second pass that tolerates whitespace within lines but not
+// in the indentation. Others are matched exactly unless cfg.LooseMatch or
+// cfg.Reindent asks for the second pass, which then ignores indentation too,
+// unless cfg.StrictIndent is set.
+func newMatchMode(path string, cfg *Config) matchMode {
+	if indentSignificant[strings.ToLower(filepath.Ext(path))] {
+		return matchMode{fuzzy: true, keepIndent: true}
+	}
+	return matchMode{fuzzy: cfg.LooseMatch || cfg.Reindent, keepIndent: cfg.StrictIndent}
+}
+
+func (m matchMode) normalize(line string) string {
+	return normalizeLineForMatching(line, m.keepIndent)
+}
+
+// sourceIndex holds the lines of a file with their normalized forms, so
+// that matching several hunks against it normalizes the file once rather
+// than once per hunk.
+type sourceIndex struct {
+	lines []string
+	// exact has trailing whitespace trimmed, for the first pass
+	exact []string
+	// fuzzy is normalized by mode, for the second pass and header anchors;
+	// it is filled on first use
+	fuzzy []string
+	mode  matchMode
+}
+
+func newSourceIndex(lines []string, mode matchMode) *sourceIndex {
+	return &sourceIndex{lines: lines, exact: normalizeLines(lines), mode: mode}
+}
+
+func (s *sourceIndex) normalized() []string {
+	if s.fuzzy == nil {
+		s.fuzzy = make([]string, len(s.lines))
+		for i, l := range s.lines {
+			s.fuzzy[i] = s.mode.normalize(l)
+		}
+	}
+	return s.fuzzy
+}
+
+// upTo returns the index of the first n lines.
+func (s *sourceIndex) upTo(n int) *sourceIndex {
+	sub := &sourceIndex{lines: s.lines[:n], exact: s.exact[:n], mode: s.mode}
+	if s.mode.fuzzy {
+		sub.fuzzy = s.normalized()[:n]
+	}
+	return sub
+}
+
+// matchBlock locates block in source at or after startLine. Lines are
+// compared ignoring trailing whitespace, including the \r of CRLF line
+// endings; failing that, in fuzzy mode, with other whitespace collapsed as
+// well (see normalizeLineForMatching).
+func matchBlock(source, block []string, startLine int, mode matchMode) (int, int) {
+	return matchBlockNear(newSourceIndex(source, mode), block, startLine, 0)
+}
+
+// matchBlockNear is matchBlock preferring a match at or after line anchor,
+// when anchor is past startLine, over an earlier one.
+func matchBlockNear(src *sourceIndex, block []string, startLine, anchor int) (int, int) {
 	if len(block) == 0 {
-		return len(source) + 1, len(source)
+		return len(src.lines) + 1, len(src.lines)
 	}
 
-	normalizedSource := normalizeLines(source)
-	normalizedBlock := normalizeLines(block)
-	startIndex := max(0, startLine-1)
+	mode := src.mode
+	exactBlock := normalizeLines(block)
+	var fuzzyBlock []string
+	if mode.fuzzy {
+		fuzzyBlock = make([]string, len(block))
+		for i, l := range block {
+			fuzzyBlock[i] = mode.normalize(l)
+		}
+	}
 
-	for i := startIndex; i <= len(normalizedSource)-len(normalizedBlock); i++ {
-		if isMatch(normalizedSource[i:i+len(normalizedBlock)], normalizedBlock) {
-			return i + 1, i + len(normalizedBlock)
+	starts := []int{startLine}
+	if anchor > startLine {
+		starts = []int{anchor, startLine}
+	}
+	for _, start := range starts {
+		if os, me := findBlock(src.exact, exactBlock, start); os != -1 {
+			return os, me
+		}
+		if !mode.fuzzy {
+			continue
+		}
+		if os, me := findBlock(src.normalized(), fuzzyBlock, start); os != -1 {
+			return os, me
 		}
 	}
+	return -1, -1
+}
+
+// headerPattern matches lines that open a function, method or type in common
+// languages.
+var headerPattern = regexp.MustCompile(`^\s*(?:(?:export|pub(?:\([^)]*\))?|public|private|protected|static|async|abstract|final|default)\s+)*(?:func|function|def|fn|class|struct|interface|impl|trait|enum|type|module)\b`)
 
+// hunkAnchor finds, at or after startLine, the source line that matches the
+// last function or class header among the context lines of h before its
+// first change, or the first such header after it. It returns 0 when the
+// hunk has no header or the header is not in source.
+func hunkAnchor(src *sourceIndex, h []string, startLine int) int {
+	header := ""
+	changed := false
+	for _, l := range h {
+		if !strings.HasPrefix(l, " ") {
+			changed = true
+			continue
+		}
+		if headerPattern.MatchString(l[1:]) && (!changed || header == "") {
+			header = l[1:]
+		}
+	}
+	if header == "" {
+		return 0
+	}
+	want := src.mode.normalize(header)
+	source := src.normalized()
+	for i := max(0, startLine-1); i < len(source); i++ {
+		if source[i] == want {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func findBlock(source, block []string, startLine int) (int, int) {
+	startIndex := max(0, startLine-1)
+	for i := startIndex; i <= len(source)-len(block); i++ {
+		if isMatch(source[i:i+len(block)], block) {
+			return i + 1, i + len(block)
+		}
+	}
 	return -1, -1
 }
 
@@ -52,51 +198,158 @@ func isMatch(source, target []string) bool {
 	return true
 }
 
-func correctDiffHunks(sourceLines []string, raw, path string) (string, error) {
-	var hunks [][]string
+var hunkStartPattern = regexp.MustCompile(`^@@ -(\d+)`)
+
+// parseHunks splits a diff into the lines of each hunk, dropping file and
+// hunk headers. starts holds the old start line each hunk's header declares,
+// or 0 when it has none.
+func parseHunks(raw string) (hunks [][]string, starts []int) {
 	var ch []string
+	start := 0
+	inHunk := false
+	// Context lines often lose their leading space, blank ones especially;
+	// keep them as context unless they only trail the hunk.
+	var pending []string
 	for _, l := range strings.Split(raw, "\n") {
 		if strings.HasPrefix(l, "---") || strings.HasPrefix(l, "+++") {
 			continue
 		}
 		if strings.HasPrefix(l, "@@") {
 			if len(ch) > 0 {
-				hunks = append(hunks, ch)
+				hunks, starts = append(hunks, ch), append(starts, start)
+			}
+			ch, pending = nil, nil
+			inHunk = true
+			start = 0
+			if m := hunkStartPattern.FindStringSubmatch(l); m != nil {
+				start, _ = strconv.Atoi(m[1])
+			}
+			continue
+		}
+		if strings.TrimRight(l, "\r") == "" {
+			if len(ch) > 0 || len(pending) > 0 {
+				pending = append(pending, " ")
 			}
-			ch = nil
 			continue
 		}
 		if strings.HasPrefix(l, "+") || strings.HasPrefix(l, "-") || strings.HasPrefix(l, " ") {
+			ch = append(ch, pending...)
+			pending = nil
 			ch = append(ch, l)
+			continue
+		}
+		if inHunk && !isDiffMetaLine(l) {
+			pending = append(pending, " "+l)
 		}
 	}
 	if len(ch) > 0 {
-		hunks = append(hunks, ch)
+		hunks, starts = append(hunks, ch), append(starts, start)
+	}
+	return hunks, starts
+}
+
+// isDiffMetaLine reports whether l is a line of diff syntax other than a
+// hunk line, such as "\ No newline at end of file" or a git file header.
+func isDiffMetaLine(l string) bool {
+	for _, p := range []string{`\`, "diff ", "index ", "new file mode", "deleted file mode", "similarity index", "rename from", "rename to", "old mode", "new mode", "Binary files"} {
+		if strings.HasPrefix(l, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectHunks returns raw with only the hunks keep accepts, and how many
+// those are. File headers are kept; a diff without hunk headers is offered
+// as a single hunk.
+func selectHunks(raw, path string, keep HunkSelector) (string, int) {
+	lines := strings.Split(raw, "\n")
+	first := slices.IndexFunc(lines, func(l string) bool { return strings.HasPrefix(l, "@@") })
+	if first == -1 {
+		if keep(path, 1, 1, raw) {
+			return raw, 1
+		}
+		return "", 0
+	}
+
+	var hunks [][]string
+	for _, l := range lines[first:] {
+		if strings.HasPrefix(l, "@@") {
+			hunks = append(hunks, nil)
+		}
+		hunks[len(hunks)-1] = append(hunks[len(hunks)-1], l)
+	}
+	kept := slices.Clone(lines[:first])
+	n := 0
+	for i, h := range hunks {
+		if keep(path, i+1, len(hunks), strings.Join(h, "\n")) {
+			kept = append(kept, h...)
+			n++
+		}
+	}
+	return strings.Join(kept, "\n"), n
+}
+
+// locateHunk returns the source lines, 1-based and inclusive, that hunk h
+// replaces, searching from line last+1, or -1 when it matches nowhere.
+// declared is the old start line from the hunk header, or 0.
+func locateHunk(src *sourceIndex, h []string, last, declared int, cfg *Config) (int, int) {
+	fullBlock, deletedOnly, deletedOnlyOffset := getTargetBlock(h)
+	// A function or class header in the context tells similar hunks apart
+	anchor := hunkAnchor(src, h, last+1)
+	match := func(block []string) (int, int) {
+		// With --search-window, look near the line the hunk header declares
+		// before searching the rest of the file
+		if w := cfg.SearchWindow; w > 0 && declared > 0 && len(block) > 0 {
+			end := min(len(src.lines), declared+w+len(block)-1)
+			if os, me := matchBlockNear(src.upTo(end), block, max(last+1, declared-w), anchor); os != -1 {
+				return os, me
+			}
+		}
+		return matchBlockNear(src, block, last+1, anchor)
+	}
+
+	os, me := match(fullBlock)
+
+	if os == -1 && len(deletedOnly) > 0 {
+		// Fallback: try to match only the deleted lines if the LLM hallucinated context
+		dos, dme := match(deletedOnly)
+		if dos != -1 {
+			os = dos - deletedOnlyOffset
+			me = dme + (len(fullBlock) - 1 - (deletedOnlyOffset + len(deletedOnly) - 1))
+		}
+		// The context around the deleted lines is replaced by the file's
+		// lines at the same distance; without enough of them, or by
+		// overlapping the previous hunk, the hunk would edit the wrong lines
+		if os <= last || me > len(src.lines) {
+			return -1, -1
+		}
 	}
+	return os, me
+}
 
+func correctDiffHunks(sourceLines []string, raw, path string, cfg *Config) (string, error) {
+	hunks, starts := parseHunks(raw)
 	if len(hunks) == 0 {
 		return "", nil
 	}
 
 	var cp []string
-	cp = append(cp, fmt.Sprintf("--- a/%s\n+++ b/%s\n", path, path))
+	prefix := cfg.diffPrefix()
+	cp = append(cp, fmt.Sprintf("--- %s%s\n+++ %s%s\n", prefix.Old, path, prefix.New, path))
+	mode := newMatchMode(path, cfg)
+	src := newSourceIndex(sourceLines, mode)
 	offset, last := 0, 0
-	for _, h := range hunks {
-		fullBlock, deletedOnly, deletedOnlyOffset := getTargetBlock(h)
-
-		os, me := matchBlock(sourceLines, fullBlock, last+1)
-
-		if os == -1 && len(deletedOnly) > 0 {
-			// Fallback: try to match only the deleted lines if the LLM hallucinated context
-			dos, dme := matchBlock(sourceLines, deletedOnly, last+1)
-			if dos != -1 {
-				os = dos - deletedOnlyOffset
-				me = dme + (len(fullBlock) - 1 - (deletedOnlyOffset + len(deletedOnly) - 1))
-			}
+	for n, h := range hunks {
+		if cfg.IgnoreWhitespace && isWhitespaceOnlyHunk(h) {
+			continue
 		}
 
+		os, me := locateHunk(src, h, last, starts[n], cfg)
 		if os == -1 {
-			return "", fmt.Errorf("failed match")
+			block, _, _ := getTargetBlock(h)
+			start, end := closestRegion(sourceLines, block, last+1, mode)
+			return "", &HunkMatchError{Hunk: n + 1, Start: start, End: end}
 		}
 
 		last = me
@@ -110,7 +363,13 @@ func correctDiffHunks(sourceLines []string, raw, path string) (string, error) {
 			}
 		}
 		ol, nl := (len(h) - ac), (len(h) - rc)
-		cp = append(cp, fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", os, ol, os+offset, nl))
+		// Pure additions are matched at the end of the file; a hunk with
+		// no old lines names the line it follows
+		header := os
+		if ol == 0 {
+			header = os - 1
+		}
+		cp = append(cp, fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", header, ol, os+offset, nl))
 
 		srcLineOffset := 0
 		for _, l := range h {
@@ -134,6 +393,41 @@ func correctDiffHunks(sourceLines []string, raw, path string) (string, error) {
 	return strings.Join(cp, ""), nil
 }
 
+// isWhitespaceOnlyHunk reports whether the removed and added lines of a hunk
+// carry the same words, i.e. the hunk only reflows whitespace.
+func isWhitespaceOnlyHunk(h []string) bool {
+	var removed, added []string
+	for _, l := range h {
+		switch {
+		case strings.HasPrefix(l, "-"):
+			removed = append(removed, strings.Fields(l[1:])...)
+		case strings.HasPrefix(l, "+"):
+			added = append(added, strings.Fields(l[1:])...)
+		}
+	}
+	return slices.Equal(removed, added)
+}
+
+// maxFuzzyLineLen is the longest line normalizeLineForMatching collapses;
+// longer ones, such as minified code, are only matched exactly, since
+// collapsing them is slow and rarely finds a match the exact pass missed.
+const maxFuzzyLineLen = 4096
+
+// normalizeLineForMatching collapses runs of whitespace within a line. With
+// keepIndent the leading whitespace must still match exactly, so tabs and
+// spaces are told apart where indentation is significant.
+func normalizeLineForMatching(line string, keepIndent bool) string {
+	if len(line) > maxFuzzyLineLen {
+		return strings.TrimRight(line, " \t\r\n")
+	}
+	body := strings.Join(strings.Fields(line), " ")
+	if !keepIndent || body == "" {
+		return body
+	}
+	indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	return indent + body
+}
+
 func normalizeLines(lines []string) []string {
 	normalized := make([]string, len(lines))
 	for i, l := range lines {
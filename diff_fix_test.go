@@ -0,0 +1,400 @@
+package itf
+
+import (
+	"bufio"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// patchLines corrects diff against source as the file at path and applies it.
+func patchLines(source []string, diff, path string, cfg *Config) ([]string, error) {
+	patched, err := correctDiffHunks(source, diff, path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return applyUnifiedDiff(source, patched, cfg), nil
+}
+
+func TestIndentationMatching(t *testing.T) {
+	// Two blocks that differ only in indentation: tabs first, then spaces
+	source := []string{
+		"def a():",
+		"\tif x:",
+		"\t\treturn 1",
+		"def b():",
+		"    if x:",
+		"        return 1",
+	}
+	spaced := "@@ -1,2 +1,2 @@\n     if x:\n-        return 1\n+        return 2\n"
+	tabbed := "@@ -1,2 +1,2 @@\n \tif x:\n-\t\treturn 1\n+\t\treturn 2\n"
+	for _, tc := range []struct {
+		name string
+		path string
+		diff string
+		cfg  Config
+		want []string // nil when the diff must not match
+	}{
+		{name: "spaces pick the space-indented block", path: "m.py", diff: spaced,
+			want: []string{"def a():", "\tif x:", "\t\treturn 1", "def b():", "    if x:", "        return 2"}},
+		{name: "tabs pick the tab-indented block", path: "m.py", diff: tabbed,
+			want: []string{"def a():", "\tif x:", "\t\treturn 2", "def b():", "    if x:", "        return 1"}},
+		{name: "exact by default elsewhere", path: "m.txt", diff: spaced,
+			want: []string{"def a():", "\tif x:", "\t\treturn 1", "def b():", "    if x:", "        return 2"}},
+		{name: "python tolerates spacing within a line", path: "m.py",
+			diff: "@@ -1,2 +1,2 @@\n     if  x:\n-        return  1\n+        return 2\n",
+			want: []string{"def a():", "\tif x:", "\t\treturn 1", "def b():", "    if x:", "        return 2"}},
+		{name: "python keeps the indentation significant", path: "m.py",
+			diff: "@@ -1,2 +1,2 @@\n   if x:\n-      return 1\n+      return 2\n"},
+		{name: "no whitespace tolerance by default", path: "m.txt",
+			diff: "@@ -1,2 +1,2 @@\n     if  x:\n-        return  1\n+        return 2\n"},
+		{name: "loose match is opt-in", path: "m.txt", cfg: Config{LooseMatch: true},
+			diff: "@@ -1,2 +1,2 @@\n   if  x:\n-      return 1\n+      return 2\n",
+			want: []string{"def a():", "\tif x:", "      return 2", "def b():", "    if x:", "        return 1"}},
+		{name: "strict indent keeps loose match indentation-sensitive", path: "m.txt", cfg: Config{LooseMatch: true, StrictIndent: true},
+			diff: "@@ -1,2 +1,2 @@\n     if  x:\n-        return  1\n+        return 2\n",
+			want: []string{"def a():", "\tif x:", "\t\treturn 1", "def b():", "    if x:", "        return 2"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := patchLines(source, tc.diff, tc.path, &tc.cfg)
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("diff matched, giving %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestLongLinesMatchExactly(t *testing.T) {
+	long := "var a = [" + strings.Repeat("1, ", maxFuzzyLineLen/3) + "];"
+	source := []string{"// header", long, "// footer"}
+	for _, tc := range []struct {
+		name    string
+		context string
+		match   bool
+	}{
+		{name: "exact long line", context: long, match: true},
+		{name: "trailing whitespace", context: long + "  ", match: true},
+		{name: "collapsed whitespace", context: strings.ReplaceAll(long, ", ", ",  ")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			diff := "@@ -1,2 +1,2 @@\n // header\n-" + tc.context + "\n+var a = [];\n"
+			got, err := patchLines(source, diff, "m.js", &Config{LooseMatch: true})
+			if !tc.match {
+				if err == nil {
+					t.Fatal("long line matched with its whitespace collapsed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"// header", "var a = [];", "// footer"}; !slices.Equal(got, want) {
+				t.Errorf("got %d lines, want the long line replaced", len(got))
+			}
+		})
+	}
+}
+
+// BenchmarkCorrectDiffHunksLongLines matches a many-hunk diff against a file
+// of minified, very long lines.
+func BenchmarkCorrectDiffHunksLongLines(b *testing.B) {
+	const lines, hunks = 400, 40
+	source := make([]string, lines)
+	for i := range source {
+		source[i] = fmt.Sprintf("/*%d*/ ", i) + strings.Repeat("f(a,b);  g( c );", 500)
+	}
+	var diff strings.Builder
+	for h := range hunks {
+		at := h * lines / hunks
+		fmt.Fprintf(&diff, "@@ -%d,2 +%d,2 @@\n %s\n-%s\n+changed %d\n", at+1, at+1, source[at], source[at+1], h)
+	}
+	for _, bc := range []struct {
+		name string
+		path string
+		cfg  Config
+	}{
+		{name: "exact", path: "m.js"},
+		{name: "loose", path: "m.js", cfg: Config{LooseMatch: true}},
+		{name: "indentation-significant", path: "m.py"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := correctDiffHunks(source, diff.String(), bc.path, &bc.cfg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestContextLinesWithoutLeadingSpace(t *testing.T) {
+	source := []string{"func a() {", "}", "", "", "func b() {", "}"}
+	joined := []string{"func a() {", "}", "", "func b() {", "}"}
+	for _, tc := range []struct {
+		name string
+		diff string
+		want []string
+	}{
+		{name: "well-formed removal of a blank line",
+			diff: "@@ -2,4 +2,3 @@\n }\n-\n \n func b() {\n", want: joined},
+		{name: "context lines lost their leading space",
+			diff: "@@ -2,4 +2,3 @@\n}\n-\n\nfunc b() {\n", want: joined},
+		{name: "stripped context between changes",
+			diff: "@@ -1,6 +1,6 @@\n-func a() {\n+func a2() {\n}\n\n\n-func b() {\n+func b2() {\n",
+			want: []string{"func a2() {", "}", "", "", "func b2() {", "}"}},
+		{name: "no newline marker is not context",
+			diff: "@@ -5,2 +5,2 @@\n func b() {\n-}\n+} // b\n\\ No newline at end of file\n",
+			want: []string{"func a() {", "}", "", "", "func b() {", "} // b"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := patchLines(source, tc.diff, "m.go", &Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	diff := func(eol string) string {
+		return strings.ReplaceAll("```diff\n--- a/f.txt\n+++ b/f.txt\n@@ -1,3 +1,4 @@\n one\n-two\n+2\n+2.5\n three\n```\n", "\n", eol)
+	}
+	for _, tc := range []struct {
+		name string
+		file string
+		diff string
+		want string
+	}{
+		{name: "CRLF file, LF diff", file: "one\r\ntwo\r\nthree\r\n", diff: diff("\n"), want: "one\r\n2\r\n2.5\r\nthree\r\n"},
+		{name: "LF file, CRLF diff", file: "one\ntwo\nthree\n", diff: diff("\r\n"), want: "one\n2\n2.5\nthree\n"},
+		{name: "CRLF file, CRLF diff", file: "one\r\ntwo\r\nthree\r\n", diff: diff("\r\n"), want: "one\r\n2\r\n2.5\r\nthree\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "f.txt", tc.file)
+			s := mustRun(t, Config{}, tc.diff)
+			if len(s.Failed) > 0 {
+				t.Fatalf("diff failed: %q", s.Warnings)
+			}
+			if got := readFile(t, "f.txt"); got != tc.want {
+				t.Errorf("f.txt = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFunctionHeaderAnchors(t *testing.T) {
+	source := []string{
+		"func first() int {",
+		"\tx := 1",
+		"\treturn x",
+		"}",
+		"",
+		"func second() int {",
+		"\tx := 1",
+		"\treturn x",
+		"}",
+	}
+	patched := func(fn string) []string {
+		lines := slices.Clone(source)
+		lines[slices.Index(source, "func "+fn+"() int {")+1] = "\tx := 2"
+		return lines
+	}
+	for _, tc := range []struct {
+		name string
+		diff string
+		want []string // nil when the diff must not match
+	}{
+		{name: "header picks the second function",
+			diff: "@@ -6,3 +6,3 @@\n func second() int {\n-\tx := 1\n+\tx := 2\n", want: patched("second")},
+		{name: "header still picks it when the other context was made up",
+			diff: "@@ -6,4 +6,4 @@\n func second() int {\n \t// made up\n-\tx := 1\n+\tx := 2\n", want: patched("second")},
+		{name: "made-up context without a header takes the first match",
+			diff: "@@ -6,3 +6,3 @@\n \t// made up\n-\tx := 1\n+\tx := 2\n", want: patched("first")},
+		{name: "header of the first function",
+			diff: "@@ -1,4 +1,4 @@\n func first() int {\n-\tx := 1\n+\tx := 2\n \t// made up\n", want: patched("first")},
+		{name: "made-up context that cannot fit before the deleted lines",
+			diff: "@@ -1,4 +1,4 @@\n func first() int {\n \t// made up\n-\tx := 1\n+\tx := 2\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := patchLines(source, tc.diff, "m.go", &Config{})
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("diff matched, giving\n%s", strings.Join(got, "\n"))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+
+	t.Run("two similar hunks in one diff", func(t *testing.T) {
+		diff := "@@ -1,4 +1,4 @@\n func first() int {\n \t// made up\n-\treturn x\n+\treturn x + 1\n" +
+			"@@ -6,4 +6,4 @@\n func second() int {\n \t// made up\n-\treturn x\n+\treturn x + 2\n"
+		got, err := patchLines(source, diff, "m.go", &Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got[2] != "\treturn x + 1" || got[7] != "\treturn x + 2" {
+			t.Errorf("got\n%s", strings.Join(got, "\n"))
+		}
+	})
+}
+
+func TestIgnoreWhitespace(t *testing.T) {
+	source := []string{"func f() {", "  a := 1", "  b := 2", "}"}
+	for _, tc := range []struct {
+		name   string
+		diff   string
+		ignore bool
+		want   []string
+	}{
+		{name: "reindented line is skipped", ignore: true,
+			diff: "@@ -1,3 +1,3 @@\n func f() {\n-  a := 1\n+\ta := 1\n   b := 2\n", want: source},
+		{name: "spaces inside a line are skipped", ignore: true,
+			diff: "@@ -2 +2 @@\n-  a := 1\n+  a  :=  1\n", want: source},
+		{name: "added blank line is skipped", ignore: true,
+			diff: "@@ -2,2 +2,3 @@\n   a := 1\n+\n   b := 2\n", want: source},
+		{name: "joined words are a change", ignore: true,
+			diff: "@@ -2 +2 @@\n-  a := 1\n+  a:=1\n", want: []string{"func f() {", "  a:=1", "  b := 2", "}"}},
+		{name: "only the whitespace hunk is skipped", ignore: true,
+			diff: "@@ -2 +2 @@\n-  a := 1\n+\ta := 1\n@@ -3 +3 @@\n-  b := 2\n+  b := 3\n", want: []string{"func f() {", "  a := 1", "  b := 3", "}"}},
+		{name: "without the flag whitespace changes apply",
+			diff: "@@ -2 +2 @@\n-  a := 1\n+\ta := 1\n", want: []string{"func f() {", "\ta := 1", "  b := 2", "}"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := patchLines(source, tc.diff, "f.go", &Config{IgnoreWhitespace: tc.ignore})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSearchWindow(t *testing.T) {
+	// The same two lines at 11-12 and 51-52, among distinct filler lines
+	var source []string
+	for i := 1; i <= 60; i++ {
+		switch i {
+		case 11, 51:
+			source = append(source, "x := 0")
+		case 12, 52:
+			source = append(source, "x++")
+		default:
+			source = append(source, fmt.Sprintf("line %d", i))
+		}
+	}
+	hunk := func(declared int) string {
+		return fmt.Sprintf("@@ -%d,2 +%d,2 @@\n x := 0\n-x++\n+x--\n", declared, declared)
+	}
+	for _, tc := range []struct {
+		name    string
+		window  int
+		diff    string
+		changed int // line, 1-based, that must become x--
+	}{
+		{name: "the whole-file search takes the first match", diff: hunk(51), changed: 12},
+		{name: "the window keeps the match near the declared line", window: 5, diff: hunk(51), changed: 52},
+		{name: "a declared line a little off still finds the near match", window: 5, diff: hunk(48), changed: 52},
+		{name: "nothing in the window falls back to the whole file", window: 5, diff: hunk(30), changed: 12},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := patchLines(source, tc.diff, "f.go", &Config{SearchWindow: tc.window})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := slices.Clone(source)
+			want[tc.changed-1] = "x--"
+			if !slices.Equal(got, want) {
+				t.Errorf("got %q, want line %d changed", got, tc.changed)
+			}
+		})
+	}
+}
+
+func TestHunkSelection(t *testing.T) {
+	// Three hunks changing lines 2, 10 and 18 of a 20-line file
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	original := strings.Join(lines, "\n") + "\n"
+	hunk := func(n int) string {
+		return fmt.Sprintf("@@ -%d,3 +%d,3 @@\n line %d\n-line %d\n+LINE %d\n line %d\n", n-1, n-1, n-1, n, n, n+1)
+	}
+	input := "```diff\n--- a/f.txt\n+++ b/f.txt\n" + hunk(2) + hunk(10) + hunk(18) + "```\n"
+
+	for _, tc := range []struct {
+		name    string
+		answers string // what the user types at the prompts
+		changed []int  // lines that must be upper-cased
+		warning string
+	}{
+		{name: "accepting some hunks applies only those", answers: "y\nn\nyes\n", changed: []int{2, 18}},
+		{name: "accepting every hunk applies the whole diff", answers: "y\nY\ny\n", changed: []int{2, 10, 18}},
+		{name: "rejecting every hunk skips the block", answers: "n\n\nno\n", warning: "f.txt: every hunk was skipped"},
+		{name: "answers running out reject the rest", answers: "y\n", changed: []int{2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "f.txt", original)
+			app, err := NewApp(&Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.sourceProvider = inputSource(t, input)
+			var asked []string
+			prompt := promptHunk(bufio.NewReader(strings.NewReader(tc.answers)))
+			app.SetHunkSelector(func(path string, n, total int, text string) bool {
+				asked = append(asked, fmt.Sprintf("%s %d/%d", path, n, total))
+				if !strings.HasPrefix(text, "@@ ") {
+					t.Errorf("hunk %d offered as %q", n, text)
+				}
+				return prompt(path, n, total, text)
+			})
+			s, err := app.Execute()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"f.txt 1/3", "f.txt 2/3", "f.txt 3/3"}; !slices.Equal(asked, want) {
+				t.Errorf("asked %q, want %q", asked, want)
+			}
+
+			want := slices.Clone(lines)
+			for _, n := range tc.changed {
+				want[n-1] = fmt.Sprintf("LINE %d", n)
+			}
+			if got := readFile(t, "f.txt"); got != strings.Join(want, "\n")+"\n" {
+				t.Errorf("f.txt = %q", got)
+			}
+			if tc.warning != "" && !slices.Contains(s.Warnings, tc.warning) {
+				t.Errorf("warnings %q, want %q", s.Warnings, tc.warning)
+			}
+			if modified := len(s.Modified) > 0; modified != (len(tc.changed) > 0) {
+				t.Errorf("modified %q with %d hunks kept", s.Modified, len(tc.changed))
+			}
+		})
+	}
+}
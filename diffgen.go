@@ -0,0 +1,310 @@
+package itf
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	DiffMyers    = "myers"
+	DiffPatience = "patience"
+
+	diffContext = 3
+)
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// GenerateUnifiedDiff compares the lines of two versions of a file and
+// returns a unified diff with three lines of context, or "" when they are
+// equal. oldName and newName are written to the headers as given, so
+// callers add any a/ and b/ prefixes or /dev/null. algorithm is DiffMyers
+// (the default when empty) or DiffPatience.
+func GenerateUnifiedDiff(oldLines, newLines []string, oldName, newName, algorithm string) (string, error) {
+	var ops []diffOp
+	switch algorithm {
+	case "", DiffMyers:
+		ops = diffLines(oldLines, newLines, myersDiff)
+	case DiffPatience:
+		ops = diffLines(oldLines, newLines, patienceDiff)
+	default:
+		return "", fmt.Errorf("unknown diff algorithm %q: want %s or %s", algorithm, DiffMyers, DiffPatience)
+	}
+	return formatUnified(ops, oldName, newName), nil
+}
+
+func (c *Config) diffAlgorithm() string {
+	if c == nil {
+		return ""
+	}
+	return c.DiffAlgorithm
+}
+
+// diffLines strips the common prefix and suffix before handing the rest to
+// diff, which keeps the search small for typical edits.
+func diffLines(a, b []string, diff func(a, b []string) []diffOp) []diffOp {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+
+	var ops []diffOp
+	for _, l := range a[:pre] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	ops = append(ops, diff(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+	return ops
+}
+
+// myersDiff finds a shortest edit script with Myers' O(ND) algorithm.
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return editAll(a, b)
+	}
+
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, slices.Clone(v[offset-d:offset+d+2]))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(a, b, trace)
+			}
+		}
+	}
+	return editAll(a, b)
+}
+
+// myersBacktrack walks the saved frontiers back from the end. trace[d] holds
+// the frontier before step d for diagonals -d..d+1.
+func myersBacktrack(a, b []string, trace [][]int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			ops = append(ops, diffOp{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			ops = append(ops, diffOp{'+', b[y]})
+		} else {
+			x--
+			ops = append(ops, diffOp{'-', a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		ops = append(ops, diffOp{' ', a[x]})
+	}
+	slices.Reverse(ops)
+	return ops
+}
+
+// patienceDiff anchors the diff on lines that occur exactly once on each
+// side, taking the longest run of them that appears in the same order, and
+// diffs the gaps between anchors recursively. Without unique lines it falls
+// back to Myers.
+func patienceDiff(a, b []string) []diffOp {
+	if len(a) == 0 || len(b) == 0 {
+		return editAll(a, b)
+	}
+
+	type count struct{ a, b, ai, bi int }
+	counts := make(map[string]*count)
+	for i, l := range a {
+		c := counts[l]
+		if c == nil {
+			c = &count{}
+			counts[l] = c
+		}
+		c.a++
+		c.ai = i
+	}
+	for i, l := range b {
+		if c := counts[l]; c != nil {
+			c.b++
+			c.bi = i
+		}
+	}
+
+	var pairs [][2]int
+	for _, l := range a {
+		if c := counts[l]; c.a == 1 && c.b == 1 {
+			pairs = append(pairs, [2]int{c.ai, c.bi})
+		}
+	}
+	anchors := longestIncreasing(pairs)
+	if len(anchors) == 0 {
+		return myersDiff(a, b)
+	}
+
+	var ops []diffOp
+	ai, bi := 0, 0
+	for _, p := range anchors {
+		ops = append(ops, diffLines(a[ai:p[0]], b[bi:p[1]], patienceDiff)...)
+		ops = append(ops, diffOp{' ', a[p[0]]})
+		ai, bi = p[0]+1, p[1]+1
+	}
+	return append(ops, diffLines(a[ai:], b[bi:], patienceDiff)...)
+}
+
+// longestIncreasing returns the longest subsequence of pairs, already
+// ordered by their first index, whose second index also increases.
+func longestIncreasing(pairs [][2]int) [][2]int {
+	var tails []int // index into pairs of the smallest tail of each length
+	prev := make([]int, len(pairs))
+	for i, p := range pairs {
+		j := sort.Search(len(tails), func(j int) bool { return pairs[tails[j]][1] >= p[1] })
+		prev[i] = -1
+		if j > 0 {
+			prev[i] = tails[j-1]
+		}
+		if j == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[j] = i
+		}
+	}
+
+	if len(tails) == 0 {
+		return nil
+	}
+	var seq [][2]int
+	for i := tails[len(tails)-1]; i >= 0; i = prev[i] {
+		seq = append(seq, pairs[i])
+	}
+	slices.Reverse(seq)
+	return seq
+}
+
+func editAll(a, b []string) []diffOp {
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, l := range a {
+		ops = append(ops, diffOp{'-', l})
+	}
+	for _, l := range b {
+		ops = append(ops, diffOp{'+', l})
+	}
+	return ops
+}
+
+// formatUnified groups ops into hunks, merging changes whose context would
+// overlap.
+func formatUnified(ops []diffOp, oldName, newName string) string {
+	var changes []int
+	for i, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	// Line numbers before each op, 0-based
+	oldAt, newAt := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldAt[i+1], newAt[i+1] = oldAt[i], newAt[i]
+		if op.kind != '+' {
+			oldAt[i+1]++
+		}
+		if op.kind != '-' {
+			newAt[i+1]++
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", oldName, newName)
+	for start := 0; start < len(changes); {
+		end := start
+		for end+1 < len(changes) && changes[end+1]-changes[end] <= 2*diffContext+1 {
+			end++
+		}
+		from := max(0, changes[start]-diffContext)
+		to := min(len(ops), changes[end]+diffContext+1)
+
+		oldStart, oldCount := oldAt[from]+1, oldAt[to]-oldAt[from]
+		newStart, newCount := newAt[from]+1, newAt[to]-newAt[from]
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, op := range ops[from:to] {
+			b.WriteByte(op.kind)
+			b.WriteString(op.line)
+			b.WriteByte('\n')
+		}
+		start = end + 1
+	}
+	return b.String()
+}
+
+var hunkRangePattern = regexp.MustCompile(`^@@ -(\S+) \+(\S+) @@`)
+
+// ReverseDiff turns a unified diff around, so that applying it undoes the
+// original: added and removed lines swap, as do the ranges of each hunk
+// header and the paths of the ---/+++ lines, which keep prefix.
+func ReverseDiff(raw string, prefix DiffPrefix) string {
+	lines := strings.Split(raw, "\n")
+	for i, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			oldPath, newPath := diffHeaderPath(l, "--- ", prefix.Old), diffHeaderPath(lines[i+1], "+++ ", prefix.New)
+			lines[i], lines[i+1] = "--- "+withPrefix(prefix.Old, newPath), "+++ "+withPrefix(prefix.New, oldPath)
+		case strings.HasPrefix(l, "+++ "):
+		case strings.HasPrefix(l, "@@"):
+			lines[i] = hunkRangePattern.ReplaceAllString(l, "@@ -$2 +$1 @@")
+		case strings.HasPrefix(l, "+"):
+			lines[i] = "-" + l[1:]
+		case strings.HasPrefix(l, "-"):
+			lines[i] = "+" + l[1:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func withPrefix(prefix, path string) string {
+	if path == "/dev/null" {
+		return path
+	}
+	return prefix + path
+}
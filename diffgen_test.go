@@ -0,0 +1,61 @@
+package itf
+
+import (
+	"strings"
+	"testing"
+)
+
+// changeRuns counts the runs of added and removed lines in a unified diff.
+func changeRuns(diff string) int {
+	runs, in := 0, false
+	for _, l := range strings.Split(diff, "\n") {
+		changed := (strings.HasPrefix(l, "+") || strings.HasPrefix(l, "-")) &&
+			!strings.HasPrefix(l, "+++") && !strings.HasPrefix(l, "---")
+		if changed && !in {
+			runs++
+		}
+		in = changed
+	}
+	return runs
+}
+
+func TestDiffAlgorithms(t *testing.T) {
+	fn := func(name, body string) string { return "func " + name + "() {\n\t" + body + "()\n}\n\n" }
+	// The last two functions move to the front, and one of them is edited
+	before := fn("a", "x") + fn("b", "y") + fn("c", "z") + fn("d", "w")
+	after := fn("c", "zz") + fn("d", "w") + fn("a", "x") + fn("b", "y")
+	oldLines := strings.Split(strings.TrimSuffix(before, "\n"), "\n")
+	newLines := strings.Split(strings.TrimSuffix(after, "\n"), "\n")
+
+	diffs := map[string]string{}
+	for _, alg := range []string{"", DiffMyers, DiffPatience} {
+		d, err := GenerateUnifiedDiff(oldLines, newLines, "a/f.go", "b/f.go", alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := applyUnifiedDiff(oldLines, d, &Config{}); strings.Join(got, "\n") != strings.Join(newLines, "\n") {
+			t.Errorf("%q diff does not apply back:\n%s", alg, d)
+		}
+		diffs[alg] = d
+	}
+	if diffs[""] != diffs[DiffMyers] {
+		t.Errorf("default diff differs from myers:\n%s", diffs[""])
+	}
+
+	// Patience keeps the moved functions whole, where Myers pairs up the
+	// braces and blank lines of every function
+	const want = "--- a/f.go\n+++ b/f.go\n@@ -1,16 +1,16 @@\n" +
+		"+func c() {\n+\tzz()\n+}\n+\n+func d() {\n+\tw()\n+}\n+\n" +
+		" func a() {\n \tx()\n }\n \n func b() {\n \ty()\n" +
+		"-}\n-\n-func c() {\n-\tz()\n-}\n-\n-func d() {\n-\tw()\n }\n \n"
+	if diffs[DiffPatience] != want {
+		t.Errorf("patience diff:\n%s\nwant:\n%s", diffs[DiffPatience], want)
+	}
+	if m, p := changeRuns(diffs[DiffMyers]), changeRuns(diffs[DiffPatience]); m <= p {
+		t.Errorf("myers has %d runs of changes and patience %d; want patience cleaner:\n%s", m, p, diffs[DiffMyers])
+	}
+
+	if _, err := GenerateUnifiedDiff(oldLines, newLines, "a", "b", "histogram"); err == nil {
+		t.Error("no error for an unknown algorithm")
+	}
+}
@@ -0,0 +1,130 @@
+package itf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/atotto/clipboard"
+)
+
+// DoctorCheck is the result of one environment check. A failed critical
+// check means itf cannot work reliably.
+type DoctorCheck struct {
+	Name     string
+	OK       bool
+	Critical bool
+	Detail   string
+}
+
+// RunDoctor checks the tools and state itf depends on.
+func RunDoctor() []DoctorCheck {
+	root, _ := findGitRoot()
+	stateDir := filepath.Join(root, stateDirName)
+	return []DoctorCheck{
+		toolCheck("git", "used to find the project root and branch"),
+		toolCheck("nvim", "optional"),
+		clipboardCheck(),
+		stateDirCheck(stateDir),
+		blobsCheck(stateDir),
+	}
+}
+
+func toolCheck(name, missing string) DoctorCheck {
+	c := DoctorCheck{Name: name}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		c.Detail = "not found in PATH (" + missing + ")"
+		return c
+	}
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil {
+		c.Detail = path
+	} else {
+		c.Detail, _, _ = strings.Cut(strings.TrimSpace(string(out)), "\n")
+	}
+	c.OK = true
+	return c
+}
+
+func clipboardCheck() DoctorCheck {
+	c := DoctorCheck{Name: "clipboard", OK: !clipboard.Unsupported}
+	if c.OK {
+		c.Detail = "a clipboard tool is available"
+	} else {
+		c.Detail = "no clipboard tool found; input must be piped on stdin"
+	}
+	return c
+}
+
+func stateDirCheck(dir string) DoctorCheck {
+	c := DoctorCheck{Name: "state dir", Critical: true}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	f, err := os.CreateTemp(dir, "doctor-*")
+	if err != nil {
+		c.Detail = fmt.Sprintf("%s is not writable: %v", dir, err)
+		return c
+	}
+	f.Close()
+	os.Remove(f.Name())
+	c.OK, c.Detail = true, dir+" is writable"
+	return c
+}
+
+// blobsCheck reads every stored blob, reassembling chunked ones, and
+// compares its content with the hash it is named after.
+func blobsCheck(stateDir string) DoctorCheck {
+	c := DoctorCheck{Name: "blobs", Critical: true}
+	var checked int
+	var corrupt []string
+	err := filepath.WalkDir(filepath.Join(stateDir, BlobsDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		// Sharded blobs are named by their directory and file name together
+		hash := strings.TrimSuffix(d.Name(), recipeSuffix)
+		if shard := filepath.Base(filepath.Dir(path)); shard != BlobsDir {
+			hash = shard + hash
+		}
+		checked++
+		content, err := ReadBlob(stateDir, hash)
+		sum := sha256.Sum256(content)
+		if err != nil || hex.EncodeToString(sum[:]) != hash {
+			corrupt = append(corrupt, hash)
+		}
+		return nil
+	})
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		c.Detail = err.Error()
+	case len(corrupt) > 0:
+		c.Detail = fmt.Sprintf("%d of %d corrupt: %s", len(corrupt), checked, strings.Join(corrupt, ", "))
+	default:
+		c.OK, c.Detail = true, fmt.Sprintf("%d checked", checked)
+	}
+	return c
+}
+
+// FormatDoctor renders checks as a checklist.
+func FormatDoctor(checks []DoctorCheck) string {
+	var b strings.Builder
+	for _, c := range checks {
+		mark := successStyle.Render("[ok]  ")
+		if !c.OK {
+			mark = warningStyle.Render("[warn]")
+			if c.Critical {
+				mark = errorStyle.Render("[FAIL]")
+			}
+		}
+		fmt.Fprintf(&b, "%s %s: %s\n", mark, c.Name, c.Detail)
+	}
+	return b.String()
+}
@@ -0,0 +1,150 @@
+package itf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ExplainPath walks content block by block and describes how each block that
+// targets path is treated by the planner, ending with the planned outcome.
+// Nothing is written.
+func ExplainPath(content, path string, resolver *PathResolver, cfg *Config) string {
+	target := resolver.Resolve(path)
+	allowed := make(map[string]struct{})
+	for _, f := range cfg.Files {
+		allowed[resolver.Resolve(f)] = struct{}{}
+	}
+
+	var b strings.Builder
+	found := 0
+	opts := ParseOptions{IndentedBlocks: cfg.IndentedBlocks}
+	err := StreamCodeBlocks(strings.NewReader(content), opts, func(cb CodeBlock) error {
+		kind := blockKind(cb, target, resolver, cfg)
+		if kind == "" {
+			return nil
+		}
+		found++
+		fmt.Fprintf(&b, "Block at line %d is a %s block for %s\n", cb.StartLine, kind, path)
+		for _, step := range explainBlock(cb, kind, target, resolver, cfg, allowed) {
+			fmt.Fprintf(&b, "  - %s\n", step)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Sprintf("Could not parse the input: %v\n", err)
+	}
+	if found == 0 {
+		return fmt.Sprintf("No block in the input targets %s\n", path)
+	}
+
+	plan, err := CreatePlanWithConfig(content, resolver, cfg)
+	if err != nil {
+		return b.String() + fmt.Sprintf("Result: planning failed: %v\n", err)
+	}
+	b.WriteString("Result: " + plannedOutcome(plan, target, resolver) + "\n")
+	return b.String()
+}
+
+func blockKind(cb CodeBlock, target string, resolver *PathResolver, cfg *Config) string {
+	switch cb.Lang {
+	case "rename", "delete":
+		for line := range strings.SplitSeq(cb.Content, "\n") {
+			for _, f := range strings.Fields(line) {
+				if resolver.Resolve(f) == target {
+					return cb.Lang
+				}
+			}
+		}
+	case "diff":
+		raw := strings.Trim(stripFenceArtifacts(cb.Content), "\n")
+		if p := ExtractPathFromDiffWithPrefix(raw, cfg.diffPrefix().New); p != "" && resolver.Resolve(p) == target {
+			return "diff"
+		}
+	default:
+		if p := blockPath(cb); p != "" && resolver.Resolve(p) == target {
+			return "file"
+		}
+	}
+	return ""
+}
+
+// explainBlock lists the planner's checks in order, stopping at the first
+// one that skips or fails the block.
+func explainBlock(cb CodeBlock, kind, target string, resolver *PathResolver, cfg *Config, allowed map[string]struct{}) []string {
+	var steps []string
+	if kind == "file" {
+		if len(cfg.Extensions) == 1 && cfg.Extensions[0] == ".diff" {
+			return append(steps, "skipped: only diff blocks are processed (-e diff)")
+		}
+		if !HasAllowedLang(cb.Lang, cfg.Langs) {
+			return append(steps, fmt.Sprintf("skipped: fence language %q is not in --lang", cb.Lang))
+		}
+		if len(cfg.Langs) > 0 {
+			steps = append(steps, fmt.Sprintf("fence language %q is allowed", cb.Lang))
+		}
+	}
+
+	if !isAllowed(target, allowed) {
+		return append(steps, "skipped: not in the --file allowlist")
+	}
+	if len(allowed) > 0 {
+		steps = append(steps, "listed in the --file allowlist")
+	}
+
+	if kind == "file" || kind == "diff" {
+		ext := filepath.Ext(target)
+		if !HasAllowedExtension(target, cfg.Extensions) {
+			return append(steps, fmt.Sprintf("skipped: extension %q is filtered out by -e", ext))
+		}
+		if len(cfg.Extensions) > 0 {
+			steps = append(steps, fmt.Sprintf("extension %q is allowed", ext))
+		}
+	}
+
+	if !cfg.AllowOutsideRoot && !resolver.IsWithinRoot(target) {
+		return append(steps, "failed: outside the project root (see --allow-outside-root)")
+	}
+
+	switch kind {
+	case "file":
+		if _, intent := hintIntent(cb.Hint); intent == intentNew {
+			if _, err := os.Stat(target); err == nil {
+				return append(steps, "failed: marked (new) but the file already exists")
+			}
+			steps = append(steps, "marked (new) and the file does not exist yet")
+		}
+	case "diff":
+		raw := strings.Trim(stripFenceArtifacts(cb.Content), "\n")
+		d := DiffBlock{FilePath: ExtractPathFromDiffWithPrefix(raw, cfg.diffPrefix().New), RawContent: raw}
+		if _, err := CorrectDiff(d, target, cfg); err != nil {
+			return append(steps, "failed: the hunks do not match the current file")
+		}
+		steps = append(steps, "hunks matched the current file")
+	}
+	return append(steps, "accepted")
+}
+
+func plannedOutcome(plan *ExecutionPlan, target string, resolver *PathResolver) string {
+	if slices.Contains(plan.Failed, target) {
+		return "listed under Failed"
+	}
+	for _, a := range plan.Actions {
+		switch {
+		case a.Type == "write" && a.Change.Path == target:
+			if plan.FileActions[target] == "create" {
+				return "would be created"
+			}
+			return "would be modified"
+		case a.Type == "delete" && a.Path == target:
+			return "would be deleted"
+		case a.Type == "rename" && a.Rename.OldPath == target:
+			return "would be renamed to " + resolver.Relative(a.Rename.NewPath)
+		case a.Type == "rename" && a.Rename.NewPath == target:
+			return "would be created by renaming " + resolver.Relative(a.Rename.OldPath)
+		}
+	}
+	return "not changed"
+}
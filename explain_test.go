@@ -0,0 +1,37 @@
+package itf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExplainPath(t *testing.T) {
+	const input = "Intro\n\n`a.go`\n```go\npackage a\n```\n" +
+		"```diff\n--- a/b.txt\n+++ b/b.txt\n@@ -1 +1 @@\n-missing\n+new\n```\n"
+	for _, tc := range []struct {
+		name string
+		path string
+		cfg  Config
+		want []string // the explanation's lines, in order
+	}{
+		{name: "block not found", path: "c.go",
+			want: []string{"No block in the input targets c.go"}},
+		{name: "extension filtered", path: "a.go", cfg: Config{Extensions: []string{".py"}},
+			want: []string{"Block at line 4 is a file block for a.go", `  - skipped: extension ".go" is filtered out by -e`, "Result: not changed"}},
+		{name: "not in the allowlist", path: "a.go", cfg: Config{Files: []string{"other.go"}},
+			want: []string{"Block at line 4 is a file block for a.go", "  - skipped: not in the --file allowlist", "Result: not changed"}},
+		{name: "accepted", path: "a.go",
+			want: []string{"Block at line 4 is a file block for a.go", "  - accepted", "Result: would be created"}},
+		{name: "diff does not match", path: "b.txt",
+			want: []string{"Block at line 7 is a diff block for b.txt", "  - failed: the hunks do not match the current file", "Result: listed under Failed"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "b.txt", "old\n")
+			got := ExplainPath(input, tc.path, newTestResolver(t), &tc.cfg)
+			if want := strings.Join(tc.want, "\n") + "\n"; got != want {
+				t.Errorf("explanation:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
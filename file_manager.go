@@ -1,13 +1,25 @@
 package itf
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 )
 
-type FileManager struct{}
+type FileManager struct {
+	// Ownership, as "uid:gid", is applied to every written file when set.
+	Ownership              string
+	TrimTrailingWhitespace bool
+	// Verify re-reads each written file and compares it with what was
+	// written; on a mismatch the file is put back and reported as failed.
+	Verify bool
+}
 
 func NewFileManager() *FileManager {
 	return &FileManager{}
@@ -15,15 +27,38 @@ func NewFileManager() *FileManager {
 
 func (m *FileManager) WriteChanges(changes []FileChange, progressCb func(int)) (updated, failed []string) {
 	for i, change := range changes {
-		content := strings.Join(change.Content, "\n")
+		lines := change.Content
+		if m.TrimTrailingWhitespace {
+			lines = trimTrailingWhitespace(lines)
+		}
+		content := strings.Join(lines, "\n")
 		if len(change.Content) > 0 {
 			content += "\n"
 		}
 
+		var previous []byte
+		var previousErr error
+		if m.Verify {
+			previous, previousErr = os.ReadFile(change.Path)
+		}
 		if err := os.WriteFile(change.Path, []byte(content), 0644); err != nil {
 			failed = append(failed, change.Path)
 			continue
 		}
+		if m.Verify && !writtenAsExpected(change.Path, []byte(content)) {
+			switch {
+			case previousErr == nil:
+				_ = os.WriteFile(change.Path, previous, 0644)
+			case errors.Is(previousErr, fs.ErrNotExist):
+				_ = os.Remove(change.Path)
+			}
+			failed = append(failed, change.Path)
+			continue
+		}
+		if err := chownPath(change.Path, m.Ownership); err != nil {
+			failed = append(failed, change.Path)
+			continue
+		}
 
 		updated = append(updated, change.Path)
 		if progressCb != nil {
@@ -33,10 +68,35 @@ func (m *FileManager) WriteChanges(changes []FileChange, progressCb func(int)) (
 	return updated, failed
 }
 
-func (m *FileManager) Undo(ops []Operation, stateDir string, projectRoot string) Summary {
+// readBack is os.ReadFile, replaced in tests to simulate a write that did not
+// land as intended.
+var readBack = os.ReadFile
+
+func writtenAsExpected(path string, want []byte) bool {
+	got, err := readBack(path)
+	return err == nil && bytes.Equal(got, want)
+}
+
+// trimTrailingWhitespace strips spaces and tabs from the end of each line,
+// before the "\r" of a CRLF line ending, which is kept.
+func trimTrailingWhitespace(lines []string) []string {
+	trimmed := make([]string, len(lines))
+	for i, l := range lines {
+		body, cr := strings.CutSuffix(l, "\r")
+		trimmed[i] = strings.TrimRight(body, " \t")
+		if cr {
+			trimmed[i] += "\r"
+		}
+	}
+	return trimmed
+}
+
+// Undo reverts ops in reverse order, so later operations on a path are
+// undone before earlier ones.
+func (m *FileManager) Undo(ops []Operation, stateDir string, trashPath string, projectRoot string) Summary {
 	var s Summary
-	for _, op := range ops {
-		if !m.undoFile(op, stateDir, projectRoot) {
+	for _, op := range slices.Backward(ops) {
+		if !m.undoFile(op, stateDir, trashPath, projectRoot) {
 			s.Failed = append(s.Failed, op.Path)
 			continue
 		}
@@ -55,7 +115,7 @@ func (m *FileManager) Undo(ops []Operation, stateDir string, projectRoot string)
 	return s
 }
 
-func (m *FileManager) undoFile(op Operation, stateDir string, projectRoot string) bool {
+func (m *FileManager) undoFile(op Operation, stateDir string, trashPath string, projectRoot string) bool {
 	currentPath := op.Path
 	if op.Action == "rename" {
 		currentPath = op.NewPath
@@ -64,7 +124,7 @@ func (m *FileManager) undoFile(op Operation, stateDir string, projectRoot string
 	checkPath := currentPath
 	if op.Action == "delete" {
 		rel, _ := filepath.Rel(projectRoot, op.Path)
-		checkPath = filepath.Join(stateDir, TrashDir, rel)
+		checkPath = filepath.Join(trashPath, rel)
 	}
 
 	actualHash, _ := GetFileSHA256(checkPath)
@@ -73,15 +133,31 @@ func (m *FileManager) undoFile(op Operation, stateDir string, projectRoot string
 	}
 
 	if op.Action == "rename" {
-		return os.Rename(op.NewPath, op.Path) == nil
+		if err := MoveFile(op.NewPath, op.Path); err != nil {
+			return false
+		}
+		removeEmptyDirs(op.Dirs)
+		// A rename that also changed the content, as one written before it
+		// or a squashed edit, puts the old content back too
+		if op.OldContentHash == "" || op.OldContentHash == op.ContentHash {
+			return true
+		}
 	}
 
 	if op.Action == "create" {
-		return os.Remove(op.Path) == nil
+		if err := os.Remove(op.Path); err != nil {
+			return false
+		}
+		removeEmptyDirs(op.Dirs)
+		return true
 	}
 
 	if op.Action == "delete" {
-		return RestoreFileFromTrash(op.Path, filepath.Join(stateDir, TrashDir), projectRoot) == nil
+		if err := RestoreFileFromTrash(op.Path, trashPath, projectRoot); err != nil {
+			return false
+		}
+		setModTime(op.Path, op.OldModTime)
+		return true
 	}
 
 	content, err := ReadBlob(stateDir, op.OldContentHash)
@@ -89,13 +165,33 @@ func (m *FileManager) undoFile(op Operation, stateDir string, projectRoot string
 		return false
 	}
 
-	return os.WriteFile(op.Path, content, 0644) == nil
+	if err := os.WriteFile(op.Path, content, 0644); err != nil {
+		return false
+	}
+	setModTime(op.Path, op.OldModTime)
+	return chownPath(op.Path, op.OldOwner) == nil
+}
+
+// setModTime sets the modification time of path to ns Unix nanoseconds,
+// unless ns is zero. Failures are ignored: the content is what matters.
+func setModTime(path string, ns int64) {
+	if ns != 0 {
+		_ = os.Chtimes(path, time.Time{}, time.Unix(0, ns))
+	}
+}
+
+// removeEmptyDirs removes those of dirs that are empty; dirs are listed
+// deepest first, so emptied parents go too.
+func removeEmptyDirs(dirs []string) {
+	for _, d := range dirs {
+		_ = os.Remove(d)
+	}
 }
 
-func (m *FileManager) Redo(ops []Operation, stateDir string, projectRoot string) Summary {
+func (m *FileManager) Redo(ops []Operation, stateDir string, trashPath string, projectRoot string) Summary {
 	var s Summary
 	for _, op := range ops {
-		if !m.redoFile(op, stateDir, projectRoot) {
+		if !m.redoFile(op, stateDir, trashPath, projectRoot) {
 			s.Failed = append(s.Failed, op.Path)
 			continue
 		}
@@ -114,18 +210,26 @@ func (m *FileManager) Redo(ops []Operation, stateDir string, projectRoot string)
 	return s
 }
 
-func (m *FileManager) redoFile(op Operation, stateDir string, projectRoot string) bool {
+func (m *FileManager) redoFile(op Operation, stateDir string, trashPath string, projectRoot string) bool {
 	actualHash, _ := GetFileSHA256(op.Path)
 	if actualHash != op.OldContentHash {
 		return false
 	}
 
+	path := op.Path
 	if op.Action == "rename" {
-		return os.Rename(op.Path, op.NewPath) == nil
+		_ = os.MkdirAll(filepath.Dir(op.NewPath), 0755)
+		if err := MoveFile(op.Path, op.NewPath); err != nil {
+			return false
+		}
+		if op.ContentHash == "" || op.ContentHash == op.OldContentHash {
+			return true
+		}
+		path = op.NewPath
 	}
 
 	if op.Action == "delete" {
-		return TrashFile(op.Path, filepath.Join(stateDir, TrashDir), projectRoot) == nil
+		return TrashFile(op.Path, trashPath, projectRoot) == nil
 	}
 
 	content, err := ReadBlob(stateDir, op.ContentHash)
@@ -133,6 +237,10 @@ func (m *FileManager) redoFile(op Operation, stateDir string, projectRoot string
 		return false
 	}
 
-	_ = os.MkdirAll(filepath.Dir(op.Path), 0755)
-	return os.WriteFile(op.Path, content, 0644) == nil
+	_ = os.MkdirAll(filepath.Dir(path), 0755)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return false
+	}
+	setModTime(path, op.ModTime)
+	return chownPath(path, op.Owner) == nil
 }
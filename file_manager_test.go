@@ -0,0 +1,187 @@
+package itf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrimTrailingWhitespace(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		trim    bool
+		want    string
+	}{
+		{name: "LF", trim: true, content: "a  \nb\t\n \nc\n", want: "a\nb\n\nc\n"},
+		{name: "CRLF keeps the carriage return", trim: true, content: "a  \r\nb\t\r\n \r\nc\r\n", want: "a\r\nb\r\n\r\nc\r\n"},
+		{name: "a lone carriage return in the line is kept", trim: true, content: "a\r b \n", want: "a\r b\n"},
+		{name: "off by default", content: "a  \r\nb\t\n", want: "a  \r\nb\t\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f.txt")
+			fm := &FileManager{TrimTrailingWhitespace: tc.trim}
+			lines := strings.Split(strings.TrimSuffix(tc.content, "\n"), "\n")
+			if _, failed := fm.WriteChanges([]FileChange{{Path: path, Content: lines}}, nil); len(failed) > 0 {
+				t.Fatalf("write failed: %q", failed)
+			}
+			if got := readFile(t, path); got != tc.want {
+				t.Errorf("wrote %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		previous string // content before the write; empty for a new file
+		verify   bool
+		corrupt  bool // whether the write reads back differently
+		want     string
+		failed   bool
+	}{
+		{name: "a mismatch puts the old content back", previous: "old\n", verify: true, corrupt: true, want: "old\n", failed: true},
+		{name: "a mismatch removes a new file", verify: true, corrupt: true, failed: true},
+		{name: "a match keeps the write", previous: "old\n", verify: true, want: "new\n"},
+		{name: "without --verify nothing is checked", previous: "old\n", corrupt: true, want: "new\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "f.txt")
+			if tc.previous != "" {
+				writeFile(t, path, tc.previous)
+			}
+			if tc.corrupt {
+				t.Cleanup(func() { readBack = os.ReadFile })
+				readBack = func(string) ([]byte, error) { return []byte("corrupted\n"), nil }
+			}
+			fm := &FileManager{Verify: tc.verify}
+			updated, failed := fm.WriteChanges([]FileChange{{Path: path, Content: []string{"new"}}}, nil)
+			if got := len(failed) > 0; got != tc.failed {
+				t.Errorf("failed %q, updated %q", failed, updated)
+			}
+			if tc.want == "" {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("new file left behind: %v", err)
+				}
+				return
+			}
+			if got := readFile(t, path); got != tc.want {
+				t.Errorf("content %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	root := t.TempDir()
+	deep := filepath.Join(root, "x", "y", "z")
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "x", "keep.txt"), "keep\n")
+	removeEmptyDirs([]string{deep, filepath.Dir(deep), filepath.Join(root, "x")})
+	if _, err := os.Stat(filepath.Join(root, "x", "y")); !os.IsNotExist(err) {
+		t.Errorf("empty x/y left behind: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "x", "keep.txt")); err != nil {
+		t.Errorf("x, which is not empty, was removed: %v", err)
+	}
+}
+
+func TestUndoRemovesCreatedDirs(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		after func(t *testing.T) // runs between the apply and the undo
+		gone  []string           // directories undo removes
+		kept  []string           // directories undo leaves
+	}{
+		{name: "nested new directories", input: "`a/b/c/f.txt`\n```\nf\n```\n", gone: []string{"a"}},
+		{name: "an existing directory stays", input: "`old/sub/f.txt`\n```\nf\n```\n",
+			gone: []string{"old/sub"}, kept: []string{"old"}},
+		{name: "two files in one new directory", input: "`new/a.txt`\n```\na\n```\n`new/b.txt`\n```\nb\n```\n",
+			gone: []string{"new"}},
+		{name: "a directory given another file stays", input: "`new/a.txt`\n```\na\n```\n",
+			after: func(t *testing.T) { writeFile(t, "new/mine.txt", "mine\n") }, kept: []string{"new"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "old/keep.txt", "keep\n")
+			mustRun(t, Config{}, tc.input)
+			if tc.after != nil {
+				tc.after(t)
+			}
+			mustRun(t, Config{Undo: true}, "")
+			for _, d := range tc.gone {
+				if _, err := os.Stat(d); !os.IsNotExist(err) {
+					t.Errorf("%s left behind: %v", d, err)
+				}
+			}
+			for _, d := range tc.kept {
+				if _, err := os.Stat(d); err != nil {
+					t.Errorf("%s removed: %v", d, err)
+				}
+			}
+
+			mustRun(t, Config{Redo: true}, "")
+			for _, d := range tc.gone {
+				if _, err := os.Stat(d); err != nil {
+					t.Errorf("%s not recreated by redo: %v", d, err)
+				}
+			}
+		})
+	}
+}
+
+func TestUndoRestoresModTime(t *testing.T) {
+	old := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	mtime := func(p string) time.Time {
+		t.Helper()
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ModTime()
+	}
+	for _, tc := range []struct {
+		name  string
+		input string
+	}{
+		{name: "modify", input: "`a.txt`\n```\nnew\n```\n"},
+		{name: "diff", input: "```diff\n--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-old\n+new\n```\n"},
+		{name: "delete", input: "```delete\na.txt\n```\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "old\n")
+			if err := os.Chtimes("a.txt", old, old); err != nil {
+				t.Fatal(err)
+			}
+			mustRun(t, Config{}, tc.input)
+			var applied time.Time
+			if tc.name != "delete" {
+				applied = mtime("a.txt")
+				// Touched since, as a build might
+				later := applied.Add(time.Hour)
+				if err := os.Chtimes("a.txt", later, later); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mustRun(t, Config{Undo: true}, "")
+			if got := mtime("a.txt"); !got.Equal(old) {
+				t.Errorf("after undo mtime %v, want %v", got, old)
+			}
+			mustRun(t, Config{Redo: true}, "")
+			if tc.name == "delete" {
+				return
+			}
+			if got := mtime("a.txt"); !got.Equal(applied) {
+				t.Errorf("after redo mtime %v, want %v", got, applied)
+			}
+		})
+	}
+}
@@ -5,10 +5,15 @@ import (
 	"compress/zlib"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 )
 
 func GetFileSHA256(path string) (string, error) {
@@ -40,7 +45,8 @@ func IsEmptyDir(name string) (bool, error) {
 }
 
 type PathResolver struct {
-	wd string
+	wd   string
+	root string
 }
 
 func NewPathResolver() (*PathResolver, error) {
@@ -48,16 +54,55 @@ func NewPathResolver() (*PathResolver, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not get current working directory: %w", err)
 	}
-	return &PathResolver{wd: wd}, nil
+	root, err := findGitRoot()
+	if err != nil {
+		root = wd
+	}
+	return &PathResolver{wd: wd, root: root}, nil
+}
+
+// IsWithinRoot reports whether an absolute path lies inside the project root
+// (the git top-level, or the working directory outside of git).
+func (r *PathResolver) IsWithinRoot(path string) bool {
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
 
 func (r *PathResolver) Resolve(relativePath string) string {
+	relativePath = fromWindowsPath(relativePath)
 	if filepath.IsAbs(relativePath) {
 		return filepath.Clean(relativePath)
 	}
 	return filepath.Join(r.wd, relativePath)
 }
 
+// fromWindowsPath makes paths written on Windows usable elsewhere:
+// backslashes become slashes, and a drive letter makes the path absolute, so
+// C:\proj\a.go becomes /proj/a.go, which the project root guard refuses
+// unless the project really lies there. On Windows both forms are
+// understood already.
+func fromWindowsPath(p string) string {
+	if filepath.Separator == '\\' {
+		return p
+	}
+	p = strings.ReplaceAll(p, `\`, "/")
+	if len(p) >= 2 && p[1] == ':' && ('a' <= p[0]|0x20 && p[0]|0x20 <= 'z') {
+		p = "/" + strings.TrimPrefix(p[2:], "/")
+	}
+	return p
+}
+
+// Relative returns path relative to the working directory when possible.
+func (r *PathResolver) Relative(path string) string {
+	if rel, err := filepath.Rel(r.wd, path); err == nil {
+		return rel
+	}
+	return path
+}
+
 func (r *PathResolver) ResolveExisting(relativePath string) string {
 	path := r.Resolve(relativePath)
 	if _, err := os.Stat(path); err == nil {
@@ -83,11 +128,11 @@ func GetFileActionsAndDirs(targetPaths []string, renameDestinations map[string]s
 			}
 		}
 
-		dir := filepath.Dir(path)
-		if dir != "." && dir != "/" {
-			if _, err := os.Stat(dir); os.IsNotExist(err) {
-				dirsToCreate[dir] = struct{}{}
+		for dir := filepath.Dir(path); dir != "." && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				break
 			}
+			dirsToCreate[dir] = struct{}{}
 		}
 	}
 	return fileActions, dirsToCreate
@@ -123,14 +168,7 @@ func TrashFile(path string, trashPath string, wd string) error {
 		return err
 	}
 
-	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
-	if _, err := w.Write(content); err != nil {
-		return err
-	}
-	w.Close()
-
-	if err := os.WriteFile(destPath, b.Bytes(), 0644); err != nil {
+	if err := writeCompressed(destPath, content); err != nil {
 		return err
 	}
 
@@ -155,7 +193,7 @@ func RestoreFileFromTrash(originalPath string, trashPath string, wd string) erro
 	}
 
 	if !isZlibCompressed(data) {
-		return os.Rename(srcPath, absPath)
+		return MoveFile(srcPath, absPath)
 	}
 
 	r, err := zlib.NewReader(bytes.NewReader(data))
@@ -176,20 +214,149 @@ func RestoreFileFromTrash(originalPath string, trashPath string, wd string) erro
 	return os.Remove(srcPath)
 }
 
+// rename is os.Rename, replaced in tests to simulate moves across
+// filesystems.
+var rename = os.Rename
+
+// MoveFile renames src to dst. When they are on different filesystems it
+// falls back to copying (files, directories and symlinks, keeping modes)
+// and removing src.
+func MoveFile(src, dst string) error {
+	err := rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyTree(src, dst); err != nil {
+		_ = os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, info.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// readLines returns the lines of a file without the final newline, or nil
+// if it is empty or cannot be read.
+func readLines(path string) []string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return splitLines(content)
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
 func WriteBlob(dir string, hash string, content []byte) error {
-	blobDir := filepath.Join(dir, "blobs")
-	if err := os.MkdirAll(blobDir, 0755); err != nil {
+	path := BlobPath(dir, hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeCompressed(path, content)
+}
+
+// BlobPath returns where the blob for hash is stored: sharded by the first two
+// hex characters, as in blobs/ab/cdef…, to keep directories small.
+func BlobPath(dir string, hash string) string {
+	if len(hash) <= 2 {
+		return filepath.Join(dir, BlobsDir, hash)
+	}
+	return filepath.Join(dir, BlobsDir, hash[:2], hash[2:])
+}
+
+func writeCompressed(path string, content []byte) error {
+	data, err := compress(content)
+	if err != nil {
 		return err
 	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// zlibWriters reuses compressors, whose state is large next to a typical
+// source file.
+var zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(nil) }}
 
+func compress(content []byte) ([]byte, error) {
 	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
+	w := zlibWriters.Get().(*zlib.Writer)
+	defer zlibWriters.Put(w)
+	w.Reset(&b)
 	if _, err := w.Write(content); err != nil {
-		return err
+		return nil, err
 	}
 	w.Close()
+	return b.Bytes(), nil
+}
+
+// blobIntact reports whether the blob for hash is stored and still reads back
+// as content with that hash. Checking is far cheaper than compressing again.
+func blobIntact(dir string, hash string) bool {
+	content, err := ReadBlob(dir, hash)
+	return err == nil && sha256Hex(content) == hash
+}
+
+// removeBlob deletes every stored form of the blob for hash, so a damaged
+// copy cannot shadow the one written next.
+func removeBlob(dir string, hash string) {
+	os.Remove(BlobPath(dir, hash))
+	os.Remove(filepath.Join(dir, BlobsDir, hash))
+	os.Remove(BlobPath(dir, hash) + recipeSuffix)
+}
 
-	return os.WriteFile(filepath.Join(blobDir, hash), b.Bytes(), 0644)
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
 }
 
 func ReadBlob(dir string, hash string) ([]byte, error) {
@@ -197,11 +364,25 @@ func ReadBlob(dir string, hash string) ([]byte, error) {
 		return []byte{}, nil
 	}
 
-	data, err := os.ReadFile(filepath.Join(dir, "blobs", hash))
+	data, err := os.ReadFile(BlobPath(dir, hash))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Blobs written before sharding live directly under blobs/
+		data, err = os.ReadFile(filepath.Join(dir, BlobsDir, hash))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		if content, cerr := readChunkedBlob(dir, hash); !errors.Is(cerr, fs.ErrNotExist) {
+			return content, cerr
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
+	return decompress(data)
+}
 
+// decompress inflates zlib data; anything else, such as blobs stored before
+// compression was added, is returned as is.
+func decompress(data []byte) ([]byte, error) {
 	if !isZlibCompressed(data) {
 		return data, nil
 	}
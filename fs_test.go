@@ -0,0 +1,208 @@
+package itf
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// crossDevice makes every rename fail as it does between filesystems.
+func crossDevice(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() { rename = os.Rename })
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+}
+
+func TestMoveFileAcrossFilesystems(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(t *testing.T, src string)
+		check func(t *testing.T, dst string)
+	}{
+		{name: "file keeps its mode",
+			setup: func(t *testing.T, src string) {
+				writeFile(t, src, "#!/bin/sh\n")
+				if err := os.Chmod(src, 0750); err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, dst string) {
+				info, err := os.Stat(dst)
+				if err != nil || info.Mode().Perm() != 0750 || readFile(t, dst) != "#!/bin/sh\n" {
+					t.Errorf("moved file: %v, %v", info, err)
+				}
+			}},
+		{name: "directory with nested files and a symlink",
+			setup: func(t *testing.T, src string) {
+				writeFile(t, filepath.Join(src, "a.txt"), "a\n")
+				writeFile(t, filepath.Join(src, "sub", "b.txt"), "b\n")
+				if err := os.Symlink("a.txt", filepath.Join(src, "link")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, dst string) {
+				if readFile(t, filepath.Join(dst, "sub", "b.txt")) != "b\n" {
+					t.Error("nested file not moved")
+				}
+				if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "a.txt" {
+					t.Errorf("symlink not moved: %q, %v", link, err)
+				}
+				if readFile(t, filepath.Join(dst, "link")) != "a\n" {
+					t.Error("symlink does not resolve")
+				}
+			}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+			tc.setup(t, src)
+			crossDevice(t)
+			if err := MoveFile(src, dst); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Lstat(src); !os.IsNotExist(err) {
+				t.Errorf("source left behind: %v", err)
+			}
+			tc.check(t, dst)
+		})
+	}
+}
+
+func TestRenameAcrossFilesystems(t *testing.T) {
+	inProject(t)
+	writeFile(t, "a.txt", "a\n")
+	crossDevice(t)
+	mustRun(t, Config{}, "```rename\na.txt b.txt\n```\n")
+	if readFile(t, "b.txt") != "a\n" {
+		t.Error("rename did not fall back to copying")
+	}
+	mustRun(t, Config{Undo: true}, "")
+	if readFile(t, "a.txt") != "a\n" {
+		t.Error("undo did not move the file back")
+	}
+	if _, err := os.Stat("b.txt"); !os.IsNotExist(err) {
+		t.Errorf("b.txt left after undo: %v", err)
+	}
+}
+
+func TestOutsideRoot(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "proj")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(root)
+	for _, tc := range []struct {
+		name   string
+		path   string
+		inside bool
+	}{
+		{name: "relative path", path: "a.txt", inside: true},
+		{name: "subdirectory", path: "sub/a.txt", inside: true},
+		{name: "name starting with dots", path: "..a.txt", inside: true},
+		{name: "parent directory", path: "../x.txt"},
+		{name: "back out through a subdirectory", path: "sub/../../x.txt"},
+		{name: "absolute path outside root", path: filepath.Join(parent, "abs.txt")},
+		{name: "sibling sharing the root's prefix", path: filepath.Join(parent, "proj-other", "a.txt")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resolver := newTestResolver(t)
+			abs := resolver.Resolve(tc.path)
+			if got := resolver.IsWithinRoot(abs); got != tc.inside {
+				t.Errorf("IsWithinRoot(%s) = %v, want %v", abs, got, tc.inside)
+			}
+
+			s, err := runItf(t, Config{}, "`"+tc.path+"`\n```\nx\n```\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, statErr := os.Stat(abs)
+			if written := statErr == nil; written != tc.inside {
+				t.Errorf("written %v, want %v; failed %q", written, tc.inside, s.Failed)
+			}
+			if failed := len(s.Failed) > 0; failed == tc.inside {
+				t.Errorf("failed %q", s.Failed)
+			}
+			os.Remove(abs)
+		})
+	}
+}
+
+func TestWindowsPaths(t *testing.T) {
+	if filepath.Separator == '\\' {
+		t.Skip("backslashes are separators on Windows")
+	}
+	for _, tc := range []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "relative", in: `src\main.go`, want: "src/main.go"},
+		{name: "mixed separators", in: `src\pkg/main.go`, want: "src/pkg/main.go"},
+		{name: "forward slashes untouched", in: "src/main.go", want: "src/main.go"},
+		{name: "drive letter makes it absolute", in: `C:\proj\main.go`, want: "/proj/main.go"},
+		{name: "lowercase drive letter", in: `d:\main.go`, want: "/main.go"},
+		{name: "drive letter with forward slashes", in: "C:/proj/main.go", want: "/proj/main.go"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := fromWindowsPath(tc.in); got != tc.want {
+				t.Errorf("fromWindowsPath(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+
+	t.Run("blocks with backslash paths", func(t *testing.T) {
+		inProject(t)
+		writeFile(t, "src/patched.go", "package a\nvar x = 1\n")
+		writeFile(t, "src/old.go", "package a\n")
+		s := mustRun(t, Config{}, "`src\\new.go`\n```go\npackage a\n```\n"+
+			"```diff\n--- a/src\\patched.go\n+++ b/src\\patched.go\n@@ -1,2 +1,2 @@\n package a\n-var x = 1\n+var x = 2\n```\n"+
+			"```delete\nsrc\\old.go\n```\n"+
+			"`C:\\proj\\outside.go`\n```go\npackage a\n```\n")
+		if got := readFile(t, "src/new.go"); got != "package a\n" {
+			t.Errorf("src/new.go = %q", got)
+		}
+		if got := readFile(t, "src/patched.go"); got != "package a\nvar x = 2\n" {
+			t.Errorf("src/patched.go = %q", got)
+		}
+		if _, err := os.Stat("src/old.go"); !os.IsNotExist(err) {
+			t.Errorf("src/old.go not deleted: %v", err)
+		}
+		if len(s.Failed) != 1 || !strings.HasSuffix(s.Failed[0], "/proj/outside.go") {
+			t.Errorf("failed %q, want only the path with a drive letter", s.Failed)
+		}
+	})
+}
+
+func TestReadBlobLayouts(t *testing.T) {
+	dir := t.TempDir()
+	sharded, flat := []byte("sharded\n"), []byte("flat\n")
+	if err := WriteBlob(dir, sha256Hex(sharded), sharded); err != nil {
+		t.Fatal(err)
+	}
+	// Blobs written before sharding live directly under blobs/
+	data, err := compress(flat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, BlobsDir, sha256Hex(flat)), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range [][]byte{sharded, flat} {
+		got, err := ReadBlob(dir, sha256Hex(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("ReadBlob = %q, want %q", got, want)
+		}
+	}
+	if _, err := ReadBlob(dir, sha256Hex([]byte("missing"))); !os.IsNotExist(err) {
+		t.Errorf("missing blob: error %v, want not exist", err)
+	}
+}
@@ -0,0 +1,114 @@
+package itf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GitDiffToMarkdown turns raw `git diff` output into the blocks itf applies:
+// a diff block per changed file, a rename block for each rename and a delete
+// block for each removed file. Without any "diff --git" line, the input is
+// split at each ---/+++ header pair instead, so plain unified diffs work
+// too. Binary changes cannot be applied and are reported in warnings.
+func GitDiffToMarkdown(diff string, prefix DiffPrefix) (markdown string, warnings []string) {
+	var b strings.Builder
+	for _, section := range splitGitDiff(diff) {
+		var oldPath, newPath, renameFrom, renameTo string
+		body := -1
+		binary := false
+		for i, l := range section {
+			switch {
+			case body >= 0:
+			case strings.HasPrefix(l, "rename from "):
+				renameFrom = strings.TrimPrefix(l, "rename from ")
+			case strings.HasPrefix(l, "rename to "):
+				renameTo = strings.TrimPrefix(l, "rename to ")
+			case strings.HasPrefix(l, "Binary files "), l == "GIT binary patch":
+				binary = true
+			case strings.HasPrefix(l, "--- ") && i+1 < len(section) && strings.HasPrefix(section[i+1], "+++ "):
+				body = i
+				oldPath = diffHeaderPath(l, "--- ", prefix.Old)
+				newPath = diffHeaderPath(section[i+1], "+++ ", prefix.New)
+			}
+		}
+
+		if binary {
+			warnings = append(warnings, fmt.Sprintf("%s: binary change skipped", gitDiffName(section)))
+			continue
+		}
+		if renameFrom != "" && renameTo != "" {
+			writeFenced(&b, "rename", []string{renameFrom + " " + renameTo})
+		}
+		switch {
+		case body < 0:
+			// Mode changes and pure renames have no hunks
+		case newPath == "/dev/null":
+			writeFenced(&b, "delete", []string{oldPath})
+		default:
+			writeFenced(&b, "diff", section[body:])
+		}
+	}
+	return b.String(), warnings
+}
+
+// splitGitDiff splits diff into one section of lines per file.
+func splitGitDiff(diff string) [][]string {
+	lines := strings.Split(strings.ReplaceAll(diff, "\r\n", "\n"), "\n")
+	git := false
+	for _, l := range lines {
+		if strings.HasPrefix(l, "diff --git ") {
+			git = true
+			break
+		}
+	}
+
+	var sections [][]string
+	for i, l := range lines {
+		start := strings.HasPrefix(l, "diff --git ")
+		if !git {
+			start = strings.HasPrefix(l, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ")
+		}
+		switch {
+		case start:
+			sections = append(sections, []string{l})
+		case len(sections) > 0:
+			sections[len(sections)-1] = append(sections[len(sections)-1], l)
+		}
+	}
+	for i, s := range sections {
+		for len(s) > 0 && s[len(s)-1] == "" {
+			s = s[:len(s)-1]
+		}
+		sections[i] = s
+	}
+	return sections
+}
+
+// diffHeaderPath reads the path of a ---/+++ line, dropping the prefix and any
+// tab-separated timestamp.
+func diffHeaderPath(line, marker, prefix string) string {
+	p, _, _ := strings.Cut(strings.TrimPrefix(line, marker), "\t")
+	if p == "/dev/null" {
+		return p
+	}
+	return strings.TrimPrefix(p, prefix)
+}
+
+func gitDiffName(section []string) string {
+	if len(section) == 0 {
+		return "?"
+	}
+	return strings.TrimPrefix(section[0], "diff --git ")
+}
+
+// writeFenced writes lines as a code block whose fence is longer than any
+// backtick run starting a line inside it.
+func writeFenced(b *strings.Builder, lang string, lines []string) {
+	fence := "```"
+	for _, l := range lines {
+		for strings.HasPrefix(strings.TrimLeft(l, " +- "), fence) {
+			fence += "`"
+		}
+	}
+	fmt.Fprintf(b, "%s%s\n%s\n%s\n\n", fence, lang, strings.Join(lines, "\n"), fence)
+}
@@ -0,0 +1,83 @@
+package itf
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestFromGitDiff(t *testing.T) {
+	inProject(t)
+	git := func(args ...string) string {
+		t.Helper()
+		args = append([]string{"-c", "user.name=itf", "-c", "user.email=itf@example.com"}, args...)
+		out, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Skipf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return string(out)
+	}
+	files := map[string]string{
+		"a.txt":     "one\ntwo\nthree\n",
+		"b.txt":     "to be deleted\n",
+		"old/c.txt": "moved\nand kept\nas it is\nwith\nenough\nlines\n",
+	}
+	for p, content := range files {
+		writeFile(t, p, content)
+	}
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "init")
+
+	// Make the changes, take the diff git shows, and put the tree back
+	writeFile(t, "a.txt", "one\n2\nthree\n")
+	if err := os.Remove("b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll("new", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename("old/c.txt", "new/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, "e.txt", "created\n")
+	git("add", "-A")
+	diff := git("diff", "--cached", "-M")
+	if !strings.Contains(diff, "rename from old/c.txt") {
+		t.Fatalf("git did not report the rename:\n%s", diff)
+	}
+	git("reset", "-q", "--hard")
+	for _, p := range []string{"e.txt", "new/c.txt"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("%s survived the reset: %v", p, err)
+		}
+	}
+
+	s := mustRun(t, Config{FromGitDiff: true}, diff)
+	if len(s.Failed) > 0 {
+		t.Fatalf("failed %q, warnings %q", s.Failed, s.Warnings)
+	}
+	for p, want := range map[string]string{"a.txt": "one\n2\nthree\n", "new/c.txt": files["old/c.txt"], "e.txt": "created\n"} {
+		if got := readFile(t, p); got != want {
+			t.Errorf("%s = %q, want %q", p, got, want)
+		}
+	}
+	for _, p := range []string{"b.txt", "old/c.txt"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", p, err)
+		}
+	}
+
+	mustRun(t, Config{Undo: true}, "")
+	for p, want := range files {
+		if got := readFile(t, p); got != want {
+			t.Errorf("after undo %s = %q, want %q", p, got, want)
+		}
+	}
+	for _, p := range []string{"e.txt", "new/c.txt"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("after undo %s still exists: %v", p, err)
+		}
+	}
+}
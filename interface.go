@@ -1,6 +1,7 @@
 package itf
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -10,7 +11,7 @@ func Apply(content string, config Config) (map[string][]string, error) {
 		return nil, fmt.Errorf("failed to initialize itf app: %w", err)
 	}
 
-	summary, err := app.processAndApply(content)
+	summary, err := app.processAndApply(context.Background(), content)
 	if err != nil {
 		return nil, err
 	}
@@ -21,10 +22,45 @@ func Apply(content string, config Config) (map[string][]string, error) {
 		"Renamed":  summary.Renamed,
 		"Deleted":  summary.Deleted,
 		"Failed":   summary.Failed,
+		"Warnings": summary.Warnings,
 		"Message":  []string{summary.Message},
 	}, nil
 }
 
+// Plan parses content and returns the actions Apply would perform, without
+// touching any file. Callers may drop or edit plan.Actions before passing the
+// plan to ApplyPlan.
+func Plan(content string, config Config) (*ExecutionPlan, error) {
+	pr, err := NewPathResolver()
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize itf app: %w", err)
+	}
+	return CreatePlanWithConfig(content, pr, &config)
+}
+
+// ApplyPlan applies a plan produced by Plan, using the config it was planned
+// with. File actions and directories are recomputed from the current actions.
+func ApplyPlan(plan *ExecutionPlan) (Summary, error) {
+	cfg := Config{}
+	if plan.cfg != nil {
+		cfg = *plan.cfg
+	}
+	app, err := NewApp(&cfg)
+	if err != nil {
+		return Summary{}, fmt.Errorf("failed to initialize itf app: %w", err)
+	}
+
+	plan.Refresh()
+	if len(plan.Actions) == 0 && len(plan.Failed) == 0 {
+		return Summary{Message: "Nothing to do", Warnings: plan.Warnings}, nil
+	}
+	if err := app.checkFileLimit(plan); err != nil {
+		return Summary{}, err
+	}
+	CreateDirs(plan.DirsToCreate)
+	return app.applyChanges(context.Background(), plan)
+}
+
 func FormatResult(results map[string][]string) string {
 	if results == nil {
 		return ""
@@ -41,6 +77,7 @@ func FormatResult(results map[string][]string) string {
 		Renamed:  results["Renamed"],
 		Deleted:  results["Deleted"],
 		Failed:   results["Failed"],
+		Warnings: results["Warnings"],
 		Message:  msg,
 	})
 }
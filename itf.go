@@ -1,23 +1,95 @@
 package itf
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime/debug"
+	"slices"
 	"strings"
 )
 
 type Config struct {
-	OutputDiffFix bool
-	Undo          bool
-	Redo          bool
-	Extensions    []string
-	Files         []string
+	OutputDiffFix          bool
+	Undo                   bool
+	Redo                   bool
+	Extensions             []string
+	Files                  []string
+	Langs                  []string
+	Message                string
+	ListHistory            bool
+	TrashDir               string
+	NoHistory              bool
+	AdditionsOnly          bool
+	DryRun                 bool
+	IndentedBlocks         bool
+	Base64                 bool
+	ShowStateDelta         bool
+	Owner                  string
+	Group                  string
+	IgnoreWhitespace       bool
+	AllowOutsideRoot       bool
+	TrimTrailingWhitespace bool
+	Restore                string
+	StrictIndent           bool
+	LooseMatch             bool
+	WriteManifest          bool
+	RewriteDiffFix         bool
+	NoRecover              bool
+	Reindent               bool
+	Squash                 int
+	Explain                string
+	ChainRenames           bool
+	DiffPrefix             *DiffPrefix
+	MaxFiles               int
+	Force                  bool
+	BackupState            bool
+	RestoreState           string
+	Verify                 bool
+	Reset                  bool
+	Only                   string
+	DiffAlgorithm          string
+	Grep                   string
+	ExportHistory          string
+	ImportHistory          string
+	RestoreTrashed         bool
+	DiffLast               bool
+	Template               bool
+	Vars                   map[string]string
+	NoBackupExtensions     []string
+	ConflictMarkers        bool
+	FromGitDiff            bool
+	ChunkedBlobs           bool
+	SearchWindow           int
+	SavePatch              string
+	LintIndent             bool
+	Resume                 bool
+	RevertDiff             bool
+	PruneTrash             bool
+	PartialParse           bool
+	InvalidUTF8            string
+
+	blockHandlers map[string]BlockHandler
+	selectHunk    HunkSelector
 }
 
+// BlockHandler plans the actions for a code block of a custom fence
+// language. Actions of a type itf does not know are passed to the
+// OnBeforeAction and OnAfterAction hooks and otherwise left alone.
+type BlockHandler func(CodeBlock, *PathResolver) []PlannedAction
+
 type ProgressUpdate func(current, total int)
 
+// HunkSelector decides whether hunk n of total, counted from 1, of a diff for
+// path is applied; text is the hunk with its header.
+type HunkSelector func(path string, n, total int, text string) bool
+
 type App struct {
 	cfg              *Config
 	stateManager     *StateManager
@@ -25,6 +97,11 @@ type App struct {
 	sourceProvider   *SourceProvider
 	fileManager      *FileManager
 	progressCallback ProgressUpdate
+
+	// OnBeforeAction and OnAfterAction, when set, are called around each
+	// action performed by an apply; err is nil if the action succeeded.
+	OnBeforeAction func(PlannedAction)
+	OnAfterAction  func(action PlannedAction, err error)
 }
 
 type DetailedError struct {
@@ -35,9 +112,23 @@ type DetailedError struct {
 func (e *DetailedError) Error() string { return e.Err.Error() }
 
 func NewApp(cfg *Config) (*App, error) {
-	sm, err := NewStateManager()
-	if err != nil {
-		return nil, err
+	var sm *StateManager
+	if !cfg.NoHistory {
+		var err error
+		if sm, err = NewStateManager(); err != nil {
+			return nil, err
+		}
+		if cfg.TrashDir != "" {
+			// A relative trash directory belongs to the project, wherever
+			// in it itf runs
+			sm.TrashPath = filepath.Clean(cfg.TrashDir)
+			if !filepath.IsAbs(sm.TrashPath) {
+				sm.TrashPath = filepath.Join(sm.ProjectRoot, cfg.TrashDir)
+			}
+		}
+		sm.NoBackupExtensions = cfg.NoBackupExtensions
+		sm.ChunkedBlobs = cfg.ChunkedBlobs
+		sm.BackupOnTruncate = cfg.BackupState
 	}
 
 	pr, err := NewPathResolver()
@@ -45,23 +136,63 @@ func NewApp(cfg *Config) (*App, error) {
 		return nil, err
 	}
 
+	fm := NewFileManager()
+	fm.TrimTrailingWhitespace = cfg.TrimTrailingWhitespace
+	fm.Verify = cfg.Verify
+	if fm.Ownership, err = ResolveOwnership(cfg.Owner, cfg.Group); err != nil {
+		return nil, err
+	}
+
 	return &App{
 		cfg:            cfg,
 		stateManager:   sm,
 		pathResolver:   pr,
 		sourceProvider: NewSourceProvider(),
-		fileManager:    NewFileManager(),
+		fileManager:    fm,
 	}, nil
 }
 
 func (a *App) SetProgressCallback(cb ProgressUpdate) { a.progressCallback = cb }
 
-func (a *App) Execute() (summary Summary, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = &DetailedError{Err: fmt.Errorf("panic: %v", r), Stack: debug.Stack()}
-		}
-	}()
+// RegisterBlockHandler plans blocks fenced with lang using fn instead of as
+// file blocks. The rename, delete and diff languages cannot be overridden.
+func (a *App) RegisterBlockHandler(lang string, fn BlockHandler) {
+	if a.cfg.blockHandlers == nil {
+		a.cfg.blockHandlers = make(map[string]BlockHandler)
+	}
+	a.cfg.blockHandlers[lang] = fn
+}
+
+// SetHunkSelector makes diffs apply only the hunks fn accepts. A diff whose
+// hunks are all rejected is skipped.
+func (a *App) SetHunkSelector(fn HunkSelector) { a.cfg.selectHunk = fn }
+
+func (a *App) Execute() (Summary, error) {
+	return a.ExecuteContext(context.Background())
+}
+
+// ExecuteContext runs the configured command. Cancelling ctx stops an apply
+// between actions; actions already performed are still recorded in history,
+// and the journal is kept so --resume can perform the rest.
+func (a *App) ExecuteContext(ctx context.Context) (summary Summary, err error) {
+	if !a.cfg.NoRecover {
+		defer func() {
+			if r := recover(); r != nil {
+				err = &DetailedError{Err: fmt.Errorf("panic: %v", r), Stack: debug.Stack()}
+			}
+		}()
+	}
+
+	if a.stateManager == nil && (a.cfg.Undo || a.cfg.Redo || a.cfg.ListHistory || a.cfg.Restore != "" || a.cfg.Squash > 0 || a.cfg.RestoreState != "" || a.cfg.Reset || a.cfg.ExportHistory != "" || a.cfg.ImportHistory != "" || a.cfg.DiffLast || a.cfg.PruneTrash) {
+		return Summary{}, fmt.Errorf("history is disabled")
+	}
+
+	if a.cfg.ShowStateDelta && a.stateManager != nil {
+		before := a.stateManager.Snapshot()
+		defer func() {
+			fmt.Fprint(os.Stderr, DescribeStateDelta(before, a.stateManager.Snapshot()))
+		}()
+	}
 
 	switch {
 	case a.cfg.Undo:
@@ -70,141 +201,497 @@ func (a *App) Execute() (summary Summary, err error) {
 		return a.redoLastOperation()
 	case a.cfg.OutputDiffFix:
 		return a.fixAndPrintDiffs()
+	case a.cfg.RewriteDiffFix:
+		return a.rewriteDiffs()
+	case a.cfg.ListHistory:
+		return a.listHistory()
+	case a.cfg.Restore != "":
+		return a.restoreDeletedFile(a.cfg.Restore)
+	case a.cfg.Squash > 0:
+		return a.squashHistory(a.cfg.Squash)
+	case a.cfg.RestoreState != "":
+		return a.restoreState(a.cfg.RestoreState)
+	case a.cfg.Reset:
+		return a.resetState()
+	case a.cfg.ExportHistory != "":
+		return a.exportHistory(a.cfg.ExportHistory)
+	case a.cfg.ImportHistory != "":
+		return a.importHistory(a.cfg.ImportHistory)
+	case a.cfg.DiffLast:
+		return a.diffLast()
+	case a.cfg.PruneTrash:
+		return a.pruneTrash()
+	case a.cfg.Explain != "":
+		return a.explainPath(a.cfg.Explain)
 	default:
-		return a.processContent()
+		return a.processContent(ctx)
+	}
+}
+
+func (a *App) processContent(ctx context.Context) (Summary, error) {
+	if r, ok, err := a.streamSource(); ok || err != nil {
+		if err != nil {
+			return Summary{}, err
+		}
+		s, err := a.applyInput(ctx, r, nil)
+		if err == nil && !r.seen {
+			return Summary{Message: "Nothing was piped on stdin"}, nil
+		}
+		return s, err
+	}
+
+	c, err := a.readSource()
+	switch {
+	case errors.Is(err, ErrEmptyClipboard):
+		return Summary{Message: "Clipboard is empty; pipe content to itf or copy a response first"}, nil
+	case errors.Is(err, ErrEmptyStdin):
+		return Summary{Message: "Nothing was piped on stdin"}, nil
+	case err != nil:
+		return Summary{}, err
+	}
+	return a.applyContent(ctx, c)
+}
+
+// applyContent applies input prepared by prepareContent, converting it from
+// git diff output first with --from-git-diff.
+func (a *App) applyContent(ctx context.Context, c string) (Summary, error) {
+	if !a.cfg.FromGitDiff {
+		return a.processAndApply(ctx, c)
 	}
+
+	c, warnings := GitDiffToMarkdown(c, a.cfg.diffPrefix())
+	s, err := a.processAndApply(ctx, c)
+	s.Warnings = append(warnings, s.Warnings...)
+	return s, err
 }
 
-func (a *App) processContent() (Summary, error) {
+func (a *App) readSource() (string, error) {
 	c, err := a.sourceProvider.GetContent()
-	if err != nil || c == "" {
-		return Summary{Message: "Empty source"}, err
+	if err != nil {
+		return c, err
+	}
+	return a.prepareContent(c)
+}
+
+// prepareContent decodes input read whole with --base64 and strips its
+// "# itf-files:" header, which adds to the --file allowlist.
+func (a *App) prepareContent(c string) (string, error) {
+	if a.cfg.Base64 {
+		var err error
+		if c, err = DecodeBase64Content(c); err != nil {
+			return c, err
+		}
+	}
+	files, c, _ := SplitFilesHeader(c)
+	a.allowFiles(files)
+	return c, nil
+}
+
+// streamSource returns piped stdin for planning as it is read, past a
+// "# itf-files:" header. ok is false when the input must be read whole
+// instead: from the clipboard, or to decode it or plan it twice.
+func (a *App) streamSource() (r *inputReader, ok bool, err error) {
+	if a.cfg.Base64 || a.cfg.FromGitDiff || a.cfg.RestoreTrashed {
+		return nil, false, nil
+	}
+	stdin, ok := a.sourceProvider.Stream()
+	if !ok {
+		return nil, false, nil
+	}
+	br := bufio.NewReader(stdin)
+	first, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	files, _, header := SplitFilesHeader(first)
+	a.allowFiles(files)
+	if header {
+		first = ""
+	}
+	r = &inputReader{r: io.MultiReader(strings.NewReader(first), br), seen: header}
+	return r, true, nil
+}
+
+func (a *App) allowFiles(files []string) {
+	for _, f := range files {
+		if !slices.Contains(a.cfg.Files, f) {
+			a.cfg.Files = append(a.cfg.Files, f)
+		}
 	}
-	return a.processAndApply(c)
 }
 
-func (a *App) processAndApply(content string) (Summary, error) {
-	plan, err := CreatePlan(content, a.pathResolver, a.cfg.Extensions, a.cfg.Files)
+func (a *App) processAndApply(ctx context.Context, content string) (Summary, error) {
+	return a.applyInput(ctx, strings.NewReader(content), func() (*ExecutionPlan, error) {
+		return CreatePlanWithConfig(content, a.pathResolver, a.cfg)
+	})
+}
+
+// applyInput plans src as it is read and applies the plan. replan plans the
+// same input again; without it, cfg.RestoreTrashed is not honored.
+func (a *App) applyInput(ctx context.Context, src io.Reader, replan func() (*ExecutionPlan, error)) (Summary, error) {
+	hash := sha256.New()
+	tee := io.TeeReader(src, hash)
+	plan, err := CreatePlanFromReader(tee, a.pathResolver, a.cfg)
 	if err != nil {
 		return Summary{}, err
 	}
+	// Planning can stop early on a parse error; the hash covers all of it
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return Summary{}, err
+	}
+	input := hex.EncodeToString(hash.Sum(nil))
+
+	if a.stateManager != nil && !a.cfg.DryRun {
+		saved, st, err := a.stateManager.readJournal()
+		switch {
+		case err != nil || saved.Input != input:
+			if a.cfg.Resume {
+				return Summary{Message: "No interrupted apply of this input to resume"}, nil
+			}
+		case a.cfg.Resume:
+			return a.applyFrom(ctx, saved.plan(a.cfg), st, a.stateManager.resumeJournal())
+		case !a.cfg.Force:
+			return Summary{}, fmt.Errorf("an earlier apply of this input was interrupted after %d of %d actions; rerun with --resume to finish it, or --force to start over", st.Done, len(saved.Actions))
+		}
+	}
+
 	if len(plan.Actions) == 0 && len(plan.Failed) == 0 {
-		return Summary{Message: "Nothing to do"}, nil
+		return Summary{Message: "Nothing to do", Warnings: plan.Warnings}, nil
+	}
+	if a.cfg.DryRun {
+		return a.planSummary(plan), nil
+	}
+	if err := a.checkFileLimit(plan); err != nil {
+		return Summary{}, err
+	}
+	if a.cfg.RestoreTrashed && a.stateManager != nil && replan != nil {
+		if restored := a.restoreTrashedTargets(plan); len(restored) > 0 {
+			// Plan again so blocks apply to the restored content
+			if plan, err = replan(); err != nil {
+				return Summary{}, err
+			}
+			for _, p := range restored {
+				plan.Warnings = append(plan.Warnings, fmt.Sprintf("%s: restored from the trash before applying", a.pathResolver.Relative(p)))
+			}
+		}
 	}
 
+	plan.input = input
 	CreateDirs(plan.DirsToCreate)
-	return a.applyChanges(plan)
+	if a.stateManager == nil {
+		return a.applyChanges(ctx, plan)
+	}
+	return a.applyFrom(ctx, plan, newApplyProgress(), a.stateManager.startJournal(input, plan))
 }
 
-func (a *App) applyChanges(plan *ExecutionPlan) (Summary, error) {
+// checkFileLimit refuses plans touching more than cfg.MaxFiles paths unless
+// cfg.Force is set. Renames count both paths.
+func (a *App) checkFileLimit(plan *ExecutionPlan) error {
+	if a.cfg.MaxFiles <= 0 || a.cfg.Force {
+		return nil
+	}
+	if n := len(collectTargetPaths(plan.Actions)); n > a.cfg.MaxFiles {
+		return fmt.Errorf("plan would touch %d files, over the limit of %d; use --force to apply anyway or --dry-run to review", n, a.cfg.MaxFiles)
+	}
+	return nil
+}
+
+func (a *App) applyChanges(ctx context.Context, plan *ExecutionPlan) (Summary, error) {
+	return a.applyFrom(ctx, plan, newApplyProgress(), nil)
+}
+
+// applyFrom performs the actions of plan that st has not done yet, noting
+// each one in j when it is not nil.
+func (a *App) applyFrom(ctx context.Context, plan *ExecutionPlan, st *applyProgress, j *applyJournal) (Summary, error) {
 	totalOps := len(plan.Actions)
-	currentOp := 0
-	oldHashes := make(map[string]string)
-	
-	var created, modified, deleted, renamedSuccess []string
-	var failedCreate, failedModify, failedDeletes, failedRenames []string
-	renamedMap := make(map[string]string)
+	currentOp := st.Done
+	defer j.close()
 
 	progress := func() {
 		currentOp++
 		a.reportProgress(currentOp, totalOps)
 	}
 
-	trash := filepath.Join(a.stateManager.StateDir, TrashDir)
+	if a.stateManager != nil {
+		a.stateManager.Sync()
+	}
+
+	for i, action := range plan.Actions {
+		if i < st.Done {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		prev := *st
+
+		if a.OnBeforeAction != nil {
+			a.OnBeforeAction(action)
+		}
+		var actionErr error
 
-	for _, action := range plan.Actions {
 		switch action.Type {
 		case "write":
-			isCreate := plan.FileActions[action.Change.Path] == "create"
+			isCreate := plan.FileActions[action.Change.Path] == "create" || st.MovedAway[action.Change.Path]
 			if !isCreate {
-				a.backupFileState(action.Change.Path, oldHashes)
+				a.backupFileState(action.Change.Path, st.OldHashes, st.OldModTimes)
+				if _, ok := st.OldOwners[action.Change.Path]; !ok && a.fileManager.Ownership != "" {
+					st.OldOwners[action.Change.Path] = fileOwnership(action.Change.Path)
+				}
 			}
 			
 			upd, fail := a.fileManager.WriteChanges([]FileChange{*action.Change}, nil)
 			if len(fail) > 0 {
+				actionErr = fmt.Errorf("failed to write %s", action.Change.Path)
 				if isCreate {
-					failedCreate = append(failedCreate, fail...)
+					st.FailedCreate = append(st.FailedCreate, fail...)
 				} else {
-					failedModify = append(failedModify, fail...)
+					st.FailedModify = append(st.FailedModify, fail...)
 				}
-			} else if len(upd) > 0 {
-				if isCreate {
-					created = append(created, upd...)
-				} else {
-					modified = append(modified, upd...)
+			} else {
+				// A path written by several blocks is reported and recorded once
+				for _, p := range upd {
+					if slices.Contains(st.Created, p) || slices.Contains(st.Modified, p) {
+						continue
+					}
+					if isCreate {
+						st.Created = append(st.Created, p)
+					} else {
+						st.Modified = append(st.Modified, p)
+					}
 				}
 			}
 
 		case "rename":
 			r := action.Rename
-			a.backupFileState(r.OldPath, oldHashes)
-			if os.Rename(r.OldPath, r.NewPath) == nil {
-				renamedMap[r.OldPath] = r.NewPath
-				renamedSuccess = append(renamedSuccess, r.OldPath)
+			a.backupFileState(r.OldPath, st.OldHashes, st.OldModTimes)
+			if actionErr = MoveFile(r.OldPath, r.NewPath); actionErr == nil {
+				st.MovedAway[r.OldPath] = true
+				st.RenamedTo[r.OldPath] = r.NewPath
+				st.Renamed = append(st.Renamed, r.OldPath)
 			} else {
-				failedRenames = append(failedRenames, r.OldPath)
+				st.FailedRenames = append(st.FailedRenames, r.OldPath)
 			}
 
 		case "delete":
 			p := action.Path
-			a.backupFileState(p, oldHashes)
-			if TrashFile(p, trash, a.stateManager.ProjectRoot) == nil {
-				deleted = append(deleted, p)
+			a.backupFileState(p, st.OldHashes, st.OldModTimes)
+			if actionErr = a.deleteFile(p); actionErr == nil {
+				st.Deleted = append(st.Deleted, p)
 			} else {
-				failedDeletes = append(failedDeletes, p)
+				st.FailedDeletes = append(st.FailedDeletes, p)
 			}
 		}
+		st.Done = i + 1
+		j.record(st.since(prev, action))
+		if a.OnAfterAction != nil {
+			a.OnAfterAction(action, actionErr)
+		}
 		progress()
 	}
 
 	// To preserve history correctly, we gather the final list of operations
-	a.recordHistory(created, modified, deleted, renamedSuccess, plan, oldHashes)
-
-	return a.createSummary(
-		created,
-		modified,
-		deleted,
-		renamedMap,
-		append(failedCreate, failedModify...),
-		failedDeletes,
-		failedRenames,
+	ops := a.recordHistory(st.Created, st.Modified, st.Deleted, st.Renamed, plan, st.OldHashes, st.OldOwners, st.OldModTimes)
+	// A cancelled apply keeps its journal for --resume
+	switch {
+	case st.Done == totalOps:
+		j.remove()
+	case len(ops) > 0:
+		j.saved(st.Done)
+	}
+
+	summary, err := a.createSummary(
+		st.Created,
+		st.Modified,
+		st.Deleted,
+		st.RenamedTo,
+		append(st.FailedCreate, st.FailedModify...),
+		st.FailedDeletes,
+		st.FailedRenames,
 		plan.Failed,
 	)
+	summary.Warnings = plan.Warnings
+	if a.cfg.SavePatch != "" {
+		switch {
+		case a.stateManager == nil:
+			summary.Warnings = append(summary.Warnings, "--save-patch needs history, which is disabled; no patch saved")
+		case len(ops) > 0:
+			if err := a.savePatch(ops, a.cfg.SavePatch); err != nil {
+				summary.Warnings = append(summary.Warnings, fmt.Sprintf("failed to save the patch: %v", err))
+			}
+		}
+	}
+	if a.stateManager != nil {
+		for _, p := range st.Modified {
+			if skipsBackup(p, a.stateManager.NoBackupExtensions) {
+				summary.Warnings = append(summary.Warnings, fmt.Sprintf("%s: no backup kept, undo cannot restore the previous content", a.pathResolver.Relative(p)))
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		summary.Message = fmt.Sprintf("Cancelled after %d of %d actions; rerun with --resume to finish", currentOp, totalOps)
+		return summary, ctx.Err()
+	}
+	return summary, err
 }
 
-func (a *App) recordHistory(created, modified, deleted, renamed []string, plan *ExecutionPlan, oldHashes map[string]string) {
-	successCount := len(created) + len(modified) + len(deleted) + len(renamed)
-	if successCount == 0 {
-		return
+func (a *App) deleteFile(path string) error {
+	if a.stateManager == nil {
+		return os.Remove(path)
+	}
+	return TrashFile(path, a.stateManager.TrashPath, a.stateManager.ProjectRoot)
+}
+
+// recordHistory writes the successful actions of plan to the history and
+// returns the recorded operations.
+func (a *App) recordHistory(created, modified, deleted, renamed []string, plan *ExecutionPlan, oldHashes, oldOwners map[string]string, oldModTimes map[string]int64) []Operation {
+	if a.stateManager == nil {
+		return nil
+	}
+	if len(created)+len(modified)+len(deleted)+len(renamed) == 0 {
+		return nil
+	}
+
+	message := a.cfg.Message
+	if message == "" {
+		message = historyLabel(created, modified, deleted, renamed)
 	}
 
-	// Get renames in map form for the history builder
-	var renamesList []FileRename
+	ops := a.stateManager.CreateOperations(historyTargets(created, modified, deleted, renamed, plan, oldHashes))
+	for i := range ops {
+		if ops[i].Action == "modify" || ops[i].Action == "delete" {
+			ops[i].OldModTime = oldModTimes[ops[i].Path]
+		}
+	}
+	if a.fileManager.Ownership != "" {
+		for i := range ops {
+			if ops[i].Action == "create" || ops[i].Action == "modify" {
+				ops[i].OldOwner = oldOwners[ops[i].Path]
+				ops[i].Owner = a.fileManager.Ownership
+			}
+		}
+	}
+	a.stateManager.Write(ops, message, plan.input)
+	if a.cfg.WriteManifest {
+		_ = a.stateManager.WriteManifest(ops)
+	}
+	return ops
+}
+
+// historyTargets lists the successful actions of plan in the order they were
+// performed, one per path and kind, for CreateOperations. A path recreated
+// after being renamed away yields a rename followed by a create, which undo
+// reverses in the opposite order.
+func historyTargets(created, modified, deleted, renamed []string, plan *ExecutionPlan, oldHashes map[string]string) []Operation {
+	var targets []Operation
+	index := make(map[string]int)
+	add := func(op Operation) {
+		key := op.Action + "\x00" + op.Path
+		if i, ok := index[key]; ok {
+			// The last block written to a path produced its content
+			targets[i].Source = op.Source
+			return
+		}
+		index[key] = len(targets)
+		targets = append(targets, op)
+	}
+
+	movedAway := make(map[string]bool)
 	for _, action := range plan.Actions {
-		if action.Type == "rename" {
-			renamesList = append(renamesList, *action.Rename)
+		switch action.Type {
+		case "write":
+			p := action.Change.Path
+			source := action.Change.Source
+			switch {
+			case movedAway[p] && slices.Contains(created, p):
+				add(Operation{Action: "create", Path: p, Source: source})
+			case slices.Contains(created, p):
+				add(Operation{Action: "create", Path: p, OldContentHash: oldHashes[p], Source: source})
+			case slices.Contains(modified, p):
+				add(Operation{Action: "modify", Path: p, OldContentHash: oldHashes[p], Source: source})
+			}
+		case "rename":
+			r := action.Rename
+			if !slices.Contains(renamed, r.OldPath) {
+				continue
+			}
+			// A write before the rename travels with the file; only the
+			// rename is recorded for it, as before.
+			for _, kind := range []string{"create", "modify"} {
+				if i, ok := index[kind+"\x00"+r.OldPath]; ok {
+					targets[i].Action = ""
+				}
+			}
+			add(Operation{Action: "rename", Path: r.OldPath, NewPath: r.NewPath, OldContentHash: oldHashes[r.OldPath]})
+			movedAway[r.OldPath] = true
+		case "delete":
+			if slices.Contains(deleted, action.Path) {
+				add(Operation{Action: "delete", Path: action.Path, OldContentHash: oldHashes[action.Path]})
+			}
 		}
 	}
 
-	historyPaths := make([]string, 0, successCount)
-	historyPaths = append(historyPaths, created...)
-	historyPaths = append(historyPaths, modified...)
-	historyPaths = append(historyPaths, deleted...)
-	historyPaths = append(historyPaths, renamed...)
+	kept := targets[:0]
+	for _, t := range targets {
+		switch t.Action {
+		case "":
+			continue
+		case "create":
+			t.Dirs = createdDirs(t.Path, plan.DirsToCreate)
+		case "rename":
+			t.Dirs = createdDirs(t.NewPath, plan.DirsToCreate)
+		}
+		kept = append(kept, t)
+	}
+	return kept
+}
 
-	ops := a.stateManager.CreateOperations(historyPaths, plan.FileActions, renamesList, oldHashes)
-	a.stateManager.Write(ops)
+// createdDirs returns the directories among dirs that contain path, deepest
+// first.
+func createdDirs(path string, dirs map[string]struct{}) []string {
+	var found []string
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, ok := dirs[dir]; !ok {
+			break
+		}
+		found = append(found, dir)
+	}
+	return found
+}
+
+func historyLabel(created, modified, deleted, renamed []string) string {
+	var parts []string
+	for _, c := range []struct {
+		n    int
+		verb string
+	}{
+		{len(created), "created"},
+		{len(modified), "modified"},
+		{len(renamed), "renamed"},
+		{len(deleted), "deleted"},
+	} {
+		if c.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", c.n, c.verb))
+		}
+	}
+	return strings.Join(parts, ", ")
 }
 
-func (a *App) backupFileState(path string, hashes map[string]string) {
+func (a *App) backupFileState(path string, hashes map[string]string, modTimes map[string]int64) {
+	if a.stateManager == nil {
+		return
+	}
 	if _, ok := hashes[path]; ok {
 		return // Already backed up
 	}
 	h, _ := GetFileSHA256(path)
 	hashes[path] = h
-	if h != "" {
+	if info, err := os.Stat(path); err == nil {
+		modTimes[path] = info.ModTime().UnixNano()
+	}
+	if h != "" && !skipsBackup(path, a.stateManager.NoBackupExtensions) {
 		if content, err := os.ReadFile(path); err == nil {
-			_ = WriteBlob(a.stateManager.StateDir, h, content)
+			_ = a.stateManager.writeBlob(h, content)
 		}
 	}
 }
@@ -233,39 +720,400 @@ func (a *App) createSummary(created, modified, deleted []string, renamed map[str
 	return s, nil
 }
 
+func (a *App) planSummary(plan *ExecutionPlan) Summary {
+	s := Summary{Message: "Dry run", Failed: plan.Failed, Warnings: plan.Warnings}
+	seen := make(map[string]struct{})
+	movedAway := make(map[string]bool)
+	for _, action := range plan.Actions {
+		switch action.Type {
+		case "write":
+			p := action.Change.Path
+			if _, ok := seen[p]; ok {
+				continue
+			}
+			seen[p] = struct{}{}
+			if plan.FileActions[p] == "create" || movedAway[p] {
+				s.Created = append(s.Created, p)
+			} else {
+				s.Modified = append(s.Modified, p)
+			}
+		case "rename":
+			movedAway[action.Rename.OldPath] = true
+			s.Renamed = append(s.Renamed, fmt.Sprintf("%s -> %s", action.Rename.OldPath, action.Rename.NewPath))
+		case "delete":
+			s.Deleted = append(s.Deleted, action.Path)
+		}
+	}
+	a.relativizeSummaryPaths(&s)
+	return s
+}
+
 func (a *App) fixAndPrintDiffs() (Summary, error) {
-	c, _ := a.sourceProvider.GetContent()
-	diffs := ExtractDiffBlocks(c, a.pathResolver, a.cfg.Files)
+	c, _ := a.readSource()
+	blocks, _ := ExtractCodeBlocks([]byte(c))
+	diffs := extractDiffBlocksFromParsed(blocks, a.pathResolver, a.allowedFiles(), a.cfg.diffPrefix().New)
 	for _, d := range diffs {
-		if res, err := CorrectDiff(d, a.pathResolver, a.cfg.Extensions, a.pathResolver.ResolveExisting(d.FilePath)); err == nil {
+		if res, err := CorrectDiff(d, a.pathResolver.ResolveExisting(d.FilePath), a.cfg); err == nil {
 			fmt.Print(res)
 		}
 	}
 	return Summary{}, nil
 }
 
+func (a *App) allowedFiles() map[string]struct{} {
+	allowed := make(map[string]struct{})
+	for _, f := range a.cfg.Files {
+		allowed[a.pathResolver.Resolve(f)] = struct{}{}
+	}
+	return allowed
+}
+
+// rewriteDiffs prints the source document with each diff block replaced by
+// its corrected version. Blocks that cannot be corrected are left as they are.
+func (a *App) rewriteDiffs() (Summary, error) {
+	c, _ := a.readSource()
+	blocks, _ := ExtractCodeBlocks([]byte(c))
+	allowed := a.allowedFiles()
+
+	var out strings.Builder
+	last := 0
+	for _, b := range blocks {
+		diffs := extractDiffBlocksFromParsed([]CodeBlock{b}, a.pathResolver, allowed, a.cfg.diffPrefix().New)
+		if len(diffs) == 0 {
+			continue
+		}
+		d := diffs[0]
+		res, err := CorrectDiff(d, a.pathResolver.ResolveExisting(d.FilePath), a.cfg)
+		if err != nil || res == "" {
+			continue
+		}
+		out.WriteString(c[last:b.Start])
+		out.WriteString("```diff\n" + res + "```\n")
+		last = b.End
+	}
+	out.WriteString(c[last:])
+	fmt.Print(out.String())
+	return Summary{}, nil
+}
+
 func (a *App) undoLastOperation() (Summary, error) {
-	ops := a.stateManager.GetOperationsToUndo()
+	ops, label := a.stateManager.GetOperationsToUndo()
 	if len(ops) == 0 {
 		return Summary{Message: "No undo"}, nil
 	}
-	s := a.fileManager.Undo(ops, a.stateManager.StateDir, a.stateManager.ProjectRoot)
-	s.Message = "Undone"
+	s := a.fileManager.Undo(ops, a.stateManager.StateDir, a.stateManager.TrashPath, a.stateManager.ProjectRoot)
+	s.Message = labelled("Undone", label)
 	a.relativizeSummaryPaths(&s)
 	return s, nil
 }
 
 func (a *App) redoLastOperation() (Summary, error) {
-	ops := a.stateManager.GetOperationsToRedo()
+	ops, label := a.stateManager.GetOperationsToRedo()
 	if len(ops) == 0 {
 		return Summary{Message: "No redo"}, nil
 	}
-	s := a.fileManager.Redo(ops, a.stateManager.StateDir, a.stateManager.ProjectRoot)
-	s.Message = "Redone"
+	s := a.fileManager.Redo(ops, a.stateManager.StateDir, a.stateManager.TrashPath, a.stateManager.ProjectRoot)
+	s.Message = labelled("Redone", label)
 	a.relativizeSummaryPaths(&s)
 	return s, nil
 }
 
+func (a *App) restoreDeletedFile(path string) (Summary, error) {
+	abs := a.pathResolver.Resolve(path)
+	op, ok := a.stateManager.FindLastDelete(abs)
+	if !ok {
+		return Summary{}, fmt.Errorf("%s was never deleted by itf", path)
+	}
+	if _, err := os.Stat(abs); err == nil {
+		return Summary{}, fmt.Errorf("%s already exists", path)
+	}
+	if err := a.restoreDeleted(abs, op, path); err != nil {
+		return Summary{}, err
+	}
+
+	s := Summary{Message: "Restored", Created: []string{abs}}
+	a.relativizeSummaryPaths(&s)
+	return s, nil
+}
+
+// restoreDeleted brings back abs, deleted by op, from the trash or failing
+// that from its blob, and records the restore as its own history entry. The
+// trashed copy stays, so undoing the restore and then the delete brings the
+// file back again.
+func (a *App) restoreDeleted(abs string, op Operation, path string) error {
+	a.stateManager.Sync()
+	_ = os.MkdirAll(filepath.Dir(abs), 0755)
+	content, err := os.ReadFile(a.stateManager.trashPathFor(abs))
+	if err == nil {
+		content, err = decompress(content)
+	}
+	if err != nil {
+		content, err = ReadBlob(a.stateManager.StateDir, op.OldContentHash)
+		if op.OldContentHash == "" || err != nil {
+			return fmt.Errorf("no trashed copy of %s is left to restore", path)
+		}
+	}
+	if err := os.WriteFile(abs, content, 0644); err != nil {
+		return err
+	}
+
+	ops := a.stateManager.CreateOperations([]Operation{{Action: "create", Path: abs}})
+	a.stateManager.Write(ops, "restore "+path, "")
+	return nil
+}
+
+// restoreTrashedTargets restores each file that plan would create, or could
+// not patch because it is missing, when an earlier run deleted it. The plan
+// then edits the restored file, so undo returns to the deleted content
+// before removing it again. It returns the restored paths.
+func (a *App) restoreTrashedTargets(plan *ExecutionPlan) []string {
+	var candidates []string
+	for _, action := range plan.Actions {
+		if action.Type == "write" && plan.FileActions[action.Change.Path] == "create" {
+			candidates = append(candidates, action.Change.Path)
+		}
+	}
+	candidates = append(candidates, plan.Failed...)
+
+	var restored []string
+	for _, p := range candidates {
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		op, ok := a.stateManager.FindLastDelete(p)
+		if !ok {
+			continue
+		}
+		if a.restoreDeleted(p, op, a.pathResolver.Relative(p)) == nil {
+			restored = append(restored, p)
+		}
+	}
+	return restored
+}
+
+func (a *App) explainPath(path string) (Summary, error) {
+	c, err := a.readSource()
+	if err != nil {
+		return Summary{}, err
+	}
+	fmt.Print(ExplainPath(c, path, a.pathResolver, a.cfg))
+	return Summary{}, nil
+}
+
+// backupState backs up the history with --backup-state, before a command
+// that rewrites it or removes what it needs, and returns the backup's path.
+func (a *App) backupState() (string, error) {
+	if !a.cfg.BackupState {
+		return "", nil
+	}
+	backup, err := a.stateManager.BackupState()
+	if err != nil {
+		return "", fmt.Errorf("failed to back up history: %w", err)
+	}
+	return backup, nil
+}
+
+// savedTo describes where backupState put the history, if anywhere.
+func savedTo(backup string) string {
+	if backup == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (previous history saved to %s)", backup)
+}
+
+func (a *App) squashHistory(n int) (Summary, error) {
+	backup, err := a.backupState()
+	if err != nil {
+		return Summary{}, err
+	}
+	a.stateManager.Sync()
+	if err := a.stateManager.Squash(n); err != nil {
+		return Summary{}, err
+	}
+	return Summary{Message: fmt.Sprintf("Squashed %d entries into one", n) + savedTo(backup)}, nil
+}
+
+func (a *App) restoreState(backup string) (Summary, error) {
+	previous, err := a.stateManager.RestoreState(backup)
+	if err != nil {
+		return Summary{}, err
+	}
+	return Summary{Message: fmt.Sprintf("Restored history from %s (previous history saved to %s)", backup, previous)}, nil
+}
+
+func (a *App) resetState() (Summary, error) {
+	files, size, err := a.stateManager.Reset()
+	if err != nil {
+		return Summary{}, fmt.Errorf("failed to reset history: %w", err)
+	}
+	from := a.stateManager.StateDir
+	if !a.stateManager.trashOwned() {
+		from += " and " + a.stateManager.TrashPath
+	}
+	return Summary{Message: fmt.Sprintf("Removed %d files (%d bytes) from %s", files, size, from)}, nil
+}
+
+func (a *App) pruneTrash() (Summary, error) {
+	// The trash a backup needs is kept, so it can still be restored
+	backup, err := a.backupState()
+	if err != nil {
+		return Summary{}, err
+	}
+	files, size, err := a.stateManager.PruneTrash()
+	if err != nil {
+		return Summary{}, fmt.Errorf("failed to prune the trash: %w", err)
+	}
+	return Summary{Message: fmt.Sprintf("Removed %d trashed files (%d bytes) that no undo needs", files, size) + savedTo(backup)}, nil
+}
+
+func (a *App) exportHistory(path string) (Summary, error) {
+	blobs, err := a.stateManager.ExportHistory(path)
+	if err != nil {
+		return Summary{}, fmt.Errorf("failed to export history: %w", err)
+	}
+	history, _ := a.stateManager.History()
+	return Summary{Message: fmt.Sprintf("Exported %d entries and %d blobs to %s", len(history), blobs, path)}, nil
+}
+
+func (a *App) importHistory(path string) (Summary, error) {
+	previous, err := a.stateManager.ImportHistory(path)
+	if err != nil {
+		return Summary{}, fmt.Errorf("failed to import history: %w", err)
+	}
+	history, _ := a.stateManager.History()
+	return Summary{Message: fmt.Sprintf("Imported %d entries from %s (previous history saved to %s)", len(history), path, previous)}, nil
+}
+
+// diffLast prints a unified diff, for each file in the last applied entry,
+// from the content itf recorded to what is on disk now. Files that were not
+// edited since print nothing.
+func (a *App) diffLast() (Summary, error) {
+	history, current := a.stateManager.History()
+	if current < 0 {
+		return Summary{Message: "No history"}, nil
+	}
+
+	prefix := a.cfg.diffPrefix()
+	for _, op := range history[current].Operations {
+		path := resultPath(op)
+		rel := filepath.ToSlash(a.stateManager.relativePath(path))
+		oldName, newName := prefix.Old+rel, prefix.New+rel
+
+		var recorded []string
+		if op.Action == "delete" {
+			oldName = "/dev/null"
+		} else {
+			content, err := ReadBlob(a.stateManager.StateDir, op.ContentHash)
+			if err != nil {
+				return Summary{}, fmt.Errorf("failed to read the recorded content of %s: %w", rel, err)
+			}
+			recorded = splitLines(content)
+		}
+		if _, err := os.Stat(path); err != nil {
+			newName = "/dev/null"
+		}
+
+		diff, err := GenerateUnifiedDiff(recorded, readLines(path), oldName, newName, a.cfg.diffAlgorithm())
+		if err != nil {
+			return Summary{}, err
+		}
+		fmt.Print(diff)
+	}
+	return Summary{}, nil
+}
+
+// savePatch writes ops as a git-style patch to path, diffing the blobs
+// recorded before and after each operation.
+func (a *App) savePatch(ops []Operation, path string) error {
+	prefix := a.cfg.diffPrefix()
+	read := func(hash, rel string) ([]string, error) {
+		content, err := ReadBlob(a.stateManager.StateDir, hash)
+		if err != nil {
+			return nil, fmt.Errorf("no recorded content for %s: %w", rel, err)
+		}
+		return splitLines(content), nil
+	}
+
+	var b strings.Builder
+	for _, op := range ops {
+		oldRel := filepath.ToSlash(a.stateManager.relativePath(op.Path))
+		newRel := filepath.ToSlash(a.stateManager.relativePath(resultPath(op)))
+		oldName, newName := prefix.Old+oldRel, prefix.New+newRel
+		mode := "100644"
+		if info, err := os.Stat(resultPath(op)); err == nil && info.Mode()&0111 != 0 {
+			mode = "100755"
+		}
+
+		var before, after []string
+		var err error
+		if op.Action != "create" {
+			if before, err = read(op.OldContentHash, oldRel); err != nil {
+				return err
+			}
+		}
+		if op.Action != "delete" {
+			if after, err = read(op.ContentHash, newRel); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(&b, "diff --git %s %s\n", oldName, newName)
+		switch op.Action {
+		case "create":
+			fmt.Fprintf(&b, "new file mode %s\n", mode)
+			oldName = "/dev/null"
+		case "delete":
+			fmt.Fprintf(&b, "deleted file mode %s\n", mode)
+			newName = "/dev/null"
+		case "rename":
+			fmt.Fprintf(&b, "rename from %s\nrename to %s\n", oldRel, newRel)
+		}
+		diff, err := GenerateUnifiedDiff(before, after, oldName, newName, a.cfg.diffAlgorithm())
+		if err != nil {
+			return err
+		}
+		b.WriteString(diff)
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+func labelled(status, label string) string {
+	if label == "" {
+		return status
+	}
+	return status + ": " + label
+}
+
+func (a *App) listHistory() (Summary, error) {
+	history, current := a.stateManager.History()
+	if len(history) == 0 {
+		return Summary{Message: "No history"}, nil
+	}
+
+	for i, e := range history {
+		marker := " "
+		if i == current {
+			marker = "*"
+		}
+		fmt.Printf("%s %3d  %s", marker, i, e.Message)
+		if e.Input != "" {
+			fmt.Printf("  (input %s)", e.Input[:min(12, len(e.Input))])
+		}
+		fmt.Println()
+		for _, op := range e.Operations {
+			path := a.stateManager.relativePath(op.Path)
+			if op.Action == "rename" {
+				path += " -> " + a.stateManager.relativePath(op.NewPath)
+			}
+			if op.Source != "" {
+				path += " (" + op.Source + ")"
+			}
+			fmt.Printf("        %-7s %s\n", op.Action, path)
+		}
+	}
+	return Summary{}, nil
+}
+
 func (a *App) relativizeSummaryPaths(s *Summary) {
 	wd, _ := os.Getwd()
 	relPath := func(p string) string {
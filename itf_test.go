@@ -0,0 +1,530 @@
+package itf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// inProject makes a fresh temporary directory the working directory, and so
+// the project root, for the rest of the test.
+func inProject(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// inputSource returns a SourceProvider that reads input as piped stdin.
+func inputSource(t *testing.T, input string) *SourceProvider {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.md")
+	writeFile(t, path, input)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return &SourceProvider{stdin: f, readClipboard: func() (string, error) { return "", nil }}
+}
+
+// runItf runs one itf invocation with cfg, piping input when it is not empty.
+func runItf(t *testing.T, cfg Config, input string) (Summary, error) {
+	t.Helper()
+	app, err := NewApp(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if input != "" {
+		app.sourceProvider = inputSource(t, input)
+	}
+	return app.Execute()
+}
+
+func mustRun(t *testing.T, cfg Config, input string) Summary {
+	t.Helper()
+	s, err := runItf(t, cfg, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// BenchmarkSingleFileApply applies one code block to one file, with undo
+// history, the most common use of itf.
+func BenchmarkSingleFileApply(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString("`main.go`\n```go\n")
+	for i := range 2000 {
+		fmt.Fprintf(&sb, "line %d of the file\n", i)
+	}
+	sb.WriteString("```\n")
+	input := sb.String()
+
+	for _, bc := range []struct {
+		name     string
+		changing bool
+	}{
+		{name: "new content", changing: true},
+		{name: "same content"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.Chdir(b.TempDir())
+			app, err := NewApp(&Config{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			n := 0
+			for b.Loop() {
+				in := input
+				if bc.changing {
+					n++
+					in = strings.Replace(input, "line 0 ", fmt.Sprintf("line %d ", n), 1)
+				}
+				if _, err := app.processAndApply(context.Background(), in); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamedInput(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		message string
+		want    map[string]string // file contents afterwards, "" for absent
+	}{
+		{name: "files header limits the blocks applied",
+			input: "# itf-files: a.txt\n`a.txt`\n```\nA\n```\n`b.txt`\n```\nB\n```\n",
+			want:  map[string]string{"a.txt": "A\n", "b.txt": ""}},
+		{name: "whitespace only", input: "  \n\n\t\n", message: "Nothing was piped on stdin"},
+		{name: "files header only", input: "# itf-files: a.txt\n", message: "Nothing to do"},
+		{name: "diff before the rename that provides its file",
+			input: "```diff\n--- a/moved.txt\n+++ b/moved.txt\n@@ -1 +1 @@\n-one\n+two\n```\n```rename\norig.txt moved.txt\n```\n",
+			want:  map[string]string{"orig.txt": "", "moved.txt": "two\n"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "orig.txt", "one\n")
+			s := mustRun(t, Config{}, tc.input)
+			if tc.message != "" && s.Message != tc.message {
+				t.Errorf("message %q, want %q", s.Message, tc.message)
+			}
+			for path, want := range tc.want {
+				got, err := os.ReadFile(path)
+				if want == "" && !os.IsNotExist(err) {
+					t.Errorf("%s exists: %q", path, got)
+				} else if want != "" && string(got) != want {
+					t.Errorf("%s = %q, want %q (%v)", path, got, want, err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLargeInput plans a multi-megabyte input of which --file keeps one
+// block, read whole and streamed from stdin.
+func BenchmarkLargeInput(b *testing.B) {
+	var sb strings.Builder
+	body := strings.Repeat("some generated line of code\n", 1000)
+	for i := range 300 {
+		fmt.Fprintf(&sb, "`gen/f%d.txt`\n```\n%s```\n", i, body)
+	}
+	sb.WriteString("`kept.txt`\n```\nkept\n```\n")
+	input := sb.String()
+	path := filepath.Join(b.TempDir(), "input.md")
+	if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.Chdir(b.TempDir())
+	cfg := &Config{DryRun: true, Files: []string{"kept.txt"}}
+
+	b.Run("whole", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			app, err := NewApp(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := app.processAndApply(context.Background(), string(data)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("streamed", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			f, err := os.Open(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			app, err := NewApp(cfg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			app.sourceProvider = &SourceProvider{stdin: f}
+			if _, err := app.Execute(); err != nil {
+				b.Fatal(err)
+			}
+			f.Close()
+		}
+	})
+}
+
+func TestNoHistory(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+		check func(t *testing.T)
+	}{
+		{name: "write", input: "`a.txt`\n```\nnew\n```\n", check: func(t *testing.T) {
+			if readFile(t, "a.txt") != "new\n" {
+				t.Error("a.txt not written")
+			}
+		}},
+		{name: "delete", input: "```delete\na.txt\n```\n", check: func(t *testing.T) {
+			if _, err := os.Stat("a.txt"); !os.IsNotExist(err) {
+				t.Errorf("a.txt not deleted: %v", err)
+			}
+		}},
+		{name: "rename", input: "```rename\na.txt b.txt\n```\n", check: func(t *testing.T) {
+			if readFile(t, "b.txt") != "old\n" {
+				t.Error("a.txt not renamed")
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "old\n")
+			mustRun(t, Config{NoHistory: true}, tc.input)
+			tc.check(t)
+			if _, err := os.Stat(stateDirName); !os.IsNotExist(err) {
+				t.Errorf("%s was created: %v", stateDirName, err)
+			}
+			if _, err := runItf(t, Config{NoHistory: true, Undo: true}, ""); err == nil {
+				t.Error("undo without history succeeded")
+			}
+		})
+	}
+}
+
+// captureStdout returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestRewriteDiffFix(t *testing.T) {
+	inProject(t)
+	writeFile(t, "a.txt", "one\ntwo\nthree\n")
+	rewrite := func(doc string) string {
+		return captureStdout(t, func() { mustRun(t, Config{RewriteDiffFix: true}, doc) })
+	}
+	before := "Change two:\n\n"
+	after := "\nThat is all.\n"
+	doc := before + "```diff\n--- a/a.txt\n+++ b/a.txt\n@@ -7,2 +7,2 @@\n one\n-two\n+2\n```\n" + after
+
+	got := rewrite(doc)
+	want := before + "```diff\n--- a/a.txt\n+++ b/a.txt\n@@ -1,2 +1,2 @@\n one\n-two\n+2\n```\n" + after
+	if got != want {
+		t.Fatalf("rewritten document:\n%s\nwant:\n%s", got, want)
+	}
+	if again := rewrite(got); again != got {
+		t.Errorf("a corrected document changed when rewritten again:\n%s", again)
+	}
+	if readFile(t, "a.txt") != "one\ntwo\nthree\n" {
+		t.Error("rewriting the document changed the file")
+	}
+}
+
+func TestNoRecover(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		noRecover bool
+	}{
+		{name: "panic returned as a DetailedError"},
+		{name: "panic propagates with NoRecover", noRecover: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			app, err := NewApp(&Config{NoRecover: tc.noRecover})
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.sourceProvider = inputSource(t, "`a.txt`\n```\na\n```\n")
+			app.OnBeforeAction = func(PlannedAction) { panic("boom") }
+
+			var recovered any
+			func() {
+				defer func() { recovered = recover() }()
+				_, err = app.Execute()
+			}()
+
+			if tc.noRecover {
+				if recovered != "boom" {
+					t.Errorf("recovered %v, want the panic to propagate", recovered)
+				}
+				return
+			}
+			if recovered != nil {
+				t.Fatalf("panic %v escaped Execute", recovered)
+			}
+			var detailed *DetailedError
+			if !errors.As(err, &detailed) {
+				t.Fatalf("error %v, want a *DetailedError", err)
+			}
+			if !strings.Contains(detailed.Error(), "boom") || len(detailed.Stack) == 0 {
+				t.Errorf("error %q with %d bytes of stack", detailed.Error(), len(detailed.Stack))
+			}
+		})
+	}
+}
+
+func TestActionHooks(t *testing.T) {
+	dir := inProject(t)
+	writeFile(t, "b.txt", "b\n")
+	writeFile(t, "c.txt", "c\n")
+	app, err := NewApp(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// c.txt/d.txt cannot be written, since c.txt is a file
+	app.sourceProvider = inputSource(t, "`a.txt`\n```\nA\n```\n```rename\nb.txt e.txt\n```\n`c.txt/d.txt`\n```\nD\n```\n")
+	var calls []string
+	rel := func(p string) string {
+		r, _ := filepath.Rel(dir, p)
+		return filepath.ToSlash(r)
+	}
+	describe := func(a PlannedAction) string {
+		switch a.Type {
+		case "write":
+			return "write " + rel(a.Change.Path)
+		case "rename":
+			return "rename " + rel(a.Rename.OldPath) + ">" + rel(a.Rename.NewPath)
+		}
+		return a.Type + " " + rel(a.Path)
+	}
+	app.OnBeforeAction = func(a PlannedAction) { calls = append(calls, "before "+describe(a)) }
+	app.OnAfterAction = func(a PlannedAction, err error) {
+		calls = append(calls, fmt.Sprintf("after %s: %v", describe(a), err != nil))
+	}
+	if _, err := app.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"before write a.txt", "after write a.txt: false",
+		"before rename b.txt>e.txt", "after rename b.txt>e.txt: false",
+		"before write c.txt/d.txt", "after write c.txt/d.txt: true",
+	}
+	if !slices.Equal(calls, want) {
+		t.Errorf("hook calls:\n%s\nwant:\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestMaxFiles(t *testing.T) {
+	const input = "`a.txt`\n```\nA\n```\n`b.txt`\n```\nB\n```\n`c.txt`\n```\nC\n```\n"
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		err  string // part of the error, when the plan is refused
+	}{
+		{name: "over the limit", cfg: Config{MaxFiles: 2}, err: "plan would touch 3 files, over the limit of 2"},
+		{name: "at the limit", cfg: Config{MaxFiles: 3}},
+		{name: "over the limit with --force", cfg: Config{MaxFiles: 2, Force: true}},
+		{name: "unlimited", cfg: Config{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			_, err := runItf(t, tc.cfg, input)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+					if _, err := os.Stat(p); err != nil {
+						t.Errorf("%s not written: %v", p, err)
+					}
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("error %v, want one containing %q", err, tc.err)
+			}
+			for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+				if _, err := os.Stat(p); !os.IsNotExist(err) {
+					t.Errorf("%s written despite the limit: %v", p, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDiffLast(t *testing.T) {
+	inProject(t)
+	mustRun(t, Config{}, "`a.txt`\n```\none\ntwo\n```\n`b.txt`\n```\nb\n```\n`c.txt`\n```\nc\n```\n")
+	diffLast := func() string {
+		t.Helper()
+		return captureStdout(t, func() { mustRun(t, Config{DiffLast: true}, "") })
+	}
+	if out := diffLast(); out != "" {
+		t.Errorf("diff without edits:\n%s", out)
+	}
+
+	// Edited and removed since itf wrote them
+	writeFile(t, "a.txt", "one\nTWO\n")
+	if err := os.Remove("c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	const want = "--- a/a.txt\n+++ b/a.txt\n@@ -1,2 +1,2 @@\n one\n-two\n+TWO\n" +
+		"--- a/c.txt\n+++ /dev/null\n@@ -1,1 +0,0 @@\n-c\n"
+	if out := diffLast(); out != want {
+		t.Errorf("diff after external edits:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestRegisterBlockHandler(t *testing.T) {
+	inProject(t)
+	writeFile(t, "a.txt", "a\n")
+	app, err := NewApp(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sql blocks are written upper-cased to migrations/<hint>.sql
+	app.RegisterBlockHandler("sql", func(b CodeBlock, r *PathResolver) []PlannedAction {
+		path := r.Resolve(filepath.Join("migrations", ExtractPathFromHint(b.Hint)+".sql"))
+		lines := strings.Split(strings.ToUpper(strings.TrimSuffix(b.Content, "\n")), "\n")
+		return []PlannedAction{{Type: "write", Change: &FileChange{Path: path, Content: lines, Source: "sql"}}}
+	})
+	// Built-in languages keep their meaning
+	app.RegisterBlockHandler("diff", func(CodeBlock, *PathResolver) []PlannedAction {
+		t.Error("the diff handler was called")
+		return nil
+	})
+	app.sourceProvider = inputSource(t, "`001_init`\n```sql\ncreate table t (id int);\n```\n"+
+		"```diff\n--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-a\n+A\n```\n"+
+		"`b.txt`\n```\nb\n```\n")
+	s, err := app.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Failed) > 0 {
+		t.Fatalf("failed %q, warnings %q", s.Failed, s.Warnings)
+	}
+	for p, want := range map[string]string{"migrations/001_init.sql": "CREATE TABLE T (ID INT);\n", "a.txt": "A\n", "b.txt": "b\n"} {
+		if got := readFile(t, p); got != want {
+			t.Errorf("%s = %q, want %q", p, got, want)
+		}
+	}
+
+	mustRun(t, Config{Undo: true}, "")
+	if _, err := os.Stat("migrations/001_init.sql"); !os.IsNotExist(err) {
+		t.Errorf("undo left the handler's file: %v", err)
+	}
+	if got := readFile(t, "a.txt"); got != "a\n" {
+		t.Errorf("after undo a.txt = %q", got)
+	}
+}
+
+func TestSavePatch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git apply is the reference applier:", err)
+	}
+	original := map[string]string{
+		"a.txt":     "one\ntwo\nthree\n",
+		"b.txt":     "to be deleted\n",
+		"old/c.txt": "moved\n",
+		"d.txt":     "renamed and edited\nline\n",
+	}
+	const input = "```diff\n--- a/a.txt\n+++ b/a.txt\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n```\n" +
+		"```delete\nb.txt\n```\n" +
+		"```rename\nold/c.txt new/c.txt\nd.txt e.txt\n```\n" +
+		"`e.txt`\n```\nrenamed and edited\nLINE\n```\n" +
+		"`sub/f.txt`\n```\ncreated\n```\n"
+	want := map[string]string{
+		"a.txt":     "one\n2\nthree\n",
+		"new/c.txt": "moved\n",
+		"e.txt":     "renamed and edited\nLINE\n",
+		"sub/f.txt": "created\n",
+	}
+	gone := []string{"b.txt", "old/c.txt", "d.txt"}
+
+	patch := filepath.Join(t.TempDir(), "changes.patch")
+	inProject(t)
+	for p, content := range original {
+		writeFile(t, p, content)
+	}
+	s := mustRun(t, Config{SavePatch: patch}, input)
+	if len(s.Failed) > 0 || len(s.Warnings) > 0 {
+		t.Fatalf("failed %q, warnings %q", s.Failed, s.Warnings)
+	}
+
+	// The patch takes a copy of the original tree to the same result
+	dir := t.TempDir()
+	for p, content := range original {
+		writeFile(t, filepath.Join(dir, p), content)
+	}
+	for _, args := range [][]string{{"apply", "--check", patch}, {"apply", patch}} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s\npatch:\n%s", strings.Join(args, " "), err, out, readFile(t, patch))
+		}
+	}
+	for p, content := range want {
+		if got := readFile(t, filepath.Join(dir, p)); got != content {
+			t.Errorf("%s = %q, want %q", p, got, content)
+		}
+	}
+	for _, p := range gone {
+		if _, err := os.Stat(filepath.Join(dir, p)); !os.IsNotExist(err) {
+			t.Errorf("%s still exists: %v", p, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package itf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+const journalName = "journal"
+
+// applyProgress is the outcome of the actions an apply has performed so far.
+// The same type holds the part a single action added, which is what the
+// journal records.
+type applyProgress struct {
+	Done int
+	// Saved marks the journal line written when a cancelled apply recorded
+	// the history of its actions; resuming records the rest as a new entry
+	Saved                                                    bool
+	Created, Modified, Deleted, Renamed                      []string
+	FailedCreate, FailedModify, FailedDeletes, FailedRenames []string
+	// RenamedTo maps each renamed path to its destination; MovedAway holds
+	// the same paths, which a later write recreates rather than modifies
+	RenamedTo            map[string]string
+	MovedAway            map[string]bool
+	OldHashes, OldOwners map[string]string
+	OldModTimes          map[string]int64
+}
+
+func newApplyProgress() *applyProgress {
+	return &applyProgress{
+		RenamedTo:   make(map[string]string),
+		MovedAway:   make(map[string]bool),
+		OldHashes:   make(map[string]string),
+		OldOwners:   make(map[string]string),
+		OldModTimes: make(map[string]int64),
+	}
+}
+
+// since returns what p gained from action after it looked like prev.
+func (p *applyProgress) since(prev applyProgress, action PlannedAction) applyProgress {
+	s := applyProgress{
+		Done:          p.Done,
+		Created:       p.Created[len(prev.Created):],
+		Modified:      p.Modified[len(prev.Modified):],
+		Deleted:       p.Deleted[len(prev.Deleted):],
+		Renamed:       p.Renamed[len(prev.Renamed):],
+		FailedCreate:  p.FailedCreate[len(prev.FailedCreate):],
+		FailedModify:  p.FailedModify[len(prev.FailedModify):],
+		FailedDeletes: p.FailedDeletes[len(prev.FailedDeletes):],
+		FailedRenames: p.FailedRenames[len(prev.FailedRenames):],
+	}
+	paths := collectTargetPaths([]PlannedAction{action})
+	s.RenamedTo = pick(p.RenamedTo, paths)
+	s.OldHashes = pick(p.OldHashes, paths)
+	s.OldOwners = pick(p.OldOwners, paths)
+	s.OldModTimes = pick(p.OldModTimes, paths)
+	return s
+}
+
+// pick returns the entries of m for paths, or nil if there are none.
+func pick[V any](m map[string]V, paths []string) map[string]V {
+	var out map[string]V
+	for _, p := range paths {
+		if v, ok := m[p]; ok {
+			if out == nil {
+				out = make(map[string]V)
+			}
+			out[p] = v
+		}
+	}
+	return out
+}
+
+// merge adds a journaled step to p. After a Saved line, p holds only what
+// is still to be recorded in history, and the renames that later actions
+// depend on.
+func (p *applyProgress) merge(s applyProgress) {
+	p.Done = s.Done
+	if s.Saved {
+		p.Created, p.Modified, p.Deleted, p.Renamed = nil, nil, nil, nil
+		p.FailedCreate, p.FailedModify, p.FailedDeletes, p.FailedRenames = nil, nil, nil, nil
+		return
+	}
+	p.Created = append(p.Created, s.Created...)
+	p.Modified = append(p.Modified, s.Modified...)
+	p.Deleted = append(p.Deleted, s.Deleted...)
+	p.Renamed = append(p.Renamed, s.Renamed...)
+	p.FailedCreate = append(p.FailedCreate, s.FailedCreate...)
+	p.FailedModify = append(p.FailedModify, s.FailedModify...)
+	p.FailedDeletes = append(p.FailedDeletes, s.FailedDeletes...)
+	p.FailedRenames = append(p.FailedRenames, s.FailedRenames...)
+	for k, v := range s.RenamedTo {
+		p.RenamedTo[k] = v
+		p.MovedAway[k] = true
+	}
+	for k, v := range s.OldHashes {
+		p.OldHashes[k] = v
+	}
+	for k, v := range s.OldOwners {
+		p.OldOwners[k] = v
+	}
+	for k, v := range s.OldModTimes {
+		p.OldModTimes[k] = v
+	}
+}
+
+// journalPlan is the first line of the journal: the plan being applied and
+// the hash of the input it came from.
+type journalPlan struct {
+	Input        string
+	Actions      []PlannedAction
+	FileActions  map[string]string
+	DirsToCreate map[string]struct{}
+	Failed       []string
+	Warnings     []string
+}
+
+// applyJournal appends a line to .itf/journal for each action an apply
+// performs, so an apply that is killed can be finished with --resume. A nil
+// journal records nothing.
+type applyJournal struct {
+	f *os.File
+}
+
+func (m *StateManager) journalPath() string {
+	return filepath.Join(m.StateDir, journalName)
+}
+
+// startJournal replaces the journal with one for plan. Journaling is best
+// effort: it returns nil when the journal cannot be written.
+func (m *StateManager) startJournal(input string, plan *ExecutionPlan) *applyJournal {
+	data, err := json.Marshal(journalPlan{
+		Input:        input,
+		Actions:      plan.Actions,
+		FileActions:  plan.FileActions,
+		DirsToCreate: plan.DirsToCreate,
+		Failed:       plan.Failed,
+		Warnings:     plan.Warnings,
+	})
+	if err != nil {
+		return nil
+	}
+	f, err := os.Create(m.journalPath())
+	if err != nil {
+		return nil
+	}
+	j := &applyJournal{f: f}
+	j.write(data)
+	return j
+}
+
+// readJournal loads the journal of an interrupted apply and the progress it
+// recorded. A line cut short by the interruption ends the journal.
+func (m *StateManager) readJournal() (*journalPlan, *applyProgress, error) {
+	data, err := os.ReadFile(m.journalPath())
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	var saved journalPlan
+	if err := json.Unmarshal(lines[0], &saved); err != nil {
+		return nil, nil, errors.New("the apply journal is unreadable")
+	}
+	st := newApplyProgress()
+	for _, l := range lines[1:] {
+		var s applyProgress
+		if json.Unmarshal(l, &s) != nil {
+			break
+		}
+		st.merge(s)
+	}
+	return &saved, st, nil
+}
+
+// resumeJournal reopens the journal to record the rest of an apply.
+func (m *StateManager) resumeJournal() *applyJournal {
+	f, err := os.OpenFile(m.journalPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil
+	}
+	return &applyJournal{f: f}
+}
+
+func (p *journalPlan) plan(cfg *Config) *ExecutionPlan {
+	return &ExecutionPlan{
+		Actions:      p.Actions,
+		FileActions:  p.FileActions,
+		DirsToCreate: p.DirsToCreate,
+		Failed:       slices.Clone(p.Failed),
+		Warnings:     slices.Clone(p.Warnings),
+		cfg:          cfg,
+		input:        p.Input,
+	}
+}
+
+func (j *applyJournal) write(line []byte) {
+	j.f.Write(append(line, '\n'))
+	j.f.Sync()
+}
+
+func (j *applyJournal) record(s applyProgress) {
+	if j == nil {
+		return
+	}
+	if data, err := json.Marshal(s); err == nil {
+		j.write(data)
+	}
+}
+
+// saved records that the history of the actions so far has been written.
+func (j *applyJournal) saved(done int) {
+	j.record(applyProgress{Done: done, Saved: true})
+}
+
+func (j *applyJournal) close() {
+	if j != nil {
+		j.f.Close()
+	}
+}
+
+// remove deletes the journal once the apply has finished and its history
+// is recorded.
+func (j *applyJournal) remove() {
+	if j == nil {
+		return
+	}
+	j.f.Close()
+	os.Remove(j.f.Name())
+}
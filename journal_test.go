@@ -0,0 +1,107 @@
+package itf
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// interruptAfter applies input and interrupts it after n actions, by
+// cancelling its context or, with panics, by a panic in a hook.
+func interruptAfter(t *testing.T, input string, n int, panics bool) {
+	t.Helper()
+	app, err := NewApp(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.sourceProvider = inputSource(t, input)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := 0
+	app.OnAfterAction = func(PlannedAction, error) {
+		if done++; done == n {
+			if panics {
+				panic("interrupted")
+			}
+			cancel()
+		}
+	}
+	s, err := app.ExecuteContext(ctx)
+	var detailed *DetailedError
+	switch {
+	case panics && !errors.As(err, &detailed):
+		t.Fatalf("error %v, want the recovered panic", err)
+	case !panics && !errors.Is(err, context.Canceled):
+		t.Fatalf("error %v, want %v", err, context.Canceled)
+	case !panics && !strings.Contains(s.Message, "--resume"):
+		t.Errorf("message %q does not mention --resume", s.Message)
+	}
+}
+
+// checkFiles compares a.txt, b.txt and c.txt to want, their lines joined
+// by "|".
+func checkFiles(t *testing.T, want string) {
+	t.Helper()
+	got := strings.Join([]string{readFile(t, "a.txt"), readFile(t, "b.txt"), readFile(t, "c.txt")}, "")
+	if want = strings.ReplaceAll(want, "|", "\n") + "\n"; got != want {
+		t.Errorf("files %q, want %q", got, want)
+	}
+}
+
+func TestResume(t *testing.T) {
+	const input = "`a.txt`\n```\nnew a\n```\n`b.txt`\n```\nnew b\n```\n`c.txt`\n```\nnew c\n```\n"
+	for _, tc := range []struct {
+		name    string
+		panics  bool // interrupt with a panic rather than by cancelling
+		cfg     Config
+		input   string
+		err     string // part of the error, when the run must fail
+		message string
+		want    string // content of a.txt, b.txt and c.txt
+		undone  string // their content after an undo, when one is run
+	}{
+		// The cancelled part is already in history, so undo leaves it
+		{name: "--resume finishes a cancelled apply", cfg: Config{Resume: true}, input: input,
+			want: "new a|new b|new c", undone: "new a|old b|old c"},
+		// A panic records no history, so the resumed apply records it all
+		{name: "--resume finishes an apply that panicked", panics: true, cfg: Config{Resume: true}, input: input,
+			want: "new a|new b|new c", undone: "old a|old b|old c"},
+		{name: "without --resume the apply is refused", input: input,
+			err: "interrupted after 1 of 3 actions", want: "new a|old b|old c"},
+		{name: "--force starts over", cfg: Config{Force: true}, input: input,
+			want: "new a|new b|new c", undone: "new a|old b|old c"},
+		{name: "--resume with other input does nothing", cfg: Config{Resume: true}, input: "`b.txt`\n```\nother\n```\n",
+			message: "No interrupted apply of this input to resume", want: "new a|old b|old c"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+				writeFile(t, p, "old "+p[:1]+"\n")
+			}
+			interruptAfter(t, input, 1, tc.panics)
+
+			s, err := runItf(t, tc.cfg, tc.input)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if s.Message != tc.message {
+				t.Errorf("message %q, want %q", s.Message, tc.message)
+			}
+			checkFiles(t, tc.want)
+			if tc.undone == "" {
+				return
+			}
+			if _, err := os.Stat(".itf/" + journalName); !os.IsNotExist(err) {
+				t.Errorf("journal left behind after the apply finished: %v", err)
+			}
+			mustRun(t, Config{Undo: true}, "")
+			checkFiles(t, tc.undone)
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package itf
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// indentSensitive lists the extensions whose files are checked by
+// mixedIndentLine.
+var indentSensitive = map[string]bool{
+	".py": true,
+	".go": true,
+}
+
+// mixedIndentLine returns the first line, numbered from 1, whose indentation
+// uses tabs where the file's first indented line uses spaces or the other
+// way round, or 0 when the indentation is consistent.
+func mixedIndentLine(lines []string) int {
+	var want byte
+	for i, l := range lines {
+		indent := l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+		if indent == "" || strings.TrimSpace(l) == "" {
+			continue
+		}
+		if want == 0 {
+			want = indent[0]
+		}
+		if strings.Contains(indent, " ") && strings.Contains(indent, "\t") || indent[0] != want {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// lintIndent warns about files written by actions whose indentation mixes
+// tabs and spaces, checking the last content planned for each path.
+func lintIndent(actions []PlannedAction, resolver *PathResolver) []string {
+	last := make(map[string][]string)
+	var paths []string
+	for _, a := range actions {
+		if a.Type != "write" || a.Change == nil || !indentSensitive[strings.ToLower(filepath.Ext(a.Change.Path))] {
+			continue
+		}
+		if _, ok := last[a.Change.Path]; !ok {
+			paths = append(paths, a.Change.Path)
+		}
+		last[a.Change.Path] = a.Change.Content
+	}
+
+	var warnings []string
+	for _, p := range paths {
+		if n := mixedIndentLine(last[p]); n > 0 {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: indentation mixes tabs and spaces", resolver.Relative(p), n))
+		}
+	}
+	return warnings
+}
+
+// checkUTF8 warns about the first line of each write whose content is not
+// valid UTF-8. With replace, invalid sequences in every line are replaced
+// with U+FFFD before the content is written.
+func checkUTF8(actions []PlannedAction, resolver *PathResolver, replace bool) []string {
+	var warnings []string
+	for _, a := range actions {
+		if a.Type != "write" || a.Change == nil {
+			continue
+		}
+		n := slices.IndexFunc(a.Change.Content, func(l string) bool { return !utf8.ValidString(l) })
+		if n == -1 {
+			continue
+		}
+		if !replace {
+			warnings = append(warnings, fmt.Sprintf("%s:%d: invalid UTF-8", resolver.Relative(a.Change.Path), n+1))
+			continue
+		}
+		content := slices.Clone(a.Change.Content)
+		for i, l := range content {
+			content[i] = strings.ToValidUTF8(l, "\uFFFD")
+		}
+		a.Change.Content = content
+		warnings = append(warnings, fmt.Sprintf("%s:%d: invalid UTF-8 replaced with U+FFFD", resolver.Relative(a.Change.Path), n+1))
+	}
+	return warnings
+}
@@ -0,0 +1,98 @@
+package itf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMixedIndentLine(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		source string
+		want   int
+	}{
+		{name: "python with spaces", source: "def f():\n    if x:\n        return 1\n", want: 0},
+		{name: "python with a tab among spaces", source: "def f():\n    if x:\n\treturn 1\n", want: 3},
+		{name: "python with tab and spaces on one line", source: "def f():\n\t    return 1\n", want: 2},
+		{name: "go with tabs", source: "func f() {\n\tif x {\n\t\treturn\n\t}\n}\n", want: 0},
+		{name: "go with spaces among tabs", source: "func f() {\n\tif x {\n        return\n\t}\n}\n", want: 3},
+		{name: "blank lines with other whitespace are ignored", source: "func f() {\n  \n\treturn\n}\n", want: 0},
+		{name: "nothing indented", source: "a\nb\n", want: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := mixedIndentLine(strings.Split(tc.source, "\n")); got != tc.want {
+				t.Errorf("mixedIndentLine = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLintIndent(t *testing.T) {
+	const input = "`a.py`\n```python\ndef f():\n    if x:\n\treturn 1\n```\n" +
+		"`b.go`\n```go\nfunc f() {\n\tif x {\n        return\n\t}\n}\n```\n" +
+		"`ok.go`\n```go\nfunc f() {\n\treturn\n}\n```\n" +
+		"`c.txt`\n```\n  a\n\tb\n```\n"
+	want := []string{
+		"a.py:3: indentation mixes tabs and spaces",
+		"b.go:3: indentation mixes tabs and spaces",
+	}
+	for _, lint := range []bool{true, false} {
+		inProject(t)
+		s := mustRun(t, Config{LintIndent: lint, DryRun: true}, input)
+		var got []string
+		for _, w := range s.Warnings {
+			if strings.Contains(w, "indentation mixes") {
+				got = append(got, w)
+			}
+		}
+		if !lint {
+			want = nil
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("--lint-indent=%v: warnings %q, want %q", lint, got, want)
+		}
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	const bad = "ok\nbad \xff\xfe here\n"
+	for _, tc := range []struct {
+		name    string
+		mode    string
+		content string
+		want    string // content written to a.txt
+		warning string
+		err     string
+	}{
+		{name: "passed through by default", content: bad, want: bad},
+		{name: "warn reports the line and writes it as is", mode: "warn", content: bad, want: bad, warning: "a.txt:2: invalid UTF-8"},
+		{name: "replace sanitizes the content", mode: "replace", content: bad, want: "ok\nbad � here\n", warning: "a.txt:2: invalid UTF-8 replaced with U+FFFD"},
+		{name: "valid content is left alone", mode: "replace", content: "ok\nnaïve\n", want: "ok\nnaïve\n"},
+		{name: "an unknown mode is refused", mode: "strip", content: bad, err: `invalid --invalid-utf8 "strip"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			s, err := runItf(t, Config{InvalidUTF8: tc.mode}, "`a.txt`\n```\n"+tc.content+"```\n")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, "a.txt"); got != tc.want {
+				t.Errorf("a.txt = %q, want %q", got, tc.want)
+			}
+			var want []string
+			if tc.warning != "" {
+				want = []string{tc.warning}
+			}
+			if !slices.Equal(s.Warnings, want) {
+				t.Errorf("warnings %q, want %q", s.Warnings, want)
+			}
+		})
+	}
+}
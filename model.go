@@ -1,5 +1,39 @@
 package itf
 
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit codes reported by the CLI.
+const (
+	ExitOK             = 0
+	ExitError          = 1
+	ExitPartialFailure = 2
+	ExitNothingToDo    = 3
+)
+
+// ExitCodeError carries a non-zero exit code for an outcome that is not a
+// hard error, such as a partial failure.
+type ExitCodeError struct {
+	Code int
+}
+
+func (e *ExitCodeError) Error() string { return fmt.Sprintf("exit status %d", e.Code) }
+
+// ExitCodeOf returns the exit code for an error from Execute: the code of an
+// ExitCodeError, ExitError for any other error and ExitOK for nil.
+func ExitCodeOf(err error) int {
+	var exitErr *ExitCodeError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &exitErr):
+		return exitErr.Code
+	}
+	return ExitError
+}
+
 type FileChange struct {
 	Path     string
 	Content  []string
@@ -30,5 +64,18 @@ type Summary struct {
 	Renamed  []string
 	Deleted  []string
 	Failed   []string
+	Warnings []string
 	Message  string
 }
+
+// ExitCode classifies a summary: any failure is a partial failure, and a
+// summary without changes or failures means there was nothing to do.
+func ExitCode(s Summary) int {
+	switch {
+	case len(s.Failed) > 0:
+		return ExitPartialFailure
+	case len(s.Created)+len(s.Modified)+len(s.Renamed)+len(s.Deleted) == 0:
+		return ExitNothingToDo
+	}
+	return ExitOK
+}
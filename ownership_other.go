@@ -0,0 +1,11 @@
+//go:build !unix
+
+package itf
+
+// File ownership is only meaningful on Unix; elsewhere it is skipped.
+
+func ResolveOwnership(owner, group string) (string, error) { return "", nil }
+
+func fileOwnership(path string) string { return "" }
+
+func chownPath(path, ownership string) error { return nil }
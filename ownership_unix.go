@@ -0,0 +1,67 @@
+//go:build unix
+
+package itf
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// ResolveOwnership turns an owner and group (names or numeric ids) into the
+// "uid:gid" form stored in history. An empty owner or group is left as -1,
+// meaning unchanged.
+func ResolveOwnership(owner, group string) (string, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		id, err := strconv.Atoi(owner)
+		if err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return "", fmt.Errorf("unknown owner %q: %w", owner, err)
+			}
+			id, _ = strconv.Atoi(u.Uid)
+		}
+		uid = id
+	}
+	if group != "" {
+		id, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return "", fmt.Errorf("unknown group %q: %w", group, err)
+			}
+			id, _ = strconv.Atoi(g.Gid)
+		}
+		gid = id
+	}
+	if uid == -1 && gid == -1 {
+		return "", nil
+	}
+	return fmt.Sprintf("%d:%d", uid, gid), nil
+}
+
+func fileOwnership(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", st.Uid, st.Gid)
+}
+
+func chownPath(path, ownership string) error {
+	if ownership == "" {
+		return nil
+	}
+	var uid, gid int
+	if _, err := fmt.Sscanf(ownership, "%d:%d", &uid, &gid); err != nil {
+		return fmt.Errorf("invalid ownership %q: %w", ownership, err)
+	}
+	return os.Chown(path, uid, gid)
+}
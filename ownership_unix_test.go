@@ -0,0 +1,62 @@
+//go:build unix
+
+package itf
+
+import (
+	"os"
+	"testing"
+)
+
+func TestResolveOwnership(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		owner, group string
+		want         string
+		err          bool
+	}{
+		{name: "neither"},
+		{name: "numeric owner and group", owner: "1234", group: "5678", want: "1234:5678"},
+		{name: "owner only", owner: "1234", want: "1234:-1"},
+		{name: "group only", group: "5678", want: "-1:5678"},
+		{name: "owner by name", owner: "root", want: "0:-1"},
+		{name: "unknown owner", owner: "no-such-user-itf", err: true},
+		{name: "unknown group", group: "no-such-group-itf", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ResolveOwnership(tc.owner, tc.group)
+			if (err != nil) != tc.err {
+				t.Fatalf("error %v, want error %v", err, tc.err)
+			}
+			if got != tc.want {
+				t.Errorf("ownership %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of a file needs root")
+	}
+	inProject(t)
+	writeFile(t, "old.txt", "one\n")
+	if err := os.Chown("old.txt", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	mustRun(t, Config{Owner: "1234", Group: "5678"}, "`old.txt`\n```\ntwo\n```\n`new.txt`\n```\nnew\n```\n")
+	for _, p := range []string{"old.txt", "new.txt"} {
+		if got := fileOwnership(p); got != "1234:5678" {
+			t.Errorf("%s is owned by %s, want 1234:5678", p, got)
+		}
+	}
+
+	mustRun(t, Config{Undo: true}, "")
+	if got := fileOwnership("old.txt"); got != "0:0" {
+		t.Errorf("undo left old.txt owned by %s, want 0:0", got)
+	}
+	mustRun(t, Config{Redo: true}, "")
+	if got := fileOwnership("old.txt"); got != "1234:5678" {
+		t.Errorf("redo left old.txt owned by %s, want 1234:5678", got)
+	}
+}
@@ -1,8 +1,13 @@
 package itf
 
 import (
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"strings"
 )
@@ -12,65 +17,231 @@ type ExecutionPlan struct {
 	FileActions  map[string]string
 	DirsToCreate map[string]struct{}
 	Failed       []string
+	Warnings     []string
+	cfg          *Config
+	// input is the hash of the content the plan was made from
+	input string
 }
 
+// CreatePlan plans content keeping only files with one of extensions and,
+// when files is not empty, only those files. CreatePlanWithConfig takes the
+// other options.
 func CreatePlan(content string, resolver *PathResolver, extensions []string, files []string) (*ExecutionPlan, error) {
+	return CreatePlanWithConfig(content, resolver, &Config{Extensions: extensions, Files: files})
+}
+
+func CreatePlanWithConfig(content string, resolver *PathResolver, cfg *Config) (*ExecutionPlan, error) {
+	return CreatePlanFromReader(strings.NewReader(content), resolver, cfg)
+}
+
+// CreatePlanFromReader plans each block as the parser emits it, without
+// holding the whole document in memory.
+func CreatePlanFromReader(src io.Reader, resolver *PathResolver, cfg *Config) (*ExecutionPlan, error) {
+	switch cfg.Only {
+	case "", "write", "rename", "delete":
+	default:
+		return nil, fmt.Errorf("invalid --only %q: want write, rename or delete", cfg.Only)
+	}
+	switch cfg.InvalidUTF8 {
+	case "", "warn", "replace":
+	default:
+		return nil, fmt.Errorf("invalid --invalid-utf8 %q: want warn or replace", cfg.InvalidUTF8)
+	}
+	var grep *regexp.Regexp
+	if cfg.Grep != "" {
+		var err error
+		if grep, err = regexp.Compile(cfg.Grep); err != nil {
+			return nil, fmt.Errorf("invalid --grep pattern: %w", err)
+		}
+	}
+	extensions := cfg.Extensions
 	allowedFiles := make(map[string]struct{})
-	for _, f := range files {
+	for _, f := range cfg.Files {
 		allowedFiles[resolver.Resolve(f)] = struct{}{}
 	}
 
-	allBlocks, err := ExtractCodeBlocks([]byte(content))
-	if err != nil {
-		return nil, err
-	}
-
 	var actions []PlannedAction
-	var failed []string
+	var failed, warnings []string
 	
 	// Track renames as we go to resolve diff sources correctly
 	renameDestSet := make(map[string]struct{})
 	renameDestToSource := make(map[string]string)
+	renamedAway := make(map[string]struct{})
+	// Content of files written earlier in this plan, so later diffs patch it
+	// rather than what is on disk
+	pending := make(map[string][]string)
+
+	outsideRoot := func(path string) bool {
+		return !cfg.AllowOutsideRoot && !resolver.IsWithinRoot(path)
+	}
+	deleted := make(map[string]struct{})
+	// exists reports whether path exists at this point of the plan
+	exists := func(path string) bool {
+		if _, ok := pending[path]; ok {
+			return true
+		}
+		if _, ok := renamedAway[path]; ok {
+			return false
+		}
+		if _, ok := deleted[path]; ok {
+			return false
+		}
+		if _, ok := renameDestSet[path]; ok {
+			return true
+		}
+		_, err := os.Stat(path)
+		return err == nil
+	}
+
+	// Diffs for files that do not exist yet are held back until the whole
+	// document is read, so a rename later in it can still provide the source
+	var deferredDiffs blockSpool
+	defer deferredDiffs.close()
+	streaming := true
 
-	for _, b := range allBlocks {
+	opts := ParseOptions{IndentedBlocks: cfg.IndentedBlocks}
+	planBlock := func(b CodeBlock) error {
+		// --grep selects file and diff blocks by content; renames and
+		// deletes are always planned
+		if grep != nil && b.Lang != "rename" && b.Lang != "delete" && !grep.MatchString(b.Content) {
+			return nil
+		}
+		// --revert-diff undoes diffs; anything else in the input is ignored
+		if cfg.RevertDiff && b.Lang != "diff" {
+			return nil
+		}
+		if fn, ok := cfg.blockHandlers[b.Lang]; ok && !isBuiltinLang(b.Lang) {
+			for _, a := range fn(b, resolver) {
+				if a.Type == "write" && a.Change != nil {
+					pending[a.Change.Path] = a.Change.Content
+				}
+				actions = append(actions, a)
+			}
+			return nil
+		}
 		switch b.Lang {
 		case "rename":
-			parsed := parseRenameBlock(b, resolver, allowedFiles)
+			parsed, warns := parseRenameBlock(b, resolver, cfg, allowedFiles)
+			warnings = append(warnings, warns...)
 			for _, r := range parsed {
+				if outsideRoot(r.OldPath) || outsideRoot(r.NewPath) {
+					failed = append(failed, r.OldPath)
+					continue
+				}
+				if !exists(r.OldPath) {
+					failed = append(failed, r.OldPath)
+					warnings = append(warnings, fmt.Sprintf("%s: cannot rename, the file does not exist", resolver.Relative(r.OldPath)))
+					continue
+				}
+				if exists(r.NewPath) && !sameFile(r.OldPath, r.NewPath) {
+					if !cfg.Force {
+						failed = append(failed, r.OldPath)
+						warnings = append(warnings, fmt.Sprintf("%s: cannot rename, %s already exists (use --force to replace it)", resolver.Relative(r.OldPath), resolver.Relative(r.NewPath)))
+						continue
+					}
+					// Trash the destination first so undo can bring it back
+					actions = append(actions, PlannedAction{Type: "delete", Path: r.NewPath})
+					delete(pending, r.NewPath)
+				}
 				actions = append(actions, PlannedAction{Type: "rename", Rename: &r})
+				delete(deleted, r.NewPath)
 				renameDestSet[r.NewPath] = struct{}{}
 				renameDestToSource[r.NewPath] = r.OldPath
+				renamedAway[r.OldPath] = struct{}{}
+				delete(renamedAway, r.NewPath)
+				if lines, ok := pending[r.OldPath]; ok {
+					pending[r.NewPath] = lines
+					delete(pending, r.OldPath)
+				}
 			}
 		case "delete":
 			paths := parseDeleteBlock(b, resolver, allowedFiles)
 			for _, p := range paths {
+				if outsideRoot(p) {
+					failed = append(failed, p)
+					continue
+				}
+				delete(pending, p)
+				deleted[p] = struct{}{}
 				actions = append(actions, PlannedAction{Type: "delete", Path: p})
 			}
 		case "diff":
-			raw := strings.Trim(b.Content, "\n")
-			path := ExtractPathFromDiff(raw)
+			raw := strings.Trim(stripFenceArtifacts(b.Content), "\n")
+			path := ExtractPathFromDiffWithPrefix(raw, cfg.diffPrefix().New)
 			if path == "" || !isAllowed(resolver.Resolve(path), allowedFiles) {
-				continue
+				return nil
+			}
+			if cfg.RevertDiff {
+				if strings.HasPrefix(raw, "--- /dev/null") || strings.Contains(raw, "\n--- /dev/null") {
+					failed = append(failed, resolver.Resolve(path))
+					warnings = append(warnings, fmt.Sprintf("%s: cannot revert a diff that creates the file; delete it instead", path))
+					return nil
+				}
+				raw = ReverseDiff(raw, cfg.diffPrefix())
 			}
-			
+			if cfg.selectHunk != nil {
+				var kept int
+				if raw, kept = selectHunks(raw, path, cfg.selectHunk); kept == 0 {
+					warnings = append(warnings, fmt.Sprintf("%s: every hunk was skipped", path))
+					return nil
+				}
+			}
+		
 			d := DiffBlock{FilePath: path, RawContent: raw}
 			abs := resolver.Resolve(d.FilePath)
+			if outsideRoot(abs) {
+				failed = append(failed, abs)
+				return nil
+			}
+			if _, ok := renamedAway[abs]; ok {
+				// The file was moved earlier in this plan; patching it would
+				// resurrect the old content. Recreate it with a file block.
+				failed = append(failed, abs)
+				return nil
+			}
+			if streaming && !exists(abs) {
+				return deferredDiffs.add(b)
+			}
 			sourcePath := abs
 			if s, ok := renameDestToSource[abs]; ok {
 				sourcePath = s
 			}
 
 			if len(extensions) > 0 && !HasAllowedExtension(d.FilePath, extensions) {
-				continue
+				return nil
 			}
 
-			patched, err := CorrectDiff(d, resolver, extensions, sourcePath)
-			if err != nil {
+			before, ok := pending[abs]
+			if !ok {
+				before = readLines(sourcePath)
+			}
+			var applied []string
+			patched, err := correctDiffHunks(before, d.RawContent, d.FilePath, cfg)
+			switch {
+			case err == nil:
+				applied = applyUnifiedDiff(before, patched, cfg)
+			case cfg.ConflictMarkers:
+				merged, n, ok := applyWithConflicts(before, d.RawContent, d.FilePath, cfg)
+				if !ok {
+					failed = append(failed, abs)
+					return nil
+				}
+				applied = merged
+				warnings = append(warnings, fmt.Sprintf("%s: %v; wrote %d conflict(s) to resolve", resolver.Relative(abs), err, n))
+			default:
 				failed = append(failed, abs)
-				continue
+				if cfg.RevertDiff {
+					warnings = append(warnings, fmt.Sprintf("%s: cannot revert, %v; the file no longer holds the diff's changes", resolver.Relative(abs), err))
+				}
+				return nil
 			}
-
-			applied := applyPatch(sourcePath, patched)
+			// A diff without hunks, or whose hunks cancel out, would only
+			// record a write that changes nothing
+			if slices.Equal(before, applied) {
+				warnings = append(warnings, fmt.Sprintf("%s: the diff changes nothing, skipped", resolver.Relative(abs)))
+				return nil
+			}
+			pending[abs] = applied
 			actions = append(actions, PlannedAction{
 				Type: "write",
 				Change: &FileChange{
@@ -82,19 +253,117 @@ func CreatePlan(content string, resolver *PathResolver, extensions []string, fil
 			})
 		default:
 			if len(extensions) == 1 && extensions[0] == ".diff" {
-				continue
+				return nil
+			}
+			change := parseFileBlock(b, resolver, cfg, allowedFiles)
+			if change == nil {
+				return nil
+			}
+			if outsideRoot(change.Path) {
+				failed = append(failed, change.Path)
+				return nil
 			}
-			change := parseFileBlock(b, resolver, extensions, allowedFiles)
-			if change != nil {
-				actions = append(actions, PlannedAction{Type: "write", Change: change})
+			if cfg.Template && !isSearchReplace(b.Content) {
+				expanded, err := expandTemplate(change.Content, cfg.Vars)
+				if err != nil {
+					failed = append(failed, change.Path)
+					warnings = append(warnings, fmt.Sprintf("%s: %v", resolver.Relative(change.Path), err))
+					return nil
+				}
+				change.Content = expanded
 			}
+			if isSearchReplace(b.Content) {
+				source, ok := pending[change.Path]
+				if !ok {
+					source = readLines(change.Path)
+				}
+				edited, err := editWithSearchReplace(source, b.Content, change.Path, cfg)
+				if err != nil {
+					failed = append(failed, change.Path)
+					warnings = append(warnings, fmt.Sprintf("%s: %v", resolver.Relative(change.Path), err))
+					return nil
+				}
+				change.Content, change.Source = edited, "search-replace"
+			}
+			// A full file block may recreate a path renamed away earlier
+			delete(renamedAway, change.Path)
+			if _, intent := hintIntent(b.Hint); intent == intentNew {
+				// Refuse to clobber a file the block claims to be creating
+				if _, err := os.Stat(change.Path); err == nil {
+					failed = append(failed, change.Path)
+					return nil
+				}
+			}
+			pending[change.Path] = change.Content
+			actions = append(actions, PlannedAction{Type: "write", Change: change})
+		}
+		return nil
+	}
+
+	// With a single --file, one block without a path hint is written to it,
+	// unless another block names the file
+	var unhinted []CodeBlock
+	named := false
+	err := StreamCodeBlocks(src, opts, func(b CodeBlock) error {
+		if len(cfg.Files) != 1 {
+			return planBlock(b)
+		}
+		target := resolver.Resolve(cfg.Files[0])
+		if isUnhinted(b, target, resolver) {
+			unhinted = append(unhinted, b)
+			return nil
+		}
+		named = named || blockKind(b, target, resolver, cfg) != ""
+		return planBlock(b)
+	})
+	var pe *ParseError
+	if cfg.PartialParse && errors.As(err, &pe) {
+		warnings = append(warnings, fmt.Sprintf("input %v; the blocks after it were not read", pe))
+	} else if err != nil {
+		return nil, err
+	}
+	streaming = false
+	if err := deferredDiffs.each(planBlock); err != nil {
+		return nil, err
+	}
+	if len(unhinted) == 1 && !named {
+		b := unhinted[0]
+		b.Hint = "`" + cfg.Files[0] + "`"
+		if err := planBlock(b); err != nil {
+			return nil, err
 		}
 	}
 
-	targetPaths := collectTargetPaths(actions)
+	if cfg.Only != "" {
+		actions = slices.DeleteFunc(actions, func(a PlannedAction) bool { return a.Type != cfg.Only })
+	}
+
+	if cfg.LintIndent {
+		warnings = append(warnings, lintIndent(actions, resolver)...)
+	}
+	if cfg.InvalidUTF8 != "" {
+		warnings = append(warnings, checkUTF8(actions, resolver, cfg.InvalidUTF8 == "replace")...)
+	}
+
+	plan := &ExecutionPlan{Actions: actions, Failed: failed, Warnings: warnings, cfg: cfg}
+	plan.Refresh()
+	return plan, nil
+}
+
+// Refresh recomputes FileActions and DirsToCreate from Actions and the
+// current filesystem, so a plan stays consistent after actions are edited.
+func (p *ExecutionPlan) Refresh() {
+	renameDestSet := make(map[string]struct{})
+	for _, a := range p.Actions {
+		if a.Type == "rename" {
+			renameDestSet[a.Rename.NewPath] = struct{}{}
+		}
+	}
+
+	targetPaths := collectTargetPaths(p.Actions)
 	fileActions, dirs := GetFileActionsAndDirs(targetPaths, renameDestSet)
-	
-	for _, a := range actions {
+
+	for _, a := range p.Actions {
 		switch a.Type {
 		case "delete":
 			fileActions[a.Path] = "delete"
@@ -102,17 +371,37 @@ func CreatePlan(content string, resolver *PathResolver, extensions []string, fil
 			fileActions[a.Rename.OldPath] = "rename"
 		}
 	}
+	p.FileActions = fileActions
+	p.DirsToCreate = dirs
+}
+
+func isBuiltinLang(lang string) bool {
+	return lang == "rename" || lang == "delete" || lang == "diff"
+}
 
-	return &ExecutionPlan{
-		Actions:      actions,
-		FileActions:  fileActions,
-		DirsToCreate: dirs,
-		Failed:       failed,
-	}, nil
+// isUnhinted reports whether a file-kind block lacks a hint naming a path
+// other than target. A single word like "Here:" passes for a bare file name,
+// so hints for other files need an extension or a directory to count.
+func isUnhinted(b CodeBlock, target string, resolver *PathResolver) bool {
+	switch b.Lang {
+	case "rename", "delete", "diff":
+		return false
+	}
+	p := blockPath(b)
+	if p == "" {
+		return true
+	}
+	if resolver.Resolve(p) == target {
+		return false
+	}
+	return strings.HasSuffix(p, ":") || !strings.ContainsAny(p, `./\`)
 }
 
-func parseFileBlock(b CodeBlock, resolver *PathResolver, extensions []string, allowed map[string]struct{}) *FileChange {
-	path := ExtractPathFromHint(b.Hint)
+func parseFileBlock(b CodeBlock, resolver *PathResolver, cfg *Config, allowed map[string]struct{}) *FileChange {
+	if !HasAllowedLang(b.Lang, cfg.Langs) {
+		return nil
+	}
+	path := blockPath(b)
 	if path == "" {
 		return nil
 	}
@@ -120,7 +409,7 @@ func parseFileBlock(b CodeBlock, resolver *PathResolver, extensions []string, al
 	if !isAllowed(abs, allowed) {
 		return nil
 	}
-	if !HasAllowedExtension(path, extensions) {
+	if !HasAllowedExtension(path, cfg.Extensions) {
 		return nil
 	}
 
@@ -144,17 +433,17 @@ func ExtractDiffBlocks(content string, resolver *PathResolver, files []string) [
 	for _, f := range files {
 		allowed[resolver.Resolve(f)] = struct{}{}
 	}
-	return extractDiffBlocksFromParsed(blocks, resolver, allowed)
+	return extractDiffBlocksFromParsed(blocks, resolver, allowed, DefaultDiffPrefix.New)
 }
 
-func extractDiffBlocksFromParsed(blocks []CodeBlock, resolver *PathResolver, allowed map[string]struct{}) []DiffBlock {
+func extractDiffBlocksFromParsed(blocks []CodeBlock, resolver *PathResolver, allowed map[string]struct{}, newPrefix string) []DiffBlock {
 	var diffs []DiffBlock
 	for _, b := range blocks {
 		if b.Lang != "diff" {
 			continue
 		}
-		raw := strings.Trim(b.Content, "\n")
-		path := ExtractPathFromDiff(raw)
+		raw := strings.Trim(stripFenceArtifacts(b.Content), "\n")
+		path := ExtractPathFromDiffWithPrefix(raw, newPrefix)
 		if path == "" {
 			continue
 		}
@@ -168,10 +457,64 @@ func extractDiffBlocksFromParsed(blocks []CodeBlock, resolver *PathResolver, all
 	return diffs
 }
 
-func ExtractPathFromHint(hint string) string {
+// stripFenceArtifacts drops lines that are nothing but a fence marker, which
+// leak into a diff block when the surrounding fences are mismatched.
+func stripFenceArtifacts(content string) string {
+	lines := strings.Split(content, "\n")
+	kept := lines[:0]
+	for _, l := range lines {
+		if isFenceArtifact(l) {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	return strings.Join(kept, "\n")
+}
+
+// Lines with a diff prefix (" ", "+", "-") are content, even if they hold a
+// fence, so only unprefixed lines are considered.
+func isFenceArtifact(line string) bool {
+	trimmed := strings.TrimRight(line, " \t\r")
+	char, count, ok := parseOpeningFence(trimmed)
+	if !ok {
+		return false
+	}
+	info := strings.TrimSpace(trimmed[count:])
+	return !strings.ContainsAny(info, " \t"+string(char))
+}
+
+const (
+	intentNew       = "new"
+	intentOverwrite = "overwrite"
+)
+
+// hintIntent splits a trailing "(new)" or "(overwrite)" annotation off a
+// path hint. A block marked new fails if its file already exists.
+func hintIntent(hint string) (string, string) {
 	hint = strings.TrimSpace(hint)
+	for _, intent := range []string{intentNew, intentOverwrite} {
+		suffix := "(" + intent + ")"
+		if len(hint) > len(suffix) && strings.EqualFold(hint[len(hint)-len(suffix):], suffix) {
+			return strings.TrimSpace(hint[:len(hint)-len(suffix)]), intent
+		}
+	}
+	return hint, ""
+}
+
+func ExtractPathFromHint(hint string) string {
+	hint, _ = hintIntent(hint)
+	if path, ok := commentPathHint(hint); ok {
+		return path
+	}
 	hint = strings.TrimLeft(hint, "# ")
 	hint = strings.Trim(hint, "*")
+	// A path quoted as a whole may contain spaces; in `a` b the quote
+	// closes early, so the hint is not a path.
+	if quoted, ok := strings.CutPrefix(hint, "`"); ok {
+		if inner, ok := strings.CutSuffix(quoted, "`"); ok && !strings.Contains(inner, "`") {
+			return strings.TrimSpace(inner)
+		}
+	}
 	hint = strings.Trim(hint, "`")
 
 	path := strings.TrimSpace(hint)
@@ -181,6 +524,53 @@ func ExtractPathFromHint(hint string) string {
 	return ""
 }
 
+// blockPath returns the path a file block is for: the one in its hint or,
+// failing that, one written in the fence info string.
+func blockPath(b CodeBlock) string {
+	if p := ExtractPathFromHint(b.Hint); p != "" {
+		return p
+	}
+	return fencePath(b)
+}
+
+var fileExtPattern = regexp.MustCompile(`\.[A-Za-z][A-Za-z0-9]*$`)
+
+// fencePath reads a path from the info string, as in ```go path/to/file.go
+// or ```main.go. A token is taken for a path, not a language, when it has a
+// directory or a file extension.
+func fencePath(b CodeBlock) string {
+	attr, _, _ := strings.Cut(b.Attrs, " ")
+	for _, tok := range []string{attr, b.Lang} {
+		if tok == "" || strings.ContainsAny(tok, `{}="'`) {
+			continue
+		}
+		if strings.ContainsAny(tok, `/\`) || fileExtPattern.MatchString(tok) {
+			return tok
+		}
+	}
+	return ""
+}
+
+// commentPathHint reads hints written as "<!-- file: path -->" or
+// "# file: path", as some tools emit before each block.
+func commentPathHint(hint string) (string, bool) {
+	h := strings.TrimSpace(hint)
+	if inner, ok := strings.CutPrefix(h, "<!--"); ok {
+		if h, ok = strings.CutSuffix(inner, "-->"); !ok {
+			return "", false
+		}
+	} else if h, ok = strings.CutPrefix(h, "#"); !ok {
+		return "", false
+	}
+
+	label, path, ok := strings.Cut(h, ":")
+	if !ok || !strings.EqualFold(strings.TrimSpace(label), "file") {
+		return "", false
+	}
+	path = strings.Trim(strings.TrimSpace(path), "`")
+	return path, path != ""
+}
+
 func HasAllowedExtension(path string, extensions []string) bool {
 	if len(extensions) == 0 {
 		return true
@@ -188,6 +578,15 @@ func HasAllowedExtension(path string, extensions []string) bool {
 	return slices.Contains(extensions, filepath.Ext(path))
 }
 
+func HasAllowedLang(lang string, langs []string) bool {
+	if len(langs) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(langs, func(l string) bool {
+		return strings.EqualFold(strings.TrimSpace(l), lang)
+	})
+}
+
 func parseDeleteBlock(b CodeBlock, resolver *PathResolver, allowed map[string]struct{}) []string {
 	var paths []string
 	for line := range strings.SplitSeq(b.Content, "\n") {
@@ -204,24 +603,45 @@ func parseDeleteBlock(b CodeBlock, resolver *PathResolver, allowed map[string]st
 	return paths
 }
 
-func parseRenameBlock(b CodeBlock, resolver *PathResolver, allowed map[string]struct{}) []FileRename {
+// parseRenameBlock reads one "old new" pair per line. A line with more paths
+// is a chained move when cfg.ChainRenames is set ("a b c" moves b to c, then
+// a to b); otherwise it is skipped with a warning, as is a line with one path.
+func parseRenameBlock(b CodeBlock, resolver *PathResolver, cfg *Config, allowed map[string]struct{}) ([]FileRename, []string) {
 	var renames []FileRename
+	var warnings []string
 	for line := range strings.SplitSeq(b.Content, "\n") {
 		parts := strings.Fields(strings.TrimSpace(line))
-		if len(parts) != 2 {
+		if len(parts) == 0 {
 			continue
 		}
-		oldAbs, newAbs := resolver.Resolve(parts[0]), resolver.Resolve(parts[1])
-		if len(allowed) > 0 {
-			_, ok1 := allowed[oldAbs]
-			_, ok2 := allowed[newAbs]
-			if !ok1 && !ok2 {
-				continue
+		if len(parts) == 1 || (len(parts) > 2 && !cfg.ChainRenames) {
+			warnings = append(warnings, fmt.Sprintf("rename line %q needs exactly 2 paths, found %d; skipped", strings.TrimSpace(line), len(parts)))
+			continue
+		}
+		for i := len(parts) - 2; i >= 0; i-- {
+			oldAbs, newAbs := resolver.Resolve(parts[i]), resolver.Resolve(parts[i+1])
+			if len(allowed) > 0 {
+				_, ok1 := allowed[oldAbs]
+				_, ok2 := allowed[newAbs]
+				if !ok1 && !ok2 {
+					continue
+				}
 			}
+			renames = append(renames, FileRename{OldPath: oldAbs, NewPath: newAbs})
 		}
-		renames = append(renames, FileRename{OldPath: oldAbs, NewPath: newAbs})
 	}
-	return renames
+	return renames, warnings
+}
+
+// sameFile reports whether two paths name one existing file, as when a
+// rename only changes case on a case-insensitive filesystem.
+func sameFile(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	return err == nil && os.SameFile(ia, ib)
 }
 
 func isAllowed(path string, allowed map[string]struct{}) bool {
@@ -258,3 +678,51 @@ func collectTargetPaths(actions []PlannedAction) []string {
 	}
 	return paths
 }
+
+// blockSpool keeps blocks in a temporary file until they are needed, so
+// setting aside the blocks of a large input does not hold them in memory.
+type blockSpool struct {
+	f   *os.File
+	enc *gob.Encoder
+	n   int
+}
+
+func (s *blockSpool) add(b CodeBlock) error {
+	if s.f == nil {
+		f, err := os.CreateTemp("", "itf-spool-*")
+		if err != nil {
+			return err
+		}
+		s.f, s.enc = f, gob.NewEncoder(f)
+	}
+	s.n++
+	return s.enc.Encode(b)
+}
+
+// each calls fn with the blocks in the order they were added.
+func (s *blockSpool) each(fn func(CodeBlock) error) error {
+	if s.f == nil {
+		return nil
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dec := gob.NewDecoder(s.f)
+	for range s.n {
+		var b CodeBlock
+		if err := dec.Decode(&b); err != nil {
+			return err
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *blockSpool) close() {
+	if s.f != nil {
+		s.f.Close()
+		os.Remove(s.f.Name())
+	}
+}
@@ -0,0 +1,692 @@
+package itf
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// plannedWrites returns the project-relative paths plan writes, in order.
+func plannedWrites(t *testing.T, plan *ExecutionPlan, resolver *PathResolver) []string {
+	t.Helper()
+	var paths []string
+	for _, a := range plan.Actions {
+		if a.Type == "write" {
+			paths = append(paths, resolver.Relative(a.Change.Path))
+		}
+	}
+	return paths
+}
+
+func newTestResolver(t *testing.T) *PathResolver {
+	t.Helper()
+	resolver, err := NewPathResolver()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolver
+}
+
+func TestLangAndExtensionFilters(t *testing.T) {
+	input := "`a.go`\n```go\npackage a\n```\n" +
+		"`b.py`\n```python\nb = 1\n```\n" +
+		"`c.txt`\n```go\nnot really go\n```\n" +
+		"`d.go`\n```\nno language\n```\n"
+	for _, tc := range []struct {
+		name       string
+		langs      []string
+		extensions []string
+		want       []string
+	}{
+		{name: "no filter", want: []string{"a.go", "b.py", "c.txt", "d.go"}},
+		{name: "lang only", langs: []string{"go"}, want: []string{"a.go", "c.txt"}},
+		{name: "extension only", extensions: []string{".go"}, want: []string{"a.go", "d.go"}},
+		{name: "lang and extension", langs: []string{"go"}, extensions: []string{".go"}, want: []string{"a.go"}},
+		{name: "several langs and an extension", langs: []string{"go", "python"}, extensions: []string{".py", ".txt"}, want: []string{"b.py", "c.txt"}},
+		{name: "disjoint", langs: []string{"python"}, extensions: []string{".go"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			resolver := newTestResolver(t)
+			plan, err := CreatePlanWithConfig(input, resolver, &Config{Langs: tc.langs, Extensions: tc.extensions})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := plannedWrites(t, plan, resolver); !slices.Equal(got, tc.want) {
+				t.Errorf("wrote %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCreatePlanKeepsItsSignature(t *testing.T) {
+	inProject(t)
+	resolver := newTestResolver(t)
+	input := "`a.go`\n```go\npackage a\n```\n`b.py`\n```python\nb = 1\n```\n`c.go`\n```go\npackage c\n```\n"
+	plan, err := CreatePlan(input, resolver, []string{".go"}, []string{"c.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := plannedWrites(t, plan, resolver); !slices.Equal(got, []string{"c.go"}) {
+		t.Errorf("wrote %q, want only c.go", got)
+	}
+}
+
+func TestRenameThenEditOldPath(t *testing.T) {
+	rename := "```rename\nold.txt new.txt\n```\n"
+	diff := func(path string) string {
+		return "```diff\n--- a/" + path + "\n+++ b/" + path + "\n@@ -1 +1 @@\n-one\n+two\n```\n"
+	}
+	for _, tc := range []struct {
+		name       string
+		input      string
+		wantWrites []string
+		wantFailed []string
+	}{
+		{name: "diff on the old path is refused", input: rename + diff("old.txt"), wantFailed: []string{"old.txt"}},
+		{name: "diff on the new path patches the moved file", input: rename + diff("new.txt"), wantWrites: []string{"new.txt"}},
+		{name: "diff before the rename applies", input: diff("old.txt") + rename, wantWrites: []string{"old.txt"}},
+		{name: "diff on the new path before the rename patches the moved file", input: diff("new.txt") + rename, wantWrites: []string{"new.txt"}},
+		{name: "a file block recreates the old path", input: rename + "`old.txt`\n```\nfresh\n```\n", wantWrites: []string{"old.txt"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "old.txt", "one\n")
+			resolver := newTestResolver(t)
+			plan, err := CreatePlanWithConfig(tc.input, resolver, &Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := plannedWrites(t, plan, resolver); !slices.Equal(got, tc.wantWrites) {
+				t.Errorf("writes %q, want %q", got, tc.wantWrites)
+			}
+			var failed []string
+			for _, p := range plan.Failed {
+				failed = append(failed, resolver.Relative(p))
+			}
+			if !slices.Equal(failed, tc.wantFailed) {
+				t.Errorf("failed %q, want %q", failed, tc.wantFailed)
+			}
+			for _, a := range plan.Actions {
+				if a.Type == "write" && resolver.Relative(a.Change.Path) == "new.txt" && !slices.Equal(a.Change.Content, []string{"two"}) {
+					t.Errorf("new.txt patched to %q, want the moved content patched", a.Change.Content)
+				}
+			}
+		})
+	}
+
+	t.Run("diff on the new path before the rename applies and undoes", func(t *testing.T) {
+		inProject(t)
+		writeFile(t, "old.txt", "one\n")
+		mustRun(t, Config{}, diff("new.txt")+rename)
+		if got := readFile(t, "new.txt"); got != "two\n" {
+			t.Errorf("new.txt = %q, want %q", got, "two\n")
+		}
+		if _, err := os.Stat("old.txt"); !os.IsNotExist(err) {
+			t.Errorf("old.txt still exists: %v", err)
+		}
+		mustRun(t, Config{Undo: true}, "")
+		if got := readFile(t, "old.txt"); got != "one\n" {
+			t.Errorf("after undo old.txt = %q, want %q", got, "one\n")
+		}
+		if _, err := os.Stat("new.txt"); !os.IsNotExist(err) {
+			t.Errorf("after undo new.txt exists: %v", err)
+		}
+	})
+}
+
+func TestRenameOperands(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		line    string
+		chain   bool
+		want    []string // planned renames as "old>new"
+		warning string
+	}{
+		{name: "two paths", line: "a.txt c.txt", want: []string{"a.txt>c.txt"}},
+		{name: "one path", line: "a.txt", warning: `rename line "a.txt" needs exactly 2 paths, found 1; skipped`},
+		{name: "three paths", line: "a.txt b.txt c.txt", warning: `rename line "a.txt b.txt c.txt" needs exactly 2 paths, found 3; skipped`},
+		{name: "three paths chained", line: "a.txt b.txt c.txt", chain: true, want: []string{"b.txt>c.txt", "a.txt>b.txt"}},
+		{name: "two paths with --chain-renames", line: "a.txt c.txt", chain: true, want: []string{"a.txt>c.txt"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "A\n")
+			writeFile(t, "b.txt", "B\n")
+			resolver := newTestResolver(t)
+			plan, err := CreatePlanWithConfig("```rename\n"+tc.line+"\n```\n", resolver, &Config{ChainRenames: tc.chain})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, a := range plan.Actions {
+				if a.Type == "rename" {
+					got = append(got, resolver.Relative(a.Rename.OldPath)+">"+resolver.Relative(a.Rename.NewPath))
+				}
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("renames %q, want %q", got, tc.want)
+			}
+			if tc.warning != "" && !slices.Contains(plan.Warnings, tc.warning) {
+				t.Errorf("warnings %q, want %q", plan.Warnings, tc.warning)
+			}
+		})
+	}
+
+	t.Run("chained move applies without overwriting", func(t *testing.T) {
+		inProject(t)
+		writeFile(t, "a.txt", "A\n")
+		writeFile(t, "b.txt", "B\n")
+		mustRun(t, Config{ChainRenames: true}, "```rename\na.txt b.txt c.txt\n```\n")
+		if readFile(t, "b.txt") != "A\n" || readFile(t, "c.txt") != "B\n" {
+			t.Errorf("b.txt = %q, c.txt = %q", readFile(t, "b.txt"), readFile(t, "c.txt"))
+		}
+		if _, err := os.Stat("a.txt"); !os.IsNotExist(err) {
+			t.Errorf("a.txt still exists: %v", err)
+		}
+	})
+}
+
+func TestCreateThenDiff(t *testing.T) {
+	patch := "```diff\n--- a/foo.go\n+++ b/foo.go\n@@ -1,2 +1,2 @@\n package foo\n-var x = 1\n+var x = 2\n```\n"
+	for _, tc := range []struct {
+		name   string
+		onDisk string // "" when foo.go does not exist
+		input  string
+		want   string
+		failed bool
+	}{
+		{name: "diff patches a file created above",
+			input: "`foo.go`\n```go\npackage foo\nvar x = 1\n```\n" + patch, want: "package foo\nvar x = 2\n"},
+		{name: "diff patches what a block above wrote, not the disk",
+			onDisk: "package foo\nvar y = 0\n",
+			input:  "`foo.go`\n```go\npackage foo\nvar x = 1\n```\n" + patch, want: "package foo\nvar x = 2\n"},
+		{name: "diff against the replaced content fails",
+			onDisk: "package foo\nvar x = 1\n",
+			input:  "`foo.go`\n```go\npackage foo\nvar y = 0\n```\n" + patch, want: "package foo\nvar y = 0\n", failed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			if tc.onDisk != "" {
+				writeFile(t, "foo.go", tc.onDisk)
+			}
+			s, err := runItf(t, Config{}, tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, "foo.go"); got != tc.want {
+				t.Errorf("foo.go = %q, want %q", got, tc.want)
+			}
+			if failed := len(s.Failed) > 0; failed != tc.failed {
+				t.Errorf("failed %q", s.Failed)
+			}
+
+			mustRun(t, Config{Undo: true}, "")
+			got, err := os.ReadFile("foo.go")
+			if tc.onDisk == "" && !os.IsNotExist(err) {
+				t.Errorf("undo left the created file: %q", got)
+			}
+			if tc.onDisk != "" && string(got) != tc.onDisk {
+				t.Errorf("undo restored %q, want %q", got, tc.onDisk)
+			}
+		})
+	}
+}
+
+func TestRevertDiff(t *testing.T) {
+	const original = "package foo\n\nvar x = 1\n\nvar y = 1\n"
+	diff := func(path, header, body string) string {
+		return "```diff\n--- a/" + path + "\n+++ b/" + path + "\n" + header + "\n" + body + "```\n"
+	}
+	patch := diff("foo.go", "@@ -2,3 +2,3 @@", " \n-var x = 1\n+var x = 2\n \n")
+	for _, tc := range []struct {
+		name    string
+		later   string // applied after patch and before the revert
+		revert  string
+		want    string
+		warning string // part of the warning when the revert must fail
+	}{
+		{name: "the last apply", revert: patch, want: original},
+		{name: "an apply followed by one to another file",
+			later:  "`bar.go`\n```go\npackage foo\n```\n",
+			revert: patch, want: original},
+		{name: "an apply followed by an edit elsewhere in the file",
+			later:  diff("foo.go", "@@ -4,2 +4,2 @@", " \n-var y = 1\n+var y = 3\n"),
+			revert: patch, want: "package foo\n\nvar x = 1\n\nvar y = 3\n"},
+		{name: "only diffs are reverted",
+			revert: "`foo.go`\n```go\npackage bar\n```\n" + patch, want: original},
+		{name: "the file has diverged",
+			later:  diff("foo.go", "@@ -2,3 +2,3 @@", " \n-var x = 2\n+var x = 5\n \n"),
+			revert: patch, want: "package foo\n\nvar x = 5\n\nvar y = 1\n", warning: "the file no longer holds the diff's changes"},
+		{name: "a diff that created a file",
+			later:  diff("new.go", "@@ -0,0 +1 @@", "+package foo\n"),
+			revert: strings.Replace(diff("new.go", "@@ -0,0 +1 @@", "+package foo\n"), "a/new.go", "/dev/null", 1),
+			want:   "package foo\n\nvar x = 2\n\nvar y = 1\n", warning: "cannot revert a diff that creates the file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "foo.go", original)
+			mustRun(t, Config{}, patch)
+			if tc.later != "" {
+				mustRun(t, Config{}, tc.later)
+			}
+			s := mustRun(t, Config{RevertDiff: true}, tc.revert)
+			if got := readFile(t, "foo.go"); got != tc.want {
+				t.Errorf("foo.go = %q, want %q", got, tc.want)
+			}
+			if failed := len(s.Failed) > 0; failed != (tc.warning != "") {
+				t.Errorf("failed %q, warnings %q", s.Failed, s.Warnings)
+			}
+			if tc.warning != "" && !slices.ContainsFunc(s.Warnings, func(w string) bool { return strings.Contains(w, tc.warning) }) {
+				t.Errorf("warnings %q, want one containing %q", s.Warnings, tc.warning)
+			}
+		})
+	}
+}
+
+func TestStrayFenceLines(t *testing.T) {
+	const hunk = "--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-one\n+two\n"
+	for _, tc := range []struct {
+		name  string
+		input string
+		path  string
+		want  string
+	}{
+		{name: "opening fence leaked in", input: "````diff\n```diff\n" + hunk + "````\n", path: "a.txt", want: "two\n"},
+		{name: "closing fence leaked in", input: "````diff\n" + hunk + "```\n````\n", path: "a.txt", want: "two\n"},
+		{name: "both, with trailing spaces", input: "````diff\n```diff \n" + hunk + "```  \n````\n", path: "a.txt", want: "two\n"},
+		{name: "tilde fence", input: "````diff\n~~~\n" + hunk + "~~~\n````\n", path: "a.txt", want: "two\n"},
+		{name: "added fence lines are content", path: "doc.md", want: "intro\n```go\n```\n",
+			input: "````diff\n--- a/doc.md\n+++ b/doc.md\n@@ -1 +1,3 @@\n intro\n+```go\n+```\n````\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "one\n")
+			writeFile(t, "doc.md", "intro\n")
+			s := mustRun(t, Config{}, tc.input)
+			if len(s.Failed) > 0 {
+				t.Errorf("failed %q, warnings %q", s.Failed, s.Warnings)
+			}
+			if got := readFile(t, tc.path); got != tc.want {
+				t.Errorf("%s = %q, want %q", tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHintIntent(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		hint   string
+		exists bool
+		want   string
+		failed bool
+	}{
+		{name: "new file marked new", hint: "`a.txt` (new)", want: "written\n"},
+		{name: "existing file marked new is refused", hint: "`a.txt` (new)", exists: true, want: "existing\n", failed: true},
+		{name: "marker is case-insensitive", hint: "**`a.txt`** (NEW)", exists: true, want: "existing\n", failed: true},
+		{name: "existing file marked overwrite", hint: "`a.txt` (overwrite)", exists: true, want: "written\n"},
+		{name: "new file marked overwrite", hint: "`a.txt` (overwrite)", want: "written\n"},
+		{name: "no marker overwrites", hint: "`a.txt`", exists: true, want: "written\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			if tc.exists {
+				writeFile(t, "a.txt", "existing\n")
+			}
+			s := mustRun(t, Config{}, tc.hint+"\n```\nwritten\n```\n")
+			if got := readFile(t, "a.txt"); got != tc.want {
+				t.Errorf("a.txt = %q, want %q", got, tc.want)
+			}
+			if failed := slices.Contains(s.Failed, "a.txt"); failed != tc.failed {
+				t.Errorf("failed %q", s.Failed)
+			}
+		})
+	}
+}
+
+func TestExtractPathFromHint(t *testing.T) {
+	for _, tc := range []struct {
+		hint, want string
+	}{
+		{"`main.go`", "main.go"},
+		{"main.go", "main.go"},
+		{"## `src/main.go`", "src/main.go"},
+		{"**`main.go`**", "main.go"},
+		// A path quoted as a whole may contain spaces
+		{"`my docs/file.md`", "my docs/file.md"},
+		{"**`my docs/file.md`**", "my docs/file.md"},
+		// A quote closing before the end leaves a path plus another token
+		{"`a` b", ""},
+		{"`my docs/file.md` is new", ""},
+		// Unquoted text with spaces is prose, not a path
+		{"my docs/file.md", ""},
+		{"Here is the change:", ""},
+		{"", ""},
+	} {
+		if got := ExtractPathFromHint(tc.hint); got != tc.want {
+			t.Errorf("ExtractPathFromHint(%q) = %q, want %q", tc.hint, got, tc.want)
+		}
+	}
+}
+
+func TestSingleFileBinding(t *testing.T) {
+	const block = "```go\npackage main\n```\n"
+	for _, tc := range []struct {
+		name  string
+		files []string
+		input string
+		want  string // content of main.go; empty when it must not be written
+	}{
+		{name: "one hint-less block binds to the only file", files: []string{"main.go"}, input: block, want: "package main\n"},
+		{name: "a word hint is not a path", files: []string{"main.go"}, input: "Here:\n" + block, want: "package main\n"},
+		{name: "two hint-less blocks are ambiguous", files: []string{"main.go"}, input: block + "```go\npackage other\n```\n"},
+		{name: "a block naming the file wins", files: []string{"main.go"},
+			input: "`main.go`\n```go\npackage named\n```\n" + block, want: "package named\n"},
+		{name: "two files are ambiguous", files: []string{"main.go", "other.go"}, input: block},
+		{name: "without --file nothing binds", input: block},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			if _, err := runItf(t, Config{Files: tc.files}, tc.input); err != nil {
+				t.Fatal(err)
+			}
+			if tc.want == "" {
+				if _, err := os.Stat("main.go"); !os.IsNotExist(err) {
+					t.Errorf("main.go written: %v", err)
+				}
+				return
+			}
+			if got := readFile(t, "main.go"); got != tc.want {
+				t.Errorf("main.go = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCommentPathHint(t *testing.T) {
+	for _, tc := range []struct {
+		hint, want string
+	}{
+		{"<!-- file: src/x.go -->", "src/x.go"},
+		{"<!--file:src/x.go-->", "src/x.go"},
+		{"<!-- File: `src/x.go` -->", "src/x.go"},
+		{"# file: src/x.go", "src/x.go"},
+		{"#file: my docs/x.md", "my docs/x.md"},
+		{"## file: src/x.go", ""},
+		{"<!-- file: src/x.go", ""},
+		{"<!-- note: src/x.go -->", ""},
+		{"# file:", ""},
+		{"`src/x.go`", ""},
+	} {
+		got, ok := commentPathHint(tc.hint)
+		if got != tc.want || ok != (tc.want != "") {
+			t.Errorf("commentPathHint(%q) = %q, %v; want %q", tc.hint, got, ok, tc.want)
+		}
+	}
+
+	// Each style names the path of the block that follows it
+	inProject(t)
+	mustRun(t, Config{}, "<!-- file: a.txt -->\n```\nA\n```\n# file: b.txt\n```\nB\n```\n")
+	if got := readFile(t, "a.txt") + readFile(t, "b.txt"); got != "A\nB\n" {
+		t.Errorf("files %q, want both written", got)
+	}
+}
+
+func TestOnly(t *testing.T) {
+	const input = "`a.txt`\n```\nnew a\n```\n```rename\nb.txt c.txt\n```\n```delete\nd.txt\n```\n"
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+	// state describes the tree as "a.txt content|b.txt|c.txt|d.txt"
+	state := func() string {
+		return fmt.Sprintf("%s|%v|%v|%v", strings.TrimSpace(readFile(t, "a.txt")), exists("b.txt"), exists("c.txt"), exists("d.txt"))
+	}
+	for _, tc := range []struct {
+		only string
+		want string
+	}{
+		{only: "write", want: "new a|true|false|true"},
+		{only: "rename", want: "old a|false|true|true"},
+		{only: "delete", want: "old a|true|false|false"},
+		{only: "", want: "new a|false|true|false"},
+	} {
+		t.Run("only "+tc.only, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "old a\n")
+			writeFile(t, "b.txt", "b\n")
+			writeFile(t, "d.txt", "d\n")
+			mustRun(t, Config{Only: tc.only}, input)
+			if got := state(); got != tc.want {
+				t.Errorf("state %s, want %s", got, tc.want)
+			}
+			mustRun(t, Config{Undo: true}, "")
+			if got, want := state(), "old a|true|false|true"; got != want {
+				t.Errorf("after undo %s, want %s", got, want)
+			}
+		})
+	}
+
+	t.Run("staged runs record one entry each", func(t *testing.T) {
+		inProject(t)
+		writeFile(t, "a.txt", "old a\n")
+		writeFile(t, "b.txt", "b\n")
+		writeFile(t, "d.txt", "d\n")
+		for _, only := range []string{"rename", "write", "delete"} {
+			mustRun(t, Config{Only: only}, input)
+		}
+		m, err := NewStateManager()
+		if err != nil {
+			t.Fatal(err)
+		}
+		history, _ := m.History()
+		var actions []string
+		for _, e := range history {
+			var ops []string
+			for _, op := range e.Operations {
+				ops = append(ops, op.Action)
+			}
+			actions = append(actions, strings.Join(ops, ","))
+		}
+		if want := []string{"rename", "modify", "delete"}; !slices.Equal(actions, want) {
+			t.Errorf("history %q, want %q", actions, want)
+		}
+	})
+
+	inProject(t)
+	if _, err := runItf(t, Config{Only: "create"}, input); err == nil || !strings.Contains(err.Error(), "invalid --only") {
+		t.Errorf("error %v, want an invalid --only error", err)
+	}
+}
+
+func TestRenameValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		line    string
+		force   bool
+		failed  []string
+		warning string
+		want    string // content of a.txt and b.txt, "-" for a missing file
+		undone  string // their content after an undo, when one is run
+	}{
+		{name: "missing source", line: "missing.txt c.txt", failed: []string{"missing.txt"},
+			warning: "missing.txt: cannot rename, the file does not exist", want: "A|B"},
+		{name: "existing destination is refused", line: "a.txt b.txt", failed: []string{"a.txt"},
+			warning: "a.txt: cannot rename, b.txt already exists (use --force to replace it)", want: "A|B"},
+		{name: "existing destination with --force", line: "a.txt b.txt", force: true, want: "-|A", undone: "A|B"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "A\n")
+			writeFile(t, "b.txt", "B\n")
+			files := func() string {
+				var got []string
+				for _, p := range []string{"a.txt", "b.txt"} {
+					data, err := os.ReadFile(p)
+					if err != nil {
+						got = append(got, "-")
+						continue
+					}
+					got = append(got, strings.TrimSpace(string(data)))
+				}
+				return strings.Join(got, "|")
+			}
+
+			s, err := runItf(t, Config{Force: tc.force}, "```rename\n"+tc.line+"\n```\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(s.Failed, tc.failed) {
+				t.Errorf("failed %q, want %q", s.Failed, tc.failed)
+			}
+			if tc.warning != "" && !slices.Contains(s.Warnings, tc.warning) {
+				t.Errorf("warnings %q, want %q", s.Warnings, tc.warning)
+			}
+			if got := files(); got != tc.want {
+				t.Errorf("files %s, want %s", got, tc.want)
+			}
+			if tc.undone == "" {
+				return
+			}
+			mustRun(t, Config{Undo: true}, "")
+			if got := files(); got != tc.undone {
+				t.Errorf("after undo %s, want %s", got, tc.undone)
+			}
+		})
+	}
+}
+
+func TestGrep(t *testing.T) {
+	const input = "`a.txt`\n```\n// TODO: finish\n```\n" +
+		"`b.txt`\n```\ndone\n```\n" +
+		"```diff\n--- a/c.txt\n+++ b/c.txt\n@@ -1 +1 @@\n-c\n+c // TODO\n```\n" +
+		"```diff\n--- a/d.txt\n+++ b/d.txt\n@@ -1 +1 @@\n-d\n+D\n```\n" +
+		"```rename\ne.txt f.txt\n```\n"
+	for _, tc := range []struct {
+		grep string
+		want []string
+	}{
+		{grep: "TODO", want: []string{"a.txt", "c.txt"}},
+		{grep: `(?m)^done$`, want: []string{"b.txt"}},
+		{grep: "nothing matches this", want: nil},
+		{grep: "", want: []string{"a.txt", "b.txt", "c.txt", "d.txt"}},
+	} {
+		t.Run(tc.grep, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "c.txt", "c\n")
+			writeFile(t, "d.txt", "d\n")
+			writeFile(t, "e.txt", "e\n")
+			resolver := newTestResolver(t)
+			plan, err := CreatePlanWithConfig(input, resolver, &Config{Grep: tc.grep})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := plannedWrites(t, plan, resolver)
+			slices.Sort(got)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("writes %q, want %q", got, tc.want)
+			}
+			// Renames are planned whatever the pattern
+			if !slices.ContainsFunc(plan.Actions, func(a PlannedAction) bool { return a.Type == "rename" }) {
+				t.Error("the rename was filtered out")
+			}
+		})
+	}
+
+	inProject(t)
+	if _, err := CreatePlanWithConfig(input, newTestResolver(t), &Config{Grep: "("}); err == nil || !strings.Contains(err.Error(), "invalid --grep") {
+		t.Errorf("error %v, want an invalid --grep error", err)
+	}
+}
+
+func TestEmptyDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+	}{
+		{name: "headers only", input: "```diff\n--- a/a.txt\n+++ b/a.txt\n```\n"},
+		{name: "hunks that cancel out", input: "```diff\n--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-a\n+a\n```\n"},
+		{name: "after a write of the same file", input: "`a.txt`\n```\nA\n```\n```diff\n--- a/a.txt\n+++ b/a.txt\n```\n"},
+		{name: "for a missing file", input: "```diff\n--- a/missing.txt\n+++ b/missing.txt\n```\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "a\n")
+			resolver := newTestResolver(t)
+			plan, err := CreatePlanWithConfig(tc.input, resolver, &Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var diffWrites int
+			for _, a := range plan.Actions {
+				if a.Type == "write" && a.Change.Source == "diff" {
+					diffWrites++
+				}
+			}
+			if diffWrites != 0 {
+				t.Errorf("%d writes planned for the diff, want none: %+v", diffWrites, plan.Actions)
+			}
+			if !slices.ContainsFunc(plan.Warnings, func(w string) bool { return strings.Contains(w, "the diff changes nothing") }) {
+				t.Errorf("warnings %q do not mention the skipped diff", plan.Warnings)
+			}
+		})
+	}
+
+	inProject(t)
+	writeFile(t, "a.txt", "a\n")
+	s := mustRun(t, Config{}, "```diff\n--- a/a.txt\n+++ b/a.txt\n```\n")
+	if len(s.Modified) != 0 || s.Message != "Nothing to do" {
+		t.Errorf("summary %+v, want nothing done", s)
+	}
+	if _, err := os.Stat(stateDirName + "/" + stateFileName); !os.IsNotExist(err) {
+		t.Errorf("history recorded for an empty diff: %v", err)
+	}
+}
+
+func TestFencePath(t *testing.T) {
+	for _, tc := range []struct {
+		info string
+		want string
+	}{
+		{info: "go path/to/file.go", want: "path/to/file.go"},
+		{info: "python app.py", want: "app.py"},
+		{info: "main.go", want: "main.go"},
+		{info: "src/Makefile", want: "src/Makefile"},
+		{info: `go src\win.go`, want: `src\win.go`},
+		{info: "go"},
+		{info: "go Makefile"},
+		{info: "go {.numberLines}"},
+		{info: `python title="a.py"`},
+		{info: "c++"},
+		{info: ""},
+	} {
+		blocks, err := ExtractCodeBlocks([]byte("```" + tc.info + "\nx\n```\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fencePath(blocks[0]); got != tc.want {
+			t.Errorf("fencePath(%q) = %q, want %q", tc.info, got, tc.want)
+		}
+	}
+
+	t.Run("a hint wins over the info string", func(t *testing.T) {
+		blocks, err := ExtractCodeBlocks([]byte("`hinted.go`\n```go other.go\nx\n```\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := blockPath(blocks[0]); got != "hinted.go" {
+			t.Errorf("blockPath = %q, want hinted.go", got)
+		}
+	})
+
+	t.Run("in-fence paths are applied", func(t *testing.T) {
+		inProject(t)
+		mustRun(t, Config{}, "```go pkg/a.go\npackage pkg\n```\n```b.py\nprint(1)\n```\n")
+		if got := readFile(t, "pkg/a.go") + readFile(t, "b.py"); got != "package pkg\nprint(1)\n" {
+			t.Errorf("files %q", got)
+		}
+	})
+}
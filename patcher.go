@@ -6,10 +6,19 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 var filePathRegex = regexp.MustCompile(`(?m)^\+\+\+ b/(?P<path>.*?)(\s|$)`)
 
+// DiffPrefix holds the path prefixes of a diff's "---" and "+++" lines.
+type DiffPrefix struct {
+	Old string
+	New string
+}
+
+var DefaultDiffPrefix = DiffPrefix{Old: "a/", New: "b/"}
+
 func ExtractPathFromDiff(content string) string {
 	if match := filePathRegex.FindStringSubmatch(content); len(match) > 1 {
 		return strings.TrimSpace(match[1])
@@ -17,6 +26,36 @@ func ExtractPathFromDiff(content string) string {
 	return ""
 }
 
+// ExtractPathFromDiffWithPrefix is ExtractPathFromDiff for diffs whose "+++"
+// path carries prefix instead of "b/". An empty prefix means none.
+func ExtractPathFromDiffWithPrefix(content, prefix string) string {
+	if prefix == DefaultDiffPrefix.New {
+		return ExtractPathFromDiff(content)
+	}
+	if match := prefixPathRegex(prefix).FindStringSubmatch(content); len(match) > 1 {
+		return strings.TrimSpace(match[1])
+	}
+	return ""
+}
+
+// prefixPathRegexes holds the compiled filePathRegex of each custom prefix.
+var prefixPathRegexes sync.Map
+
+func prefixPathRegex(prefix string) *regexp.Regexp {
+	if re, ok := prefixPathRegexes.Load(prefix); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, _ := prefixPathRegexes.LoadOrStore(prefix, regexp.MustCompile(`(?m)^\+\+\+ `+regexp.QuoteMeta(prefix)+`(?P<path>.*?)(\s|$)`))
+	return re.(*regexp.Regexp)
+}
+
+func (c *Config) diffPrefix() DiffPrefix {
+	if c == nil || c.DiffPrefix == nil {
+		return DefaultDiffPrefix
+	}
+	return *c.DiffPrefix
+}
+
 func GeneratePatchedContents(diffs []DiffBlock, resolver *PathResolver, extensions []string, renameMap map[string]string) ([]FileChange, []string, error) {
 	var changes []FileChange
 	var failed []string
@@ -33,13 +72,14 @@ func GeneratePatchedContents(diffs []DiffBlock, resolver *PathResolver, extensio
 			continue
 		}
 
-		patched, err := CorrectDiff(d, resolver, extensions, sourcePath)
+		cfg := &Config{Extensions: extensions}
+		patched, err := CorrectDiff(d, sourcePath, cfg)
 		if err != nil {
 			failed = append(failed, abs)
 			continue
 		}
 
-		applied := applyPatch(sourcePath, patched)
+		applied := applyPatch(sourcePath, patched, cfg)
 
 		changes = append(changes, FileChange{
 			Path:     abs,
@@ -51,7 +91,7 @@ func GeneratePatchedContents(diffs []DiffBlock, resolver *PathResolver, extensio
 	return changes, failed, nil
 }
 
-func CorrectDiff(diff DiffBlock, resolver *PathResolver, extensions []string, sourcePath string) (string, error) {
+func CorrectDiff(diff DiffBlock, sourcePath string, cfg *Config) (string, error) {
 	src := ""
 	if sourcePath != "" {
 		if _, err := os.Stat(sourcePath); err == nil {
@@ -61,14 +101,12 @@ func CorrectDiff(diff DiffBlock, resolver *PathResolver, extensions []string, so
 
 	var lines []string
 	if src != "" {
-		if content, err := os.ReadFile(src); err == nil {
-			lines = strings.Split(string(content), "\n")
-		}
+		lines = readLines(src)
 	}
-	return correctDiffHunks(lines, diff.RawContent, diff.FilePath)
+	return correctDiffHunks(lines, diff.RawContent, diff.FilePath, cfg)
 }
 
-func applyPatch(sourcePath, patch string) []string {
+func applyPatch(sourcePath, patch string, cfg *Config) []string {
 	var sourceLines []string
 	if sourcePath != "" {
 		srcPath := sourcePath
@@ -78,14 +116,34 @@ func applyPatch(sourcePath, patch string) []string {
 			}
 		}
 	}
-	return applyUnifiedDiff(sourceLines, patch)
+	return applyUnifiedDiff(sourceLines, patch, cfg)
 }
 
-func applyUnifiedDiff(source []string, patch string) []string {
+// applyUnifiedDiff applies patch to source. With cfg.AdditionsOnly, removed
+// lines are kept as if they were context, so only insertions take effect.
+// With cfg.Reindent, added lines are re-indented from the diff's indentation
+// unit to the source's. Added lines end in \r when the source uses CRLF.
+func applyUnifiedDiff(source []string, patch string, cfg *Config) []string {
 	patchLines := strings.Split(patch, "\n")
 	var result []string
 	srcIdx := 0
 
+	var fromUnit, toUnit string
+	if cfg.Reindent {
+		var changed []string
+		for _, l := range patchLines {
+			if (strings.HasPrefix(l, "+") && !strings.HasPrefix(l, "+++")) || (strings.HasPrefix(l, "-") && !strings.HasPrefix(l, "---")) {
+				changed = append(changed, l[1:])
+			}
+		}
+		fromUnit, toUnit = indentUnit(changed), indentUnit(source)
+	}
+	// Added lines take the source's line ending, whatever the diff used
+	eol := ""
+	if len(source) > 0 && strings.HasSuffix(source[0], "\r") {
+		eol = "\r"
+	}
+
 	for i := 0; i < len(patchLines); i++ {
 		line := patchLines[i]
 		if !strings.HasPrefix(line, "@@ -") {
@@ -104,7 +162,12 @@ func applyUnifiedDiff(source []string, patch string) []string {
 		}
 		start, _ := strconv.Atoi(rangeSplit[0])
 
+		// A hunk removing nothing (-N,0) inserts after line N rather than at
+		// it; past the end of the source it appends.
 		startIdx := max(0, start-1)
+		if len(rangeSplit) > 1 && rangeSplit[1] == "0" {
+			startIdx = min(start, len(source))
+		}
 
 		for srcIdx < startIdx && srcIdx < len(source) {
 			result = append(result, source[srcIdx])
@@ -120,8 +183,11 @@ func applyUnifiedDiff(source []string, patch string) []string {
 			}
 
 			if strings.HasPrefix(hunkLine, "+") {
-				result = append(result, hunkLine[1:])
+				result = append(result, reindent(strings.TrimSuffix(hunkLine[1:], "\r"), fromUnit, toUnit)+eol)
 			} else if strings.HasPrefix(hunkLine, "-") {
+				if cfg.AdditionsOnly && srcIdx < len(source) {
+					result = append(result, source[srcIdx])
+				}
 				srcIdx++
 			} else if strings.HasPrefix(hunkLine, " ") {
 				if srcIdx < len(source) {
@@ -140,3 +206,49 @@ func applyUnifiedDiff(source []string, patch string) []string {
 
 	return result
 }
+
+// indentUnit guesses the indentation step used by lines: a tab when most
+// indented lines start with one, otherwise the largest common width of the
+// space indents. It returns "" when there is no usable signal, including a
+// one-space step, which is usually alignment rather than indentation.
+func indentUnit(lines []string) string {
+	tabs, spaces, width := 0, 0, 0
+	for _, l := range lines {
+		switch {
+		case strings.TrimSpace(l) == "":
+		case strings.HasPrefix(l, "\t"):
+			tabs++
+		case strings.HasPrefix(l, " "):
+			spaces++
+			width = gcd(width, len(l)-len(strings.TrimLeft(l, " ")))
+		}
+	}
+	if tabs > spaces {
+		return "\t"
+	}
+	if width < 2 {
+		return ""
+	}
+	return strings.Repeat(" ", width)
+}
+
+// reindent replaces each leading occurrence of from in line with to. Any
+// remaining partial indentation is kept as is.
+func reindent(line, from, to string) string {
+	if from == "" || to == "" || from == to {
+		return line
+	}
+	level := 0
+	for strings.HasPrefix(line, from) {
+		line = line[len(from):]
+		level++
+	}
+	return strings.Repeat(to, level) + line
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,173 @@
+package itf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAdditionsOnly(t *testing.T) {
+	source := []string{"a", "old", "c"}
+	for _, tc := range []struct {
+		name          string
+		diff          string
+		additionsOnly bool
+		want          []string // nil when the diff must not match
+	}{
+		{name: "replacement keeps the removed line", additionsOnly: true,
+			diff: "@@ -1,3 +1,3 @@\n a\n-old\n+new\n c\n", want: []string{"a", "old", "new", "c"}},
+		{name: "deletion leaves the file as it was", additionsOnly: true,
+			diff: "@@ -1,3 +1,2 @@\n a\n-old\n c\n", want: source},
+		{name: "insertion still applies", additionsOnly: true,
+			diff: "@@ -1,2 +1,3 @@\n a\n+b\n old\n", want: []string{"a", "b", "old", "c"}},
+		{name: "removed lines must still match", additionsOnly: true,
+			diff: "@@ -1,3 +1,3 @@\n a\n-missing\n+new\n c\n"},
+		{name: "without the flag the line is replaced",
+			diff: "@@ -1,3 +1,3 @@\n a\n-old\n+new\n c\n", want: []string{"a", "new", "c"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := patchLines(source, tc.diff, "m.txt", &Config{AdditionsOnly: tc.additionsOnly})
+			if tc.want == nil {
+				if err == nil {
+					t.Fatalf("diff matched, giving %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReindent(t *testing.T) {
+	// The diff is indented by unit; lines are at depth 0, 1 or 2
+	diff := func(unit string) string {
+		in := func(depth int, s string) string { return strings.Repeat(unit, depth) + s }
+		return "@@ -1,5 +1,6 @@\n" +
+			" " + in(0, "func f() {") + "\n" +
+			" " + in(1, "if x {") + "\n" +
+			"-" + in(2, "a()") + "\n" +
+			"+" + in(2, "a(1)") + "\n" +
+			"+" + in(2, "b()") + "\n" +
+			" " + in(1, "}") + "\n" +
+			"+" + in(1, "c()") + "\n" +
+			" " + in(0, "}") + "\n"
+	}
+	file := func(unit string, added bool) []string {
+		lines := []string{"func f() {", unit + "if x {", unit + unit + "a()", unit + "}", "}"}
+		if added {
+			lines = []string{"func f() {", unit + "if x {", unit + unit + "a(1)", unit + unit + "b()", unit + "}", unit + "c()", "}"}
+		}
+		return lines
+	}
+	for _, tc := range []struct {
+		name               string
+		fileUnit, diffUnit string
+		cfg                Config
+		want               []string
+	}{
+		{name: "2 spaces into 4", fileUnit: "    ", diffUnit: "  ", cfg: Config{Reindent: true}, want: file("    ", true)},
+		{name: "4 spaces into 2", fileUnit: "  ", diffUnit: "    ", cfg: Config{Reindent: true}, want: file("  ", true)},
+		{name: "4 spaces into tabs", fileUnit: "\t", diffUnit: "    ", cfg: Config{Reindent: true}, want: file("\t", true)},
+		{name: "tabs into 2 spaces", fileUnit: "  ", diffUnit: "\t", cfg: Config{Reindent: true}, want: file("  ", true)},
+		{name: "same width is left alone", fileUnit: "    ", diffUnit: "    ", cfg: Config{Reindent: true}, want: file("    ", true)},
+		{name: "without --reindent added lines keep the diff's indentation", fileUnit: "    ", diffUnit: "  ", cfg: Config{LooseMatch: true},
+			want: []string{"func f() {", "    if x {", "    a(1)", "    b()", "    }", "  c()", "}"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := patchLines(file(tc.fileUnit, false), diff(tc.diffUnit), "m.go", &tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiffPrefix(t *testing.T) {
+	const path, before, after = "dir/a.go", "package a\nvar x = 1\n", "package a\nvar x = 2\n"
+	for _, tc := range []struct {
+		name   string
+		prefix *DiffPrefix
+	}{
+		{name: "default"},
+		{name: "i/ and w/", prefix: &DiffPrefix{Old: "i/", New: "w/"}},
+		{name: "none", prefix: &DiffPrefix{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{DiffPrefix: tc.prefix}
+			p := cfg.diffPrefix()
+			header := "--- " + p.Old + path + "\n+++ " + p.New + path + "\n"
+			diff := header + "@@ -1,2 +1,2 @@\n package a\n-var x = 1\n+var x = 2\n"
+			if got := ExtractPathFromDiffWithPrefix(diff, p.New); got != path {
+				t.Errorf("extracted %q, want %q", got, path)
+			}
+
+			corrected, err := correctDiffHunks(strings.Split(strings.TrimSuffix(before, "\n"), "\n"), diff, path, &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(corrected, header) {
+				t.Errorf("corrected diff starts %q, want %q", corrected, header)
+			}
+			if got := ExtractPathFromDiffWithPrefix(corrected, p.New); got != path {
+				t.Errorf("extracted %q from the corrected diff, want %q", got, path)
+			}
+
+			// Applying the diff and then reverting it gives the file back
+			inProject(t)
+			writeFile(t, path, before)
+			block := "```diff\n" + diff + "```\n"
+			mustRun(t, cfg, block)
+			if got := readFile(t, path); got != after {
+				t.Errorf("applied %q, want %q", got, after)
+			}
+			revert := cfg
+			revert.RevertDiff = true
+			mustRun(t, revert, block)
+			if got := readFile(t, path); got != before {
+				t.Errorf("reverted %q, want %q", got, before)
+			}
+		})
+	}
+}
+
+func TestAppendAtEOF(t *testing.T) {
+	source := []string{"a", "b", "c"}
+	for _, tc := range []struct {
+		name   string
+		source []string
+		diff   string
+		want   []string
+	}{
+		{name: "after the last line", source: source,
+			diff: "@@ -3,0 +4,2 @@\n+d\n+e\n", want: []string{"a", "b", "c", "d", "e"}},
+		{name: "a start past the end is clamped", source: source,
+			diff: "@@ -10,0 +11 @@\n+d\n", want: []string{"a", "b", "c", "d"}},
+		{name: "into an empty file", source: nil,
+			diff: "@@ -0,0 +1,2 @@\n+a\n+b\n", want: []string{"a", "b"}},
+		{name: "after an earlier hunk", source: source,
+			diff: "@@ -1 +1 @@\n-a\n+A\n@@ -3,0 +4 @@\n+d\n", want: []string{"A", "b", "c", "d"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := applyUnifiedDiff(tc.source, tc.diff, &Config{}); !slices.Equal(got, tc.want) {
+				t.Errorf("applyUnifiedDiff = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	// The same hunk, through the checks and fixes a diff block goes through
+	got, err := patchLines(source, "--- a/m.txt\n+++ b/m.txt\n@@ -3,0 +4,2 @@\n+d\n+e\n", "m.txt", &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c", "d", "e"}; !slices.Equal(got, want) {
+		t.Errorf("patched %q, want %q", got, want)
+	}
+}
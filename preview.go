@@ -0,0 +1,50 @@
+package itf
+
+// PreviewContent plans the current source and returns the lines path would
+// hold after applying it, with diffs and search/replace blocks already
+// applied. ok reports whether the plan touches path at all; a path the plan
+// deletes or renames away is touched but has no content. Nothing is written.
+func (a *App) PreviewContent(path string) (content []string, ok bool, err error) {
+	c, err := a.readSource()
+	if err != nil {
+		return nil, false, err
+	}
+	if a.cfg.FromGitDiff {
+		c, _ = GitDiffToMarkdown(c, a.cfg.diffPrefix())
+	}
+	plan, err := CreatePlanWithConfig(c, a.pathResolver, a.cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	content, ok = previewPath(plan, a.pathResolver.Resolve(path))
+	return content, ok, nil
+}
+
+// previewPath follows target through the actions of plan.
+func previewPath(plan *ExecutionPlan, target string) ([]string, bool) {
+	// Content of the paths written or moved so far; nil means it is gone
+	files := make(map[string][]string)
+	current := func(p string) []string {
+		if lines, ok := files[p]; ok {
+			return lines
+		}
+		return readLines(p)
+	}
+
+	ok := false
+	for _, a := range plan.Actions {
+		switch a.Type {
+		case "write":
+			files[a.Change.Path] = a.Change.Content
+			ok = ok || a.Change.Path == target
+		case "rename":
+			files[a.Rename.NewPath] = current(a.Rename.OldPath)
+			files[a.Rename.OldPath] = nil
+			ok = ok || a.Rename.OldPath == target || a.Rename.NewPath == target
+		case "delete":
+			files[a.Path] = nil
+			ok = ok || a.Path == target
+		}
+	}
+	return files[target], ok
+}
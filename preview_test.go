@@ -0,0 +1,48 @@
+package itf
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPreviewContent(t *testing.T) {
+	const input = "```diff\n--- a/a.txt\n+++ b/a.txt\n@@ -1,2 +1,2 @@\n one\n-two\n+2\n```\n" +
+		"`b.txt`\n```\nnew b\n```\n" +
+		"```rename\nc.txt d.txt\n```\n" +
+		"```delete\ne.txt\n```\n"
+	for _, tc := range []struct {
+		path string
+		want []string
+		ok   bool
+	}{
+		{path: "a.txt", want: []string{"one", "2"}, ok: true},
+		{path: "b.txt", want: []string{"new b"}, ok: true},
+		{path: "d.txt", want: []string{"c"}, ok: true},
+		{path: "c.txt", ok: true},
+		{path: "e.txt", ok: true},
+		{path: "untouched.txt"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			inProject(t)
+			for p, content := range map[string]string{"a.txt": "one\ntwo\n", "b.txt": "old b\n", "c.txt": "c\n", "e.txt": "e\n"} {
+				writeFile(t, p, content)
+			}
+			app, err := NewApp(&Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.sourceProvider = inputSource(t, input)
+			got, ok, err := app.PreviewContent(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.ok || !slices.Equal(got, tc.want) {
+				t.Errorf("PreviewContent(%q) = %q, %v; want %q, %v", tc.path, got, ok, tc.want, tc.ok)
+			}
+			// Nothing is written
+			if got := readFile(t, "a.txt") + readFile(t, "b.txt"); got != "one\ntwo\nold b\n" {
+				t.Errorf("files changed by the preview: %q", got)
+			}
+		})
+	}
+}
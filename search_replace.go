@@ -0,0 +1,101 @@
+package itf
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	searchMarker  = "<<<<<<< SEARCH"
+	dividerMarker = "======="
+	replaceMarker = ">>>>>>> REPLACE"
+)
+
+type searchReplace struct {
+	search  []string
+	replace []string
+}
+
+// isSearchReplace reports whether a block body is in the
+// SEARCH/=======/REPLACE edit format rather than a whole file.
+func isSearchReplace(content string) bool {
+	for line := range strings.SplitSeq(content, "\n") {
+		if strings.TrimSpace(line) != "" {
+			return strings.TrimSpace(line) == searchMarker
+		}
+	}
+	return false
+}
+
+func parseSearchReplace(content string) ([]searchReplace, error) {
+	var edits []searchReplace
+	var cur *searchReplace
+	inReplace := false
+	for line := range strings.SplitSeq(strings.TrimRight(content, "\n"), "\n") {
+		switch strings.TrimSpace(line) {
+		case searchMarker:
+			if cur != nil {
+				return nil, fmt.Errorf("SEARCH section not closed by %s", replaceMarker)
+			}
+			cur, inReplace = &searchReplace{}, false
+			continue
+		case dividerMarker:
+			if cur != nil && !inReplace {
+				inReplace = true
+				continue
+			}
+		case replaceMarker:
+			if cur != nil && inReplace {
+				edits = append(edits, *cur)
+				cur = nil
+				continue
+			}
+		}
+
+		switch {
+		case cur == nil:
+			if strings.TrimSpace(line) != "" {
+				return nil, fmt.Errorf("text outside a SEARCH/REPLACE section: %q", line)
+			}
+		case inReplace:
+			cur.replace = append(cur.replace, line)
+		default:
+			cur.search = append(cur.search, line)
+		}
+	}
+	if cur != nil {
+		return nil, fmt.Errorf("SEARCH section not closed by %s", replaceMarker)
+	}
+	return edits, nil
+}
+
+// applySearchReplace substitutes each edit in turn, locating its SEARCH lines
+// with the same matcher used for diff context. An empty SEARCH supplies the
+// content of a new or empty file.
+func applySearchReplace(source []string, edits []searchReplace, mode matchMode) ([]string, error) {
+	result := slices.Clone(source)
+	for _, e := range edits {
+		if len(e.search) == 0 {
+			if len(result) > 0 {
+				return nil, fmt.Errorf("empty SEARCH section for a file that is not empty")
+			}
+			result = slices.Clone(e.replace)
+			continue
+		}
+		start, end := matchBlock(result, e.search, 1, mode)
+		if start == -1 {
+			return nil, fmt.Errorf("SEARCH text not found: %q", e.search[0])
+		}
+		result = slices.Concat(result[:start-1], e.replace, result[end:])
+	}
+	return result, nil
+}
+
+func editWithSearchReplace(source []string, content, path string, cfg *Config) ([]string, error) {
+	edits, err := parseSearchReplace(content)
+	if err != nil {
+		return nil, err
+	}
+	return applySearchReplace(source, edits, newMatchMode(path, cfg))
+}
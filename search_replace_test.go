@@ -0,0 +1,67 @@
+package itf
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSearchReplace(t *testing.T) {
+	const original = "package a\n\nfunc one() int { return 1 }\n\nfunc two() int { return 2 }\n"
+	block := func(path string, sections ...string) string {
+		return "`" + path + "`\n```go\n" + strings.Join(sections, "") + "```\n"
+	}
+	edit := func(search, replace string) string {
+		return "<<<<<<< SEARCH\n" + search + "=======\n" + replace + ">>>>>>> REPLACE\n"
+	}
+	for _, tc := range []struct {
+		name    string
+		input   string
+		path    string
+		want    string // "" when the file must not exist
+		warning string // part of the warning for a failed block
+	}{
+		{name: "several pairs apply in order", path: "a.go",
+			input: block("a.go",
+				edit("func one() int { return 1 }\n", "func one() int { return 10 }\n"),
+				edit("func two() int { return 2 }\n", "func two() int { return 20 }\n")),
+			want: "package a\n\nfunc one() int { return 10 }\n\nfunc two() int { return 20 }\n"},
+		{name: "a later pair sees the earlier replacement", path: "a.go",
+			input: block("a.go",
+				edit("func one() int { return 1 }\n", "func uno() int { return 1 }\n"),
+				edit("func uno() int { return 1 }\n", "func uno() int { return 11 }\n")),
+			want: "package a\n\nfunc uno() int { return 11 }\n\nfunc two() int { return 2 }\n"},
+		{name: "an unmatched search fails the whole block", path: "a.go",
+			input: block("a.go",
+				edit("func one() int { return 1 }\n", "func one() int { return 10 }\n"),
+				edit("func three() int { return 3 }\n", "\n")),
+			want: original, warning: `SEARCH text not found: "func three() int { return 3 }"`},
+		{name: "an empty search creates a new file", path: "b.go",
+			input: block("b.go", edit("", "package b\n")), want: "package b\n"},
+		{name: "an empty search on a file with content fails", path: "a.go",
+			input: block("a.go", edit("", "package b\n")), want: original, warning: "empty SEARCH section"},
+		{name: "an unclosed section fails", path: "a.go",
+			input: block("a.go", "<<<<<<< SEARCH\npackage a\n=======\npackage b\n"), want: original, warning: "not closed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.go", original)
+			s, err := runItf(t, Config{}, tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(tc.path)
+			if tc.want == "" && !os.IsNotExist(err) || tc.want != "" && string(got) != tc.want {
+				t.Errorf("%s = %q, want %q", tc.path, got, tc.want)
+			}
+			failed := slices.Contains(s.Failed, tc.path)
+			if failed != (tc.warning != "") {
+				t.Errorf("failed %q, warnings %q", s.Failed, s.Warnings)
+			}
+			if tc.warning != "" && !slices.ContainsFunc(s.Warnings, func(w string) bool { return strings.Contains(w, tc.warning) }) {
+				t.Errorf("warnings %q, want one containing %q", s.Warnings, tc.warning)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package itf
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// pasteCommand picks the command that prints the clipboard on this system.
+func pasteCommand() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "pbpaste"
+	case "windows":
+		return "powershell.exe -NoProfile -Command Get-Clipboard"
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		if _, err := exec.LookPath("wl-paste"); err == nil {
+			return "wl-paste --no-newline"
+		}
+	}
+	if _, err := exec.LookPath("xclip"); err == nil {
+		return "xclip -selection clipboard -o"
+	}
+	if _, err := exec.LookPath("xsel"); err == nil {
+		return "xsel --clipboard --output"
+	}
+	return "wl-paste --no-newline"
+}
+
+// ShellFunction returns an "itfp" helper for shell that pipes the clipboard,
+// read with paste, into itf and passes its arguments through.
+func ShellFunction(shell, paste string) (string, error) {
+	switch shell {
+	case "bash", "zsh":
+		return fmt.Sprintf("itfp() {\n    %s | itf \"$@\"\n}\n", paste), nil
+	case "fish":
+		return fmt.Sprintf("function itfp\n    %s | itf $argv\nend\n", paste), nil
+	case "powershell":
+		return fmt.Sprintf("function itfp {\n    %s | itf @args\n}\n", paste), nil
+	}
+	return "", fmt.Errorf("unsupported shell for shell function: %s", shell)
+}
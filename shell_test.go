@@ -0,0 +1,67 @@
+package itf
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestShellFunction(t *testing.T) {
+	for _, tc := range []struct {
+		shell, paste, want string
+	}{
+		{"bash", "pbpaste", "itfp() {\n    pbpaste | itf \"$@\"\n}\n"},
+		{"zsh", "xclip -selection clipboard -o", "itfp() {\n    xclip -selection clipboard -o | itf \"$@\"\n}\n"},
+		{"bash", "wl-paste --no-newline", "itfp() {\n    wl-paste --no-newline | itf \"$@\"\n}\n"},
+		{"fish", "xsel --clipboard --output", "function itfp\n    xsel --clipboard --output | itf $argv\nend\n"},
+		{"powershell", "powershell.exe -NoProfile -Command Get-Clipboard",
+			"function itfp {\n    powershell.exe -NoProfile -Command Get-Clipboard | itf @args\n}\n"},
+	} {
+		got, err := ShellFunction(tc.shell, tc.paste)
+		if err != nil {
+			t.Fatalf("%s with %s: %v", tc.shell, tc.paste, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s with %s:\n%s\nwant:\n%s", tc.shell, tc.paste, got, tc.want)
+		}
+	}
+	if _, err := ShellFunction("tcsh", "pbpaste"); err == nil {
+		t.Error("tcsh: no error for an unsupported shell")
+	}
+}
+
+func TestPasteCommand(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("clipboard tools are only looked up on Linux")
+	}
+	for _, tc := range []struct {
+		name    string
+		tools   []string // executables on PATH
+		wayland bool
+		want    string
+	}{
+		{name: "wl-paste under Wayland", tools: []string{"wl-paste", "xclip"}, wayland: true, want: "wl-paste --no-newline"},
+		{name: "xclip without Wayland", tools: []string{"wl-paste", "xclip"}, want: "xclip -selection clipboard -o"},
+		{name: "xclip when wl-paste is missing", tools: []string{"xclip"}, wayland: true, want: "xclip -selection clipboard -o"},
+		{name: "xsel", tools: []string{"xsel"}, want: "xsel --clipboard --output"},
+		{name: "nothing installed", want: "wl-paste --no-newline"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bin := t.TempDir()
+			for _, tool := range tc.tools {
+				if err := os.WriteFile(filepath.Join(bin, tool), []byte("#!/bin/sh\n"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", bin)
+			t.Setenv("WAYLAND_DISPLAY", "")
+			if tc.wayland {
+				t.Setenv("WAYLAND_DISPLAY", "wayland-0")
+			}
+			if got := pasteCommand(); got != tc.want {
+				t.Errorf("pasteCommand() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
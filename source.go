@@ -1,32 +1,121 @@
 package itf
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/atotto/clipboard"
 )
 
-type SourceProvider struct{}
+var (
+	ErrEmptyClipboard   = errors.New("clipboard is empty")
+	ErrEmptyStdin       = errors.New("stdin is empty")
+	ErrClipboardNotText = errors.New("clipboard does not contain text")
+)
+
+type SourceProvider struct {
+	stdin         *os.File
+	readClipboard func() (string, error)
+}
 
 func NewSourceProvider() *SourceProvider {
-	return &SourceProvider{}
+	return &SourceProvider{stdin: os.Stdin, readClipboard: clipboard.ReadAll}
 }
 
 func (sp *SourceProvider) GetContent() (string, error) {
-	stat, _ := os.Stdin.Stat()
-	if (stat.Mode() & os.ModeCharDevice) == 0 {
-		c, err := io.ReadAll(os.Stdin)
+	if !sp.stdinIsTerminal() {
+		c, err := io.ReadAll(sp.stdin)
 		if err != nil {
 			return "", err
 		}
+		if strings.TrimSpace(string(c)) == "" {
+			return "", ErrEmptyStdin
+		}
 		return string(c), nil
 	}
 
-	c, err := clipboard.ReadAll()
+	c, err := sp.readClipboard()
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(c), nil
+	if !isText(c) {
+		return "", ErrClipboardNotText
+	}
+	c = strings.TrimSpace(c)
+	if c == "" {
+		return "", ErrEmptyClipboard
+	}
+	return c, nil
+}
+
+// Stream returns stdin when it is piped, for reading as it arrives.
+func (sp *SourceProvider) Stream() (io.Reader, bool) {
+	if sp.stdinIsTerminal() {
+		return nil, false
+	}
+	return sp.stdin, true
+}
+
+// inputReader notes whether anything but whitespace was read through it.
+type inputReader struct {
+	r    io.Reader
+	seen bool
+}
+
+func (r *inputReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if !r.seen && len(bytes.TrimSpace(p[:n])) > 0 {
+		r.seen = true
+	}
+	return n, err
+}
+
+// isText reports whether clipboard content is text rather than image or
+// other binary data, which some platforms hand back as raw bytes.
+func isText(c string) bool {
+	return utf8.ValidString(c) && !strings.ContainsRune(c, 0)
+}
+
+// DecodeBase64Content decodes content that was base64-encoded to survive
+// shell escaping. Surrounding whitespace and line wrapping are ignored.
+func DecodeBase64Content(content string) (string, error) {
+	compact := strings.Join(strings.Fields(content), "")
+	decoded, err := base64.StdEncoding.DecodeString(compact)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 input: %w", err)
+	}
+	return string(decoded), nil
+}
+
+// filesHeader starts an optional first line of the input that lists the
+// files it may change, as in "# itf-files: main.go, util.go".
+const filesHeader = "# itf-files:"
+
+// SplitFilesHeader removes a leading "# itf-files:" line from content and
+// returns the paths it lists, separated by commas or spaces. ok is false,
+// and content is returned unchanged, when the first line is not such a
+// header.
+func SplitFilesHeader(content string) (files []string, rest string, ok bool) {
+	first, rest, _ := strings.Cut(content, "\n")
+	list, ok := strings.CutPrefix(strings.TrimRight(first, "\r"), filesHeader)
+	if !ok {
+		return nil, content, false
+	}
+	files = strings.FieldsFunc(list, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	return files, rest, true
+}
+
+func (sp *SourceProvider) stdinIsTerminal() bool {
+	stat, err := sp.stdin.Stat()
+	if err != nil {
+		return true
+	}
+	return (stat.Mode() & os.ModeCharDevice) != 0
 }
@@ -0,0 +1,126 @@
+package itf
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// terminal returns a character device standing in for a TTY on stdin.
+func terminal(t *testing.T) *os.File {
+	t.Helper()
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestGetContent(t *testing.T) {
+	clipboardErr := errors.New("no clipboard utility")
+	for _, tc := range []struct {
+		name      string
+		piped     string // stdin content, unless tty makes stdin a terminal
+		tty       bool
+		clipboard string
+		clipErr   error
+		want      string
+		wantErr   error
+	}{
+		{name: "piped input", piped: "`a.go`\n", want: "`a.go`\n"},
+		{name: "empty pipe", wantErr: ErrEmptyStdin},
+		{name: "whitespace-only pipe", piped: " \n\t\n", wantErr: ErrEmptyStdin},
+		{name: "pipe wins over the clipboard", piped: "piped", clipboard: "copied", want: "piped"},
+		{name: "TTY reads the clipboard", tty: true, clipboard: "  copied\n", want: "copied"},
+		{name: "TTY with an empty clipboard", tty: true, wantErr: ErrEmptyClipboard},
+		{name: "TTY with a whitespace clipboard", tty: true, clipboard: "\n \n", wantErr: ErrEmptyClipboard},
+		{name: "TTY with an image on the clipboard", tty: true, clipboard: "\x89PNG\x00\x01", wantErr: ErrClipboardNotText},
+		{name: "TTY without a clipboard", tty: true, clipErr: clipboardErr, wantErr: clipboardErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sp := inputSource(t, tc.piped)
+			if tc.tty {
+				sp.stdin = terminal(t)
+			}
+			sp.readClipboard = func() (string, error) { return tc.clipboard, tc.clipErr }
+			got, err := sp.GetContent()
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("error %v, want %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("content %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEmptySourceMessages(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tty  bool
+		want string
+	}{
+		{name: "empty clipboard", tty: true, want: "Clipboard is empty; pipe content to itf or copy a response first"},
+		{name: "empty pipe", want: "Nothing was piped on stdin"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			app, err := NewApp(&Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.sourceProvider = inputSource(t, "")
+			if tc.tty {
+				app.sourceProvider.stdin = terminal(t)
+			}
+			s, err := app.Execute()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Message != tc.want {
+				t.Errorf("message %q, want %q", s.Message, tc.want)
+			}
+		})
+	}
+}
+
+func TestBase64Input(t *testing.T) {
+	const response = "Here is the file:\n\n`a.go`\n```go\npackage a\n\nvar s = \"it's $HOME `quoted`\"\n```\n"
+	encoded := base64.StdEncoding.EncodeToString([]byte(response))
+	var wrapped strings.Builder
+	for s := encoded; s != ""; {
+		n := min(len(s), 20)
+		wrapped.WriteString(s[:n] + "\n")
+		s = s[n:]
+	}
+	for _, tc := range []struct {
+		name  string
+		input string
+		err   string // part of the error, when decoding must fail
+	}{
+		{name: "one line", input: encoded},
+		{name: "wrapped lines", input: wrapped.String()},
+		{name: "surrounding whitespace", input: "\n  " + encoded + "  \n\n"},
+		{name: "not base64", input: response, err: "invalid base64 input"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			_, err := runItf(t, Config{Base64: true}, tc.input)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFile(t, "a.go"); got != "package a\n\nvar s = \"it's $HOME `quoted`\"\n" {
+				t.Errorf("a.go = %q", got)
+			}
+		})
+	}
+}
@@ -2,11 +2,18 @@ package itf
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -15,10 +22,14 @@ import (
 const (
 	stateDirName    = ".itf"
 	stateFileName   = "states.itf"
+	branchesDirName = "branches"
 	TrashDir        = "trash"
 	BlobsDir        = "blobs"
+	manifestName    = "last-manifest.json"
+	backupsDirName  = "backups"
 	entrySeparator  = "\n===\n"
 	opSeparator     = "\n---\n"
+	metaPrefix      = "@"
 	none            = "-"
 )
 
@@ -29,9 +40,26 @@ type Operation struct {
 	OldContentHash string
 	ContentHash    string
 	NewPath        string
+	OldOwner       string
+	Owner          string
+	// Source is the kind of block that wrote the file (codeblock, diff or
+	// search-replace); empty for renames, deletes and older history.
+	Source string
+	// Dirs lists directories created for the file, deepest first. Undo
+	// removes those left empty.
+	Dirs []string
+	// OldModTime and ModTime are the file's modification times, in Unix
+	// nanoseconds, before and after the operation; undo and redo put them
+	// back. Zero when unknown, as in older history.
+	OldModTime int64
+	ModTime    int64
 }
 
 type HistoryEntry struct {
+	Message string
+	// Input is the sha256 of the input the entry was applied from, so it can
+	// be traced back to the response; empty for restores and older history.
+	Input      string
 	Operations []Operation
 }
 
@@ -44,7 +72,29 @@ type StateManager struct {
 	statePath   string
 	state       *State
 	StateDir    string
+	TrashPath   string
 	ProjectRoot string
+	// NoBackupExtensions lists file name suffixes, such as ".min.js", whose
+	// content is not stored as blobs.
+	NoBackupExtensions []string
+	// ChunkedBlobs stores new blobs as shared chunks; see WriteChunkedBlob.
+	ChunkedBlobs bool
+	// BackupOnTruncate backs up the state file before entries are dropped
+	// from the history, as when an apply discards the redo entries.
+	BackupOnTruncate bool
+}
+
+func (m *StateManager) writeBlob(hash string, content []byte) error {
+	// Blobs are named by their content, so an intact one is already right;
+	// a truncated or corrupt one is replaced
+	if blobIntact(m.StateDir, hash) {
+		return nil
+	}
+	removeBlob(m.StateDir, hash)
+	if m.ChunkedBlobs {
+		return WriteChunkedBlob(m.StateDir, hash, content)
+	}
+	return WriteBlob(m.StateDir, hash, content)
 }
 
 func findGitRoot() (string, error) {
@@ -60,6 +110,40 @@ func findGitRoot() (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
+// currentBranch returns the checked-out git branch, or "" outside git, on a
+// detached HEAD or before the first commit.
+func currentBranch() string {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		return ""
+	}
+	out, err := exec.Command(gitPath, "rev-parse", "--abbrev-ref", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	if b := strings.TrimSpace(string(out)); b != "HEAD" {
+		return b
+	}
+	return ""
+}
+
+// statePathFor keeps one history per branch under branches/<branch>/, so
+// switching branches does not make Sync discard the other branch's history.
+// Without a branch the top-level state file is used; the first branch to
+// find no history of its own takes that file over.
+func statePathFor(dir, branch string) string {
+	shared := filepath.Join(dir, stateFileName)
+	if branch == "" {
+		return shared
+	}
+	p := filepath.Join(dir, branchesDirName, filepath.FromSlash(branch), stateFileName)
+	_ = os.MkdirAll(filepath.Dir(p), 0755)
+	if _, err := os.Stat(p); errors.Is(err, fs.ErrNotExist) {
+		_ = os.Rename(shared, p)
+	}
+	return p
+}
+
 func NewStateManager() (*StateManager, error) {
 	root, _ := findGitRoot()
 	dir := filepath.Join(root, stateDirName)
@@ -67,8 +151,9 @@ func NewStateManager() (*StateManager, error) {
 		return nil, err
 	}
 	m := &StateManager{
-		statePath:   filepath.Join(dir, stateFileName),
+		statePath:   statePathFor(dir, currentBranch()),
 		StateDir:    dir,
+		TrashPath:   filepath.Join(dir, TrashDir),
 		ProjectRoot: root,
 	}
 	m.state = &State{CurrentIndex: -1, History: []HistoryEntry{}}
@@ -103,6 +188,11 @@ func (m *StateManager) load() error {
 		}
 
 		entry := &m.state.History[len(m.state.History)-1]
+		if strings.HasPrefix(line, metaPrefix) {
+			m.parseMeta(entry, strings.TrimPrefix(line, metaPrefix))
+			continue
+		}
+
 		op := Operation{Timestamp: parseTimestamp(line)}
 
 		fields := []*string{&op.Action, &op.Path, &op.OldContentHash, &op.ContentHash, &op.NewPath}
@@ -124,11 +214,60 @@ func (m *StateManager) load() error {
 	return scanner.Err()
 }
 
+// parseMeta applies an "@key value" line. Entry keys precede the first
+// operation; operation keys follow the operation they describe.
+func (m *StateManager) parseMeta(entry *HistoryEntry, meta string) {
+	key, value, _ := strings.Cut(meta, " ")
+	switch key {
+	case "message":
+		entry.Message = value
+		return
+	case "input":
+		entry.Input = value
+		return
+	}
+
+	if len(entry.Operations) == 0 {
+		return
+	}
+	op := &entry.Operations[len(entry.Operations)-1]
+	switch key {
+	case "old-owner":
+		op.OldOwner = value
+	case "owner":
+		op.Owner = value
+	case "source":
+		op.Source = value
+	case "dir":
+		op.Dirs = append(op.Dirs, m.resolvePath(value))
+	case "old-mtime":
+		op.OldModTime, _ = strconv.ParseInt(value, 10, 64)
+	case "mtime":
+		op.ModTime, _ = strconv.ParseInt(value, 10, 64)
+	}
+}
+
+// parseTimestamp reads a nanosecond timestamp. History written before
+// nanoseconds were used holds seconds, which are converted.
 func parseTimestamp(s string) int64 {
 	ts, _ := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if ts > 0 && ts < 1e12 {
+		ts *= int64(time.Second)
+	}
 	return ts
 }
 
+// lastTimestamp returns the latest timestamp recorded in history.
+func (m *StateManager) lastTimestamp() int64 {
+	var last int64
+	for _, e := range m.state.History {
+		for _, op := range e.Operations {
+			last = max(last, op.Timestamp)
+		}
+	}
+	return last
+}
+
 func (m *StateManager) save() {
 	file, err := os.Create(m.statePath)
 	if err != nil {
@@ -143,6 +282,12 @@ func (m *StateManager) save() {
 
 	for _, e := range m.state.History {
 		fmt.Fprint(writer, entrySeparator)
+		if e.Message != "" {
+			fmt.Fprintf(writer, "%smessage %s\n", metaPrefix, singleLine(e.Message))
+		}
+		if e.Input != "" {
+			fmt.Fprintf(writer, "%sinput %s\n", metaPrefix, e.Input)
+		}
 		for i, op := range e.Operations {
 			fmt.Fprintf(writer, "%d\n%s\n%s\n%s\n%s\n%s",
 				op.Timestamp,
@@ -152,6 +297,24 @@ func (m *StateManager) save() {
 				m.toStoreValue(op.ContentHash),
 				m.relativePath(op.NewPath),
 			)
+			if op.OldOwner != "" {
+				fmt.Fprintf(writer, "\n%sold-owner %s", metaPrefix, op.OldOwner)
+			}
+			if op.Owner != "" {
+				fmt.Fprintf(writer, "\n%sowner %s", metaPrefix, op.Owner)
+			}
+			if op.Source != "" {
+				fmt.Fprintf(writer, "\n%ssource %s", metaPrefix, op.Source)
+			}
+			for _, d := range op.Dirs {
+				fmt.Fprintf(writer, "\n%sdir %s", metaPrefix, m.relativePath(d))
+			}
+			if op.OldModTime != 0 {
+				fmt.Fprintf(writer, "\n%sold-mtime %d", metaPrefix, op.OldModTime)
+			}
+			if op.ModTime != 0 {
+				fmt.Fprintf(writer, "\n%smtime %d", metaPrefix, op.ModTime)
+			}
 			if i < len(e.Operations)-1 {
 				fmt.Fprint(writer, opSeparator)
 			}
@@ -159,6 +322,18 @@ func (m *StateManager) save() {
 	}
 }
 
+// skipsBackup reports whether the name of path ends in one of exts.
+func skipsBackup(path string, exts []string) bool {
+	name := filepath.Base(path)
+	return slices.ContainsFunc(exts, func(ext string) bool {
+		return ext != "" && strings.HasSuffix(name, ext)
+	})
+}
+
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
 func (m *StateManager) fromStoreValue(s string) string {
 	if s == none {
 		return ""
@@ -201,7 +376,7 @@ func (m *StateManager) Sync() {
 	for i := m.state.CurrentIndex; i >= 0; i-- {
 		if m.matchState(i) {
 			if i < m.state.CurrentIndex {
-				m.state.History = m.state.History[:i+1]
+				m.truncate(i + 1)
 				m.state.CurrentIndex = i
 				m.save()
 			}
@@ -209,11 +384,19 @@ func (m *StateManager) Sync() {
 		}
 	}
 
-	m.state.History = []HistoryEntry{}
+	m.truncate(0)
 	m.state.CurrentIndex = -1
 	m.save()
 }
 
+// truncate keeps the first n history entries.
+func (m *StateManager) truncate(n int) {
+	if m.BackupOnTruncate {
+		_, _ = m.BackupState()
+	}
+	m.state.History = m.state.History[:n]
+}
+
 func (m *StateManager) matchState(idx int) bool {
 	if idx < 0 || idx >= len(m.state.History) {
 		return false
@@ -241,72 +424,612 @@ func (m *StateManager) matchState(idx int) bool {
 	return true
 }
 
-func (m *StateManager) Write(ops []Operation) {
-	m.Sync()
+// Write appends a new entry after the current position, dropping any redo
+// entries. Callers Sync before changing files, while the previous entry can
+// still be compared against disk.
+func (m *StateManager) Write(ops []Operation, message, input string) {
 	if m.state.CurrentIndex < len(m.state.History)-1 {
-		m.state.History = m.state.History[:m.state.CurrentIndex+1]
+		m.truncate(m.state.CurrentIndex + 1)
 	}
-	m.state.History = append(m.state.History, HistoryEntry{Operations: ops})
+	m.state.History = append(m.state.History, HistoryEntry{Message: message, Input: input, Operations: ops})
 	m.state.CurrentIndex++
 	m.save()
 }
 
-func (m *StateManager) GetOperationsToUndo() []Operation {
+func (m *StateManager) GetOperationsToUndo() ([]Operation, string) {
 	if m.state.CurrentIndex < 0 {
-		return nil
+		return nil, ""
 	}
-	ops := m.state.History[m.state.CurrentIndex].Operations
+	entry := m.state.History[m.state.CurrentIndex]
 	m.state.CurrentIndex--
 	m.save()
-	return ops
+	return entry.Operations, entry.Message
 }
 
-func (m *StateManager) GetOperationsToRedo() []Operation {
+func (m *StateManager) GetOperationsToRedo() ([]Operation, string) {
 	if m.state.CurrentIndex+1 >= len(m.state.History) {
-		return nil
+		return nil, ""
 	}
 	m.state.CurrentIndex++
-	ops := m.state.History[m.state.CurrentIndex].Operations
+	entry := m.state.History[m.state.CurrentIndex]
 	m.save()
-	return ops
+	return entry.Operations, entry.Message
 }
 
-func (m *StateManager) CreateOperations(updated []string, actions map[string]string, renames []FileRename, oldHashes map[string]string) []Operation {
-	var ops []Operation
-	rm := make(map[string]string)
-	for _, r := range renames {
-		rm[r.OldPath] = r.NewPath
+// FindLastDelete returns the most recent applied delete of path, searching
+// back from the current history position.
+func (m *StateManager) FindLastDelete(path string) (Operation, bool) {
+	for i := min(m.state.CurrentIndex, len(m.state.History)-1); i >= 0; i-- {
+		for _, op := range m.state.History[i].Operations {
+			if op.Action == "delete" && op.Path == path {
+				return op, true
+			}
+		}
 	}
+	return Operation{}, false
+}
 
-	now := time.Now().UTC().Unix()
-	for _, f := range updated {
-		action := actions[f]
-		checkPath, newPath := f, ""
-		
-		switch action {
+func (m *StateManager) History() ([]HistoryEntry, int) {
+	return m.state.History, m.state.CurrentIndex
+}
+
+type StateSnapshot struct {
+	CurrentIndex int
+	History      []HistoryEntry
+}
+
+func (m *StateManager) Snapshot() StateSnapshot {
+	return StateSnapshot{CurrentIndex: m.state.CurrentIndex, History: slices.Clone(m.state.History)}
+}
+
+// DescribeStateDelta reports how the history moved between two snapshots:
+// the current index and any entries dropped or appended after the shared prefix.
+func DescribeStateDelta(before, after StateSnapshot) string {
+	common := 0
+	for common < len(before.History) && common < len(after.History) &&
+		entriesEqual(before.History[common], after.History[common]) {
+		common++
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "State: index %d -> %d, entries %d -> %d\n",
+		before.CurrentIndex, after.CurrentIndex, len(before.History), len(after.History))
+	for i := common; i < len(before.History); i++ {
+		fmt.Fprintf(&b, "  - #%d %s (%d ops)\n", i, before.History[i].Message, len(before.History[i].Operations))
+	}
+	for i := common; i < len(after.History); i++ {
+		fmt.Fprintf(&b, "  + #%d %s (%d ops)\n", i, after.History[i].Message, len(after.History[i].Operations))
+	}
+	return b.String()
+}
+
+func entriesEqual(a, b HistoryEntry) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// CreateOperations completes targets (action, paths and old hash) with a
+// timestamp and the current content hash, storing new content as blobs.
+// Order is preserved: undo walks it backwards and redo forwards.
+func (m *StateManager) CreateOperations(targets []Operation) []Operation {
+	ops := make([]Operation, 0, len(targets))
+	// Timestamps are in nanoseconds and strictly increasing, even when the
+	// clock is coarse or steps back
+	next := max(time.Now().UTC().UnixNano(), m.lastTimestamp()+1)
+	for i, op := range targets {
+		checkPath := op.Path
+		switch op.Action {
 		case "rename":
-			newPath = rm[f]
-			checkPath = newPath
+			checkPath = op.NewPath
 		case "delete":
-			rel, _ := filepath.Rel(m.ProjectRoot, f)
-			checkPath = filepath.Join(m.StateDir, TrashDir, rel)
+			checkPath = m.trashPathFor(op.Path)
 		}
 
 		currentHash, _ := GetFileSHA256(checkPath)
-		if action != "delete" && currentHash != "" {
+		if op.Action != "delete" && currentHash != "" && !skipsBackup(checkPath, m.NoBackupExtensions) {
 			content, _ := os.ReadFile(checkPath)
-			_ = WriteBlob(m.StateDir, currentHash, content)
+			_ = m.writeBlob(currentHash, content)
+		}
+		if op.Action == "rename" {
+			// A later modify of the destination starts from the content the
+			// rename left behind, which undo must find before moving it back
+			for _, later := range targets[i+1:] {
+				if later.Action == "modify" && later.Path == op.NewPath {
+					currentHash = later.OldContentHash
+					break
+				}
+			}
+		}
+
+		if op.Action == "create" || op.Action == "modify" {
+			if info, err := os.Stat(checkPath); err == nil {
+				op.ModTime = info.ModTime().UnixNano()
+			}
 		}
 
-		ops = append(ops, Operation{
-			Timestamp:      now,
-			Path:           f,
-			Action:         action,
-			OldContentHash: oldHashes[f],
-			ContentHash:    currentHash,
-			NewPath:        newPath,
-		})
+		op.Timestamp = next
+		next++
+		op.ContentHash = currentHash
+		ops = append(ops, op)
 	}
-	sort.Slice(ops, func(i, j int) bool { return ops[i].Path < ops[j].Path })
 	return ops
 }
+
+// ManifestEntry describes one path changed by the last apply and where its new
+// content is stored. Deleted paths have no hash or blob.
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	Hash   string `json:"hash,omitempty"`
+	Blob   string `json:"blob,omitempty"`
+}
+
+// WriteManifest records ops in .itf/last-manifest.json, replacing the
+// manifest of any previous apply. Paths are relative to the project root.
+func (m *StateManager) WriteManifest(ops []Operation) error {
+	entries := make([]ManifestEntry, 0, len(ops))
+	for _, op := range ops {
+		path := op.Path
+		if op.Action == "rename" {
+			path = op.NewPath
+		}
+		e := ManifestEntry{Path: m.relativePath(path), Action: op.Action}
+		// The hash of a delete is that of its trashed copy, not content
+		if op.Action != "delete" {
+			e.Hash = op.ContentHash
+		}
+		// Chunked blobs have no single file to point to
+		if e.Hash != "" {
+			if _, err := os.Stat(BlobPath(m.StateDir, op.ContentHash)); err == nil {
+				e.Blob = BlobPath(m.StateDir, op.ContentHash)
+			}
+		}
+		entries = append(entries, e)
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(m.StateDir, manifestName), append(data, '\n'), 0644)
+}
+
+// BackupState copies the state file to a timestamped file under backups/
+// and returns its path. Blobs are not copied: they are never removed, so
+// every blob a backup refers to is still present when it is restored.
+func (m *StateManager) BackupState() (string, error) {
+	data, err := os.ReadFile(m.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = []byte("-1"), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(m.StateDir, backupsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("states-%s.itf", time.Now().Format("20060102-150405.000000"))
+	p := filepath.Join(dir, name)
+	return p, os.WriteFile(p, data, 0644)
+}
+
+// RestoreState replaces the state file with a backup made by BackupState.
+// The current state is backed up first, so a restore can itself be undone.
+// backup may be a path or a file name under backups/.
+func (m *StateManager) RestoreState(backup string) (string, error) {
+	if _, err := os.Stat(backup); errors.Is(err, fs.ErrNotExist) && !strings.ContainsRune(backup, filepath.Separator) {
+		backup = filepath.Join(m.StateDir, backupsDirName, backup)
+	}
+	data, err := os.ReadFile(backup)
+	if err != nil {
+		return "", err
+	}
+	if !isStateFile(data) {
+		return "", fmt.Errorf("%s is not an itf state file", backup)
+	}
+	return m.replaceState(data)
+}
+
+func isStateFile(data []byte) bool {
+	_, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0]))
+	return err == nil
+}
+
+// replaceState backs up the current state file, then loads data in its place.
+func (m *StateManager) replaceState(data []byte) (string, error) {
+	previous, err := m.BackupState()
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(m.statePath, data, 0644); err != nil {
+		return "", err
+	}
+	m.state = &State{CurrentIndex: -1, History: []HistoryEntry{}}
+	return previous, m.load()
+}
+
+// HistoryBundle is a self-contained copy of a branch's history: the state
+// file as stored on disk and the content of every blob it refers to, base64
+// encoded. Paths in the state are relative to the project root.
+type HistoryBundle struct {
+	State string            `json:"state"`
+	Blobs map[string]string `json:"blobs"`
+}
+
+// ExportHistory writes the history and its blobs to path as a HistoryBundle
+// and returns the number of blobs included. Blobs missing from the store are
+// left out.
+func (m *StateManager) ExportHistory(path string) (int, error) {
+	data, err := os.ReadFile(m.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		data, err = []byte("-1"), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	bundle := HistoryBundle{State: string(data), Blobs: make(map[string]string)}
+	for _, e := range m.state.History {
+		for _, op := range e.Operations {
+			for _, hash := range []string{op.OldContentHash, op.ContentHash} {
+				if _, ok := bundle.Blobs[hash]; ok || hash == "" {
+					continue
+				}
+				content, err := ReadBlob(m.StateDir, hash)
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				if err != nil {
+					return 0, fmt.Errorf("failed to read blob %s: %w", hash, err)
+				}
+				bundle.Blobs[hash] = base64.StdEncoding.EncodeToString(content)
+			}
+		}
+	}
+	out, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	return len(bundle.Blobs), os.WriteFile(path, append(out, '\n'), 0644)
+}
+
+// ImportHistory stores the blobs of a bundle written by ExportHistory and
+// replaces the history with its state. The current state is backed up first;
+// its path is returned. Blobs whose content does not match their hash are
+// rejected before anything is changed.
+func (m *StateManager) ImportHistory(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var bundle HistoryBundle
+	if err := json.Unmarshal(data, &bundle); err != nil || !isStateFile([]byte(bundle.State)) {
+		return "", fmt.Errorf("%s is not an itf history bundle", path)
+	}
+
+	blobs := make(map[string][]byte, len(bundle.Blobs))
+	for hash, enc := range bundle.Blobs {
+		content, err := base64.StdEncoding.DecodeString(enc)
+		sum := sha256.Sum256(content)
+		if err != nil || hex.EncodeToString(sum[:]) != hash {
+			return "", fmt.Errorf("%s: blob %s is corrupt", path, hash)
+		}
+		blobs[hash] = content
+	}
+	for hash, content := range blobs {
+		if err := m.writeBlob(hash, content); err != nil {
+			return "", err
+		}
+	}
+	return m.replaceState([]byte(bundle.State))
+}
+
+// Reset removes everything under the state directory: history for every
+// branch, blobs, trash and backups. A trash directory kept elsewhere loses
+// the files deletes in the history put there. It returns the number of
+// files removed and their total size.
+func (m *StateManager) Reset() (files int, size int64, err error) {
+	if !m.trashOwned() {
+		_, known, err := m.trashRefs()
+		if err != nil {
+			return 0, 0, err
+		}
+		if files, size, err = m.removeTrash(nil, known); err != nil {
+			return 0, 0, err
+		}
+	}
+	err = filepath.WalkDir(m.StateDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if info, err := d.Info(); err == nil {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	entries, err := os.ReadDir(m.StateDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(m.StateDir, e.Name())); err != nil {
+			return 0, 0, err
+		}
+	}
+	m.state = &State{CurrentIndex: -1, History: []HistoryEntry{}}
+	return files, size, nil
+}
+
+// Squash merges the last n applied entries into one. Operations on the same
+// file are folded into a single operation spanning from its earliest old
+// content to its latest content; a file created and then deleted within the
+// range drops out entirely. Entries available for redo are kept.
+func (m *StateManager) Squash(n int) error {
+	first := m.state.CurrentIndex - n + 1
+	if n < 2 || first < 0 {
+		return fmt.Errorf("cannot squash %d entries: %d applied", n, m.state.CurrentIndex+1)
+	}
+
+	var ops []Operation
+	var messages []string
+	var fixups []func() error
+	byPath := make(map[string]int)
+	dropped := make(map[int]bool)
+	for _, e := range m.state.History[first : m.state.CurrentIndex+1] {
+		if e.Message != "" {
+			messages = append(messages, e.Message)
+		}
+		for _, op := range e.Operations {
+			i, ok := byPath[op.Path]
+			if !ok {
+				byPath[resultPath(op)] = len(ops)
+				ops = append(ops, op)
+				continue
+			}
+			delete(byPath, op.Path)
+			merged, fix, err := m.foldOperations(ops[i], op)
+			if err != nil {
+				return err
+			}
+			if fix != nil {
+				fixups = append(fixups, fix)
+			}
+			if merged == nil {
+				dropped[i] = true
+				continue
+			}
+			ops[i] = *merged
+			byPath[resultPath(*merged)] = i
+		}
+	}
+
+	for _, fix := range fixups {
+		if err := fix(); err != nil {
+			return err
+		}
+	}
+
+	var kept []Operation
+	for i, op := range ops {
+		if !dropped[i] {
+			kept = append(kept, op)
+		}
+	}
+
+	squashed := HistoryEntry{Message: strings.Join(messages, "; "), Operations: kept}
+	// The inputs are kept only when all entries came from the same one
+	squashed.Input = m.state.History[first].Input
+	for _, e := range m.state.History[first : m.state.CurrentIndex+1] {
+		if e.Input != squashed.Input {
+			squashed.Input = ""
+		}
+	}
+	rest := slices.Clone(m.state.History[m.state.CurrentIndex+1:])
+	m.state.History = append(append(m.state.History[:first], squashed), rest...)
+	m.state.CurrentIndex = first
+	m.save()
+	return nil
+}
+
+func resultPath(op Operation) string {
+	if op.Action == "rename" {
+		return op.NewPath
+	}
+	return op.Path
+}
+
+// foldOperations combines a with b, a later operation on the file a left
+// behind. A nil result means the two cancel out. The returned fixup, if any,
+// updates the trash so that undoing the merged delete restores the file as it
+// was before a.
+func (m *StateManager) foldOperations(a, b Operation) (*Operation, func() error, error) {
+	switch a.Action + ">" + b.Action {
+	case "create>modify", "modify>modify":
+		a.ContentHash, a.Owner, a.Source, a.ModTime = b.ContentHash, b.Owner, b.Source, b.ModTime
+		return &a, nil, nil
+	case "create>delete":
+		return nil, nil, nil
+	case "create>rename":
+		a.Path, a.ContentHash, a.Dirs = b.NewPath, b.ContentHash, slices.Concat(b.Dirs, a.Dirs)
+		return &a, nil, nil
+	case "modify>rename":
+		b.OldContentHash, b.OldOwner, b.OldModTime = a.OldContentHash, a.OldOwner, a.OldModTime
+		return &b, nil, nil
+	case "rename>modify":
+		a.ContentHash, a.Owner, a.Source, a.ModTime = b.ContentHash, b.Owner, b.Source, b.ModTime
+		return &a, nil, nil
+	case "rename>rename":
+		a.NewPath, a.ContentHash, a.Dirs = b.NewPath, b.ContentHash, slices.Concat(b.Dirs, a.Dirs)
+		return &a, nil, nil
+	case "delete>create":
+		if _, err := ReadBlob(m.StateDir, a.OldContentHash); err != nil {
+			return nil, nil, fmt.Errorf("cannot squash %s: original content is missing", m.relativePath(a.Path))
+		}
+		b.Action, b.OldContentHash, b.OldOwner, b.OldModTime = "modify", a.OldContentHash, a.OldOwner, a.OldModTime
+		return &b, nil, nil
+	case "rename>delete":
+		from, to := m.trashPathFor(b.Path), m.trashPathFor(a.Path)
+		b.Path, b.OldContentHash, b.OldOwner = a.Path, a.OldContentHash, a.OldOwner
+		if a.OldContentHash == "" || a.OldContentHash == a.ContentHash {
+			return &b, func() error {
+				if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+					return err
+				}
+				return os.Rename(from, to)
+			}, nil
+		}
+		// The rename changed the content too; the trash must hold the
+		// content from before it
+		data, err := m.trashedOriginal(a)
+		if err != nil {
+			return nil, nil, err
+		}
+		b.OldModTime, b.ContentHash = a.OldModTime, sha256Hex(data)
+		return &b, func() error {
+			if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(to, data, 0644); err != nil {
+				return err
+			}
+			return os.Remove(from)
+		}, nil
+	case "modify>delete":
+		data, err := m.trashedOriginal(a)
+		if err != nil {
+			return nil, nil, err
+		}
+		b.OldContentHash, b.OldOwner, b.OldModTime, b.ContentHash = a.OldContentHash, a.OldOwner, a.OldModTime, sha256Hex(data)
+		trash := m.trashPathFor(b.Path)
+		return &b, func() error { return os.WriteFile(trash, data, 0644) }, nil
+	}
+	return nil, nil, fmt.Errorf("cannot squash %s: %s followed by %s", m.relativePath(a.Path), a.Action, b.Action)
+}
+
+// trashedOriginal returns the content a started from as it is stored in the
+// trash.
+func (m *StateManager) trashedOriginal(a Operation) ([]byte, error) {
+	content, err := ReadBlob(m.StateDir, a.OldContentHash)
+	if err != nil {
+		return nil, fmt.Errorf("cannot squash %s: original content is missing", m.relativePath(a.Path))
+	}
+	return compress(content)
+}
+
+func (m *StateManager) trashPathFor(path string) string {
+	rel, _ := filepath.Rel(m.ProjectRoot, path)
+	return filepath.Join(m.TrashPath, rel)
+}
+
+// PruneTrash removes trashed files that no undo can bring back: those not
+// left by a delete that is still applied in the history of some branch, in a
+// backup, or in the journal of an interrupted apply. A trash directory
+// outside the state directory may be shared, as with --trash-dir /tmp, so
+// there only files some delete in the history put there are removed.
+func (m *StateManager) PruneTrash() (files int, size int64, err error) {
+	keep, known, err := m.trashRefs()
+	if err != nil {
+		return 0, 0, err
+	}
+	return m.removeTrash(keep, known)
+}
+
+// trashRefs returns the trash paths that deletes still applied in some
+// history, backup or interrupted apply need, and all those that any delete
+// in the history trashed.
+func (m *StateManager) trashRefs() (keep, known map[string]bool, err error) {
+	keep = make(map[string]bool)
+	known = make(map[string]bool)
+	err = filepath.WalkDir(m.StateDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		inBackups := filepath.Base(filepath.Dir(path)) == backupsDirName && strings.HasSuffix(path, ".itf")
+		if d.Name() != stateFileName && !inBackups {
+			return nil
+		}
+		s := &StateManager{statePath: path, StateDir: m.StateDir, TrashPath: m.TrashPath, ProjectRoot: m.ProjectRoot}
+		s.state = &State{CurrentIndex: -1}
+		if err := s.load(); err != nil {
+			return err
+		}
+		for _, e := range s.state.History[:min(s.state.CurrentIndex+1, len(s.state.History))] {
+			for _, op := range e.Operations {
+				if op.Action == "delete" {
+					keep[m.trashPathFor(op.Path)] = true
+				}
+			}
+		}
+		for _, e := range s.state.History {
+			for _, op := range e.Operations {
+				if op.Action == "delete" {
+					known[m.trashPathFor(op.Path)] = true
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if saved, _, err := m.readJournal(); err == nil {
+		for _, a := range saved.Actions {
+			if a.Type == "delete" {
+				keep[m.trashPathFor(a.Path)] = true
+			}
+		}
+	}
+	return keep, known, nil
+}
+
+// trashOwned reports whether the trash is within the state directory, and
+// so holds nothing but what itf put there.
+func (m *StateManager) trashOwned() bool {
+	rel, err := filepath.Rel(m.StateDir, m.TrashPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// removeTrash removes the trashed files not in keep and, from a trash that
+// is not owned, only those in known.
+func (m *StateManager) removeTrash(keep, known map[string]bool) (files int, size int64, err error) {
+	owned := m.trashOwned()
+	var dirs []string
+	emptied := make(map[string]bool)
+	err = filepath.WalkDir(m.TrashPath, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case d.IsDir():
+			dirs = append(dirs, path)
+			return nil
+		case keep[path], !owned && !known[path]:
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		files++
+		size += info.Size()
+		for d := filepath.Dir(path); d != m.TrashPath && d != filepath.Dir(d); d = filepath.Dir(d) {
+			emptied[d] = true
+		}
+		return nil
+	})
+	// Drop directories left empty, deepest first; in a shared trash only
+	// those that held removed files
+	for _, d := range slices.Backward(dirs[min(1, len(dirs)):]) {
+		if owned || emptied[d] {
+			os.Remove(d)
+		}
+	}
+	return files, size, err
+}
@@ -0,0 +1,826 @@
+package itf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneTrash(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sharedAt string // --trash-dir, or "" for .itf/trash
+	}{
+		{name: "state dir trash"},
+		{name: "shared trash dir", sharedAt: "shared"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := inProject(t)
+			cfg := Config{}
+			trash := filepath.Join(root, stateDirName, TrashDir)
+			if tc.sharedAt != "" {
+				trash = filepath.Join(t.TempDir(), tc.sharedAt)
+				cfg.TrashDir = trash
+			}
+			writeFile(t, "kept.txt", "kept\n")
+			writeFile(t, "undone.txt", "undone\n")
+
+			mustRun(t, cfg, "```delete\nkept.txt\n```\n")
+			mustRun(t, cfg, "```delete\nundone.txt\n```\n")
+			undo := cfg
+			undo.Undo = true
+			mustRun(t, undo, "")
+			// A copy left behind for the undone delete, which nothing needs
+			writeFile(t, filepath.Join(trash, "undone.txt"), "stale\n")
+			unrelated := filepath.Join(trash, "other", "unrelated.txt")
+			writeFile(t, unrelated, "not itf's\n")
+
+			prune := cfg
+			prune.PruneTrash = true
+			mustRun(t, prune, "")
+
+			if _, err := os.Stat(filepath.Join(trash, "kept.txt")); err != nil {
+				t.Errorf("trash for an applied delete was pruned: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(trash, "undone.txt")); !os.IsNotExist(err) {
+				t.Errorf("trash for an undone delete survived: %v", err)
+			}
+			_, err := os.Stat(unrelated)
+			if tc.sharedAt != "" && err != nil {
+				t.Errorf("file itf never trashed was removed from a shared trash dir: %v", err)
+			}
+			if tc.sharedAt == "" && !os.IsNotExist(err) {
+				t.Errorf("unreferenced file survived in the state dir trash: %v", err)
+			}
+			if readFile(t, "undone.txt") != "undone\n" {
+				t.Errorf("project file changed by prune")
+			}
+		})
+	}
+}
+
+func TestWriteBlobRepairsDamagedBlob(t *testing.T) {
+	content := []byte(strings.Repeat("a line of text that repeats\n", 4000))
+	hash := sha256Hex(content)
+	for _, tc := range []struct {
+		name    string
+		chunked bool
+		damage  func(t *testing.T, dir string)
+	}{
+		{name: "truncated blob", damage: func(t *testing.T, dir string) {
+			path := BlobPath(dir, hash)
+			writeFile(t, path, readFile(t, path)[:10])
+		}},
+		{name: "empty blob", damage: func(t *testing.T, dir string) {
+			writeFile(t, BlobPath(dir, hash), "")
+		}},
+		{name: "corrupt chunk", chunked: true, damage: func(t *testing.T, dir string) {
+			writeFile(t, chunkPath(dir, sha256Hex(splitChunks(content)[0])), "garbage")
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			m, err := NewStateManager()
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.ChunkedBlobs = tc.chunked
+			if err := m.writeBlob(hash, content); err != nil {
+				t.Fatal(err)
+			}
+			tc.damage(t, m.StateDir)
+			if got, err := ReadBlob(m.StateDir, hash); err == nil && bytes.Equal(got, content) {
+				t.Fatal("damage did not change the blob")
+			}
+			if err := m.writeBlob(hash, content); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadBlob(m.StateDir, hash)
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("blob not repaired: %d bytes, err %v", len(got), err)
+			}
+		})
+	}
+}
+
+func TestCustomTrashDir(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		subdir   string // where itf runs, within a git project
+		trashDir func(root string) string
+		want     func(root string) string // where the trash must be
+	}{
+		{name: "relative, at the project root",
+			trashDir: func(string) string { return "bin" },
+			want:     func(root string) string { return filepath.Join(root, "bin") }},
+		{name: "relative, from a subdirectory", subdir: "sub",
+			trashDir: func(string) string { return "bin" },
+			want:     func(root string) string { return filepath.Join(root, "bin") }},
+		{name: "absolute", subdir: "sub",
+			trashDir: func(root string) string { return filepath.Join(filepath.Dir(root), "elsewhere") },
+			want:     func(root string) string { return filepath.Join(filepath.Dir(root), "elsewhere") }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := filepath.Join(inProject(t), "project")
+			if err := os.MkdirAll(filepath.Join(root, tc.subdir), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if tc.subdir != "" {
+				if err := exec.Command("git", "init", "-q", root).Run(); err != nil {
+					t.Skip("git is needed to run itf below the project root:", err)
+				}
+			}
+			t.Chdir(filepath.Join(root, tc.subdir))
+			cfg := Config{TrashDir: tc.trashDir(root)}
+			writeFile(t, "gone.txt", "gone\n")
+
+			mustRun(t, cfg, "```delete\ngone.txt\n```\n")
+			trashed := filepath.Join(tc.want(root), tc.subdir, "gone.txt")
+			if _, err := os.Stat(trashed); err != nil {
+				t.Fatalf("not trashed where expected: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(root, ".itf", "trash")); !os.IsNotExist(err) {
+				t.Errorf("the default trash was used: %v", err)
+			}
+
+			undo := cfg
+			undo.Undo = true
+			mustRun(t, undo, "")
+			if got := readFile(t, "gone.txt"); got != "gone\n" {
+				t.Errorf("undo restored %q", got)
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sharedAt string // --trash-dir, or "" for .itf/trash
+	}{
+		{name: "state dir trash"},
+		{name: "separate trash dir", sharedAt: "shared"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := inProject(t)
+			cfg := Config{}
+			trash := filepath.Join(root, stateDirName, TrashDir)
+			if tc.sharedAt != "" {
+				trash = filepath.Join(t.TempDir(), tc.sharedAt)
+				cfg.TrashDir = trash
+			}
+			writeFile(t, "gone.txt", "gone\n")
+			writeFile(t, "untracked.txt", "untracked\n")
+			mustRun(t, cfg, "`kept.txt`\n```\nkept\n```\n")
+			mustRun(t, cfg, "```delete\ngone.txt\n```\n")
+			unrelated := filepath.Join(trash, "unrelated.txt")
+			if tc.sharedAt != "" {
+				writeFile(t, unrelated, "not itf's\n")
+			}
+
+			reset := cfg
+			reset.Reset = true
+			mustRun(t, reset, "")
+
+			entries, err := os.ReadDir(filepath.Join(root, stateDirName))
+			if err != nil || len(entries) != 0 {
+				t.Errorf("state dir not emptied: %v %v", entries, err)
+			}
+			if _, err := os.Stat(filepath.Join(trash, "gone.txt")); !os.IsNotExist(err) {
+				t.Errorf("trashed file survived the reset: %v", err)
+			}
+			if tc.sharedAt != "" && readFile(t, unrelated) != "not itf's\n" {
+				t.Error("reset changed a file itf never trashed")
+			}
+			if readFile(t, "kept.txt") != "kept\n" || readFile(t, "untracked.txt") != "untracked\n" {
+				t.Error("reset changed project files")
+			}
+			if _, err := os.Stat("gone.txt"); !os.IsNotExist(err) {
+				t.Errorf("reset brought back a deleted file: %v", err)
+			}
+		})
+	}
+}
+
+func TestSquash(t *testing.T) {
+	// files describes a.txt and b.txt, with "-" for a missing file
+	files := func(t *testing.T) string {
+		t.Helper()
+		var parts []string
+		for _, p := range []string{"a.txt", "b.txt"} {
+			data, err := os.ReadFile(p)
+			if os.IsNotExist(err) {
+				data = []byte("-\n")
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			parts = append(parts, p+"="+strings.TrimSuffix(string(data), "\n"))
+		}
+		return strings.Join(parts, " ")
+	}
+	const (
+		start    = "a.txt=one b.txt=-"
+		modifyA  = "`a.txt`\n```\ntwo\n```\n"
+		renameAB = "```rename\na.txt b.txt\n```\n"
+	)
+	for _, tc := range []struct {
+		name  string
+		steps []string
+		want  string
+	}{
+		{name: "modify then modify", steps: []string{modifyA, "`a.txt`\n```\nthree\n```\n"}, want: "a.txt=three b.txt=-"},
+		{name: "create then delete", steps: []string{modifyA + "`b.txt`\n```\nnew\n```\n", "```delete\nb.txt\n```\n"}, want: "a.txt=two b.txt=-"},
+		{name: "modify then rename", steps: []string{modifyA, renameAB}, want: "a.txt=- b.txt=two"},
+		{name: "rename then modify", steps: []string{renameAB, "`b.txt`\n```\ntwo\n```\n"}, want: "a.txt=- b.txt=two"},
+		{name: "modify, rename, then delete", steps: []string{modifyA, renameAB, "```delete\nb.txt\n```\n"}, want: "a.txt=- b.txt=-"},
+		{name: "rename then delete", steps: []string{renameAB, "```delete\nb.txt\n```\n"}, want: "a.txt=- b.txt=-"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "one\n")
+			for _, step := range tc.steps {
+				mustRun(t, Config{}, step)
+			}
+			mustRun(t, Config{Squash: len(tc.steps)}, "")
+			if got := files(t); got != tc.want {
+				t.Fatalf("after squash %s, want %s", got, tc.want)
+			}
+			mustRun(t, Config{Undo: true}, "")
+			if got := files(t); got != start {
+				t.Errorf("one undo gives %s, want %s", got, start)
+			}
+			mustRun(t, Config{Redo: true}, "")
+			if got := files(t); got != tc.want {
+				t.Errorf("redo gives %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackupState(t *testing.T) {
+	type step struct {
+		cfg   Config
+		input string
+	}
+	write := func(label, content string) step {
+		return step{Config{Message: label}, "`a.txt`\n```\n" + content + "\n```\n"}
+	}
+	// history describes the labels of the history entries, with the
+	// current one marked by a *
+	history := func(t *testing.T) string {
+		t.Helper()
+		app, err := NewApp(&Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, current := app.stateManager.History()
+		var labels []string
+		for i, e := range entries {
+			if i == current {
+				e.Message += "*"
+			}
+			labels = append(labels, e.Message)
+		}
+		return strings.Join(labels, " ")
+	}
+	for _, tc := range []struct {
+		name     string
+		steps    []step
+		after    string // history after the last step
+		restored string // history after restoring its backup; "" for no backup
+	}{
+		{name: "squash",
+			steps:    []step{write("A", "two"), write("B", "three"), {cfg: Config{Squash: 2, BackupState: true}}},
+			after:    "A; B*",
+			restored: "A B*"},
+		{name: "prune trash",
+			steps:    []step{write("A", "two"), {cfg: Config{PruneTrash: true, BackupState: true}}},
+			after:    "A*",
+			restored: "A*"},
+		{name: "apply dropping the redo entries",
+			steps: []step{write("A", "two"), write("B", "three"), {cfg: Config{Undo: true}},
+				{Config{Message: "C", BackupState: true}, "`a.txt`\n```\nfour\n```\n"}},
+			after:    "A C*",
+			restored: "A* B"},
+		{name: "without --backup-state",
+			steps: []step{write("A", "two"), write("B", "three"), {cfg: Config{Squash: 2}}},
+			after: "A; B*"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "one\n")
+			for _, s := range tc.steps {
+				mustRun(t, s.cfg, s.input)
+			}
+			if got := history(t); got != tc.after {
+				t.Errorf("history %q, want %q", got, tc.after)
+			}
+
+			backups, _ := os.ReadDir(filepath.Join(stateDirName, backupsDirName))
+			if tc.restored == "" {
+				if len(backups) > 0 {
+					t.Errorf("backed up without --backup-state: %v", backups)
+				}
+				return
+			}
+			if len(backups) != 1 {
+				t.Fatalf("%d backups, want 1", len(backups))
+			}
+			mustRun(t, Config{RestoreState: backups[0].Name()}, "")
+			if got := history(t); got != tc.restored {
+				t.Errorf("restored history %q, want %q", got, tc.restored)
+			}
+		})
+	}
+}
+
+func TestRestoreByName(t *testing.T) {
+	deleteAB := "```delete\na.txt\nb.txt\n```\n"
+	lose := func(trash, blob bool) {
+		if trash {
+			os.Remove(filepath.Join(stateDirName, TrashDir, "a.txt"))
+		}
+		if blob {
+			os.Remove(BlobPath(stateDirName, sha256Hex([]byte("a\n"))))
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		setup func(t *testing.T)
+		want  string // content of a.txt after the restore
+		err   string // part of the error, when the restore must fail
+	}{
+		{name: "one of several deleted files",
+			setup: func(t *testing.T) { mustRun(t, Config{}, deleteAB) },
+			want:  "a\n"},
+		{name: "the most recent delete",
+			setup: func(t *testing.T) {
+				mustRun(t, Config{}, deleteAB)
+				mustRun(t, Config{}, "`a.txt`\n```\nnewer\n```\n")
+				mustRun(t, Config{}, "```delete\na.txt\n```\n")
+			},
+			want: "newer\n"},
+		{name: "from the blob when the trash lost it",
+			setup: func(t *testing.T) { mustRun(t, Config{}, deleteAB); lose(true, false) },
+			want:  "a\n"},
+		{name: "neither trash nor blob",
+			setup: func(t *testing.T) { mustRun(t, Config{}, deleteAB); lose(true, true) },
+			err:   "no trashed copy of a.txt is left to restore"},
+		{name: "never deleted",
+			setup: func(t *testing.T) { mustRun(t, Config{}, "```delete\nb.txt\n```\n") },
+			err:   "a.txt was never deleted by itf"},
+		{name: "recreated since",
+			setup: func(t *testing.T) {
+				mustRun(t, Config{}, deleteAB)
+				writeFile(t, "a.txt", "again\n")
+			},
+			err: "a.txt already exists"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "a\n")
+			writeFile(t, "b.txt", "b\n")
+			tc.setup(t)
+
+			s, err := runItf(t, Config{Restore: "a.txt"}, "")
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(s.Created) != 1 || s.Created[0] != "a.txt" {
+				t.Errorf("created %q, want a.txt", s.Created)
+			}
+			if got := readFile(t, "a.txt"); got != tc.want {
+				t.Errorf("a.txt = %q, want %q", got, tc.want)
+			}
+			if _, err := os.Stat("b.txt"); !os.IsNotExist(err) {
+				t.Errorf("b.txt came back too: %v", err)
+			}
+			// The restore is its own history entry
+			mustRun(t, Config{Undo: true}, "")
+			if _, err := os.Stat("a.txt"); !os.IsNotExist(err) {
+				t.Errorf("undo left the restored file: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	inProject(t)
+	writeFile(t, "mod.txt", "old\n")
+	writeFile(t, "from.txt", "moved\n")
+	writeFile(t, "gone.txt", "gone\n")
+	mustRun(t, Config{WriteManifest: true}, "`new.txt`\n```\nnew\n```\n`mod.txt`\n```\nchanged\n```\n"+
+		"```rename\nfrom.txt to.txt\n```\n```delete\ngone.txt\n```\n")
+
+	data, err := os.ReadFile(filepath.Join(stateDirName, manifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []ManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewApp(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, current := app.stateManager.History()
+	ops := history[current].Operations
+	if len(entries) != len(ops) {
+		t.Fatalf("manifest has %d entries, the operation %d", len(entries), len(ops))
+	}
+
+	want := map[string]string{"new.txt": "create", "mod.txt": "modify", "to.txt": "rename", "gone.txt": "delete"}
+	for i, e := range entries {
+		if want[e.Path] != e.Action {
+			t.Errorf("entry %s: action %q, want %q", e.Path, e.Action, want[e.Path])
+		}
+		if e.Action != "delete" && e.Hash != ops[i].ContentHash {
+			t.Errorf("entry %s: hash %q, operation has %q", e.Path, e.Hash, ops[i].ContentHash)
+		}
+		if e.Action == "delete" {
+			if e.Hash != "" || e.Blob != "" {
+				t.Errorf("deleted %s has hash %q and blob %q", e.Path, e.Hash, e.Blob)
+			}
+			continue
+		}
+		// The blob holds the content now on disk
+		content, err := ReadBlob(stateDirName, e.Hash)
+		if err != nil {
+			t.Errorf("entry %s: %v", e.Path, err)
+		} else if string(content) != readFile(t, e.Path) {
+			t.Errorf("entry %s: blob holds %q", e.Path, content)
+		}
+		if _, err := os.Stat(e.Blob); err != nil {
+			t.Errorf("entry %s: blob location: %v", e.Path, err)
+		}
+	}
+}
+
+func TestRenameSourceRecreated(t *testing.T) {
+	inProject(t)
+	writeFile(t, "a.txt", "original\n")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes("a.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	mustRun(t, Config{}, "```rename\na.txt b.txt\n```\n`a.txt`\n```\nfresh\n```\n")
+
+	applied := func() {
+		t.Helper()
+		if got := readFile(t, "a.txt"); got != "fresh\n" {
+			t.Errorf("a.txt = %q, want the recreated file", got)
+		}
+		if got := readFile(t, "b.txt"); got != "original\n" {
+			t.Errorf("b.txt = %q, want the renamed original", got)
+		}
+	}
+	applied()
+
+	mustRun(t, Config{Undo: true}, "")
+	if got := readFile(t, "a.txt"); got != "original\n" {
+		t.Errorf("after undo a.txt = %q, want %q", got, "original\n")
+	}
+	if info, err := os.Stat("a.txt"); err != nil {
+		t.Error(err)
+	} else if !info.ModTime().Equal(mtime) {
+		t.Errorf("after undo a.txt mtime %v, want %v", info.ModTime(), mtime)
+	}
+	if _, err := os.Stat("b.txt"); !os.IsNotExist(err) {
+		t.Errorf("after undo b.txt exists: %v", err)
+	}
+
+	mustRun(t, Config{Redo: true}, "")
+	applied()
+}
+
+func TestStatePathFor(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, stateFileName)
+	if got := statePathFor(dir, ""); got != shared {
+		t.Errorf("no branch: %q, want %q", got, shared)
+	}
+	writeFile(t, shared, "0\n")
+
+	// The first branch takes the shared history over
+	main := filepath.Join(dir, branchesDirName, "main", stateFileName)
+	if got := statePathFor(dir, "main"); got != main {
+		t.Errorf("main: %q, want %q", got, main)
+	}
+	if got := readFile(t, main); got != "0\n" {
+		t.Errorf("main history %q, want the shared one", got)
+	}
+	if _, err := os.Stat(shared); !os.IsNotExist(err) {
+		t.Errorf("shared history left behind: %v", err)
+	}
+
+	// A branch name with a slash nests, and starts without history
+	feature := filepath.Join(dir, branchesDirName, "feature", "x", stateFileName)
+	if got := statePathFor(dir, "feature/x"); got != feature {
+		t.Errorf("feature/x: %q, want %q", got, feature)
+	}
+	if _, err := os.Stat(feature); !os.IsNotExist(err) {
+		t.Errorf("feature/x has history: %v", err)
+	}
+	if got := readFile(t, main); got != "0\n" {
+		t.Errorf("main history %q after switching away", got)
+	}
+}
+
+func TestBranchHistory(t *testing.T) {
+	inProject(t)
+	git := func(args ...string) {
+		t.Helper()
+		args = append([]string{"-c", "user.name=itf", "-c", "user.email=itf@example.com"}, args...)
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Skipf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	git("init", "-q", "-b", "main")
+	git("commit", "-q", "--allow-empty", "-m", "init")
+	writeFile(t, "a.txt", "old\n")
+	mustRun(t, Config{}, "`a.txt`\n```\nnew\n```\n")
+
+	git("checkout", "-q", "-b", "feature")
+	runItf(t, Config{Undo: true}, "")
+	if got := readFile(t, "a.txt"); got != "new\n" {
+		t.Errorf("undo on feature changed a.txt to %q", got)
+	}
+
+	git("checkout", "-q", "main")
+	mustRun(t, Config{Undo: true}, "")
+	if got := readFile(t, "a.txt"); got != "old\n" {
+		t.Errorf("undo on main left a.txt %q", got)
+	}
+}
+
+func TestOperationSource(t *testing.T) {
+	inProject(t)
+	writeFile(t, "b.txt", "b\n")
+	mustRun(t, Config{}, "`a.txt`\n```\nA\n```\n```diff\n--- a/b.txt\n+++ b/b.txt\n@@ -1 +1 @@\n-b\n+B\n```\n")
+
+	sources := func() map[string]string {
+		t.Helper()
+		m, err := NewStateManager()
+		if err != nil {
+			t.Fatal(err)
+		}
+		history, _ := m.History()
+		got := map[string]string{}
+		for _, e := range history {
+			for _, op := range e.Operations {
+				got[m.relativePath(op.Path)] = op.Source
+			}
+		}
+		return got
+	}
+	if got, want := sources(), map[string]string{"a.txt": "codeblock", "b.txt": "diff"}; !maps.Equal(got, want) {
+		t.Errorf("sources %v, want %v", got, want)
+	}
+
+	out := captureStdout(t, func() { mustRun(t, Config{ListHistory: true}, "") })
+	for _, want := range []string{"a.txt (codeblock)", "b.txt (diff)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("--list-history output %q does not contain %q", out, want)
+		}
+	}
+
+	// History written before sources were recorded still loads
+	path := filepath.Join(stateDirName, stateFileName)
+	var kept []string
+	for _, l := range strings.Split(readFile(t, path), "\n") {
+		if !strings.HasPrefix(l, metaPrefix+"source ") {
+			kept = append(kept, l)
+		}
+	}
+	writeFile(t, path, strings.Join(kept, "\n"))
+	if got, want := sources(), map[string]string{"a.txt": "", "b.txt": ""}; !maps.Equal(got, want) {
+		t.Errorf("sources from older history %v, want %v", got, want)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want int64
+	}{
+		{"1700000000", 1700000000 * int64(time.Second)}, // seconds, from older history
+		{"1700000000123456789", 1700000000123456789},
+		{" 1700000000123456789 ", 1700000000123456789},
+		{"0", 0},
+		{"garbage", 0},
+	} {
+		if got := parseTimestamp(tc.in); got != tc.want {
+			t.Errorf("parseTimestamp(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestOperationOrder(t *testing.T) {
+	inProject(t)
+	// Two applies in quick succession, each naming paths out of sorted order
+	mustRun(t, Config{}, "`z.txt`\n```\nz\n```\n`a.txt`\n```\na\n```\n")
+	mustRun(t, Config{}, "`m.txt`\n```\nm\n```\n`b.txt`\n```\nb\n```\n")
+
+	m, err := NewStateManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, _ := m.History()
+	var paths []string
+	var last int64
+	for _, e := range history {
+		for _, op := range e.Operations {
+			paths = append(paths, m.relativePath(op.Path))
+			if op.Timestamp <= last {
+				t.Errorf("%s: timestamp %d does not follow %d", op.Path, op.Timestamp, last)
+			}
+			last = op.Timestamp
+		}
+	}
+	if want := []string{"z.txt", "a.txt", "m.txt", "b.txt"}; !slices.Equal(paths, want) {
+		t.Errorf("history order %q, want %q", paths, want)
+	}
+}
+
+func TestExportImportHistory(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "history.json")
+	inProject(t)
+	writeFile(t, "a.txt", "old\n")
+	mustRun(t, Config{}, "`a.txt`\n```\nnew\n```\n")
+	mustRun(t, Config{ExportHistory: bundle}, "")
+
+	// A second project, with its own state directory, holding the result
+	inProject(t)
+	writeFile(t, "a.txt", "new\n")
+	mustRun(t, Config{ImportHistory: bundle}, "")
+	if content, err := ReadBlob(stateDirName, sha256Hex([]byte("old\n"))); err != nil || string(content) != "old\n" {
+		t.Errorf("imported blob %q, %v", content, err)
+	}
+	mustRun(t, Config{Undo: true}, "")
+	if got := readFile(t, "a.txt"); got != "old\n" {
+		t.Errorf("after undo a.txt = %q, want %q", got, "old\n")
+	}
+	mustRun(t, Config{Redo: true}, "")
+	if got := readFile(t, "a.txt"); got != "new\n" {
+		t.Errorf("after redo a.txt = %q, want %q", got, "new\n")
+	}
+
+	// A blob that does not match its hash is refused
+	var b HistoryBundle
+	if err := json.Unmarshal([]byte(readFile(t, bundle)), &b); err != nil {
+		t.Fatal(err)
+	}
+	for hash := range b.Blobs {
+		b.Blobs[hash] = base64.StdEncoding.EncodeToString([]byte("tampered\n"))
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, bundle, string(data))
+	if _, err := runItf(t, Config{ImportHistory: bundle}, ""); err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("error %v, want a corrupt blob error", err)
+	}
+}
+
+func TestRestoreTrashed(t *testing.T) {
+	const diff = "```diff\n--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-orig\n+patched\n```\n"
+	for _, tc := range []struct {
+		name    string
+		input   string
+		restore bool
+		want    string   // content of a.txt after the apply, "-" when missing
+		undone  []string // content of a.txt after each successive undo
+	}{
+		{name: "a block over a trashed file restores it first", input: "`a.txt`\n```\nfresh\n```\n", restore: true,
+			want: "fresh\n", undone: []string{"orig\n", "-", "orig\n"}},
+		{name: "a diff patches the restored file", input: diff, restore: true,
+			want: "patched\n", undone: []string{"orig\n", "-", "orig\n"}},
+		{name: "without --restore-trashed a block creates the file", input: "`a.txt`\n```\nfresh\n```\n",
+			want: "fresh\n", undone: []string{"-", "orig\n"}},
+		{name: "without --restore-trashed a diff fails", input: diff, want: "-"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			content := func() string {
+				data, err := os.ReadFile("a.txt")
+				if err != nil {
+					return "-"
+				}
+				return string(data)
+			}
+			writeFile(t, "a.txt", "orig\n")
+			mustRun(t, Config{}, "```delete\na.txt\n```\n")
+
+			s, err := runItf(t, Config{RestoreTrashed: tc.restore}, tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := content(); got != tc.want {
+				t.Errorf("a.txt = %q, want %q", got, tc.want)
+			}
+			if restored := slices.Contains(s.Warnings, "a.txt: restored from the trash before applying"); restored != tc.restore {
+				t.Errorf("warnings %q, restored %v, want %v", s.Warnings, restored, tc.restore)
+			}
+			for i, want := range tc.undone {
+				mustRun(t, Config{Undo: true}, "")
+				if got := content(); got != want {
+					t.Errorf("after undo %d a.txt = %q, want %q", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNoBackupExtensions(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want bool
+	}{
+		{"dist/app.min.js", true},
+		{"yarn.lock", true},
+		{"src/app.js", false},
+		{"lock/readme.md", false},
+	} {
+		if got := skipsBackup(tc.path, []string{".min.js", ".lock"}); got != tc.want {
+			t.Errorf("skipsBackup(%q) = %v, want %v", tc.path, got, tc.want)
+		}
+	}
+
+	inProject(t)
+	writeFile(t, "app.min.js", "old min\n")
+	writeFile(t, "app.js", "old app\n")
+	s := mustRun(t, Config{NoBackupExtensions: []string{".min.js"}},
+		"`app.min.js`\n```\nnew min\n```\n`app.js`\n```\nnew app\n```\n`new.min.js`\n```\ncreated min\n```\n")
+	for content, want := range map[string]bool{
+		"old min\n": false, "new min\n": false, "created min\n": false,
+		"old app\n": true, "new app\n": true,
+	} {
+		_, err := ReadBlob(stateDirName, sha256Hex([]byte(content)))
+		if got := err == nil; got != want {
+			t.Errorf("blob of %q stored %v, want %v (%v)", content, got, want, err)
+		}
+	}
+	if want := "app.min.js: no backup kept, undo cannot restore the previous content"; !slices.Contains(s.Warnings, want) {
+		t.Errorf("warnings %q, want %q", s.Warnings, want)
+	}
+}
+
+func TestEntryInputHash(t *testing.T) {
+	inProject(t)
+	const input = "`a.txt`\n```\nA\n```\n"
+	mustRun(t, Config{}, input)
+	want := sha256Hex([]byte(input))
+
+	inputs := func() []string {
+		t.Helper()
+		m, err := NewStateManager()
+		if err != nil {
+			t.Fatal(err)
+		}
+		history, _ := m.History()
+		var got []string
+		for _, e := range history {
+			got = append(got, e.Input)
+		}
+		return got
+	}
+	if got := inputs(); !slices.Equal(got, []string{want}) {
+		t.Errorf("inputs %q, want %q", got, want)
+	}
+	out := captureStdout(t, func() { mustRun(t, Config{ListHistory: true}, "") })
+	if !strings.Contains(out, "(input "+want[:12]+")") {
+		t.Errorf("--list-history output %q does not show the input hash", out)
+	}
+
+	// History written before the input was recorded still loads
+	path := filepath.Join(stateDirName, stateFileName)
+	var kept []string
+	for _, l := range strings.Split(readFile(t, path), "\n") {
+		if !strings.HasPrefix(l, metaPrefix+"input ") {
+			kept = append(kept, l)
+		}
+	}
+	writeFile(t, path, strings.Join(kept, "\n"))
+	if got := inputs(); !slices.Equal(got, []string{""}) {
+		t.Errorf("inputs from older history %q, want none", got)
+	}
+	if out := captureStdout(t, func() { mustRun(t, Config{ListHistory: true}, "") }); strings.Contains(out, "(input") {
+		t.Errorf("--list-history output %q shows an input for older history", out)
+	}
+}
@@ -0,0 +1,21 @@
+package itf
+
+import (
+	"strings"
+	"text/template"
+)
+
+// expandTemplate runs lines through text/template with vars as the data, so
+// {{.Name}} is replaced by vars["Name"]. A variable missing from vars is an
+// error rather than "<no value>".
+func expandTemplate(lines []string, vars map[string]string) ([]string, error) {
+	t, err := template.New("block").Option("missingkey=error").Parse(strings.Join(lines, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, vars); err != nil {
+		return nil, err
+	}
+	return strings.Split(b.String(), "\n"), nil
+}
@@ -0,0 +1,68 @@
+package itf
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		lines []string
+		vars  map[string]string
+		want  []string
+		err   string
+	}{
+		{name: "one variable", lines: []string{"name: {{.Name}}"}, vars: map[string]string{"Name": "itf"}, want: []string{"name: itf"}},
+		{name: "several lines and variables", lines: []string{"[{{.Section}}]", "port = {{.Port}}"},
+			vars: map[string]string{"Section": "server", "Port": "8080"}, want: []string{"[server]", "port = 8080"}},
+		{name: "no actions", lines: []string{"plain", ""}, want: []string{"plain", ""}},
+		{name: "missing variable", lines: []string{"{{.Name}}"}, vars: map[string]string{}, err: `map has no entry for key "Name"`},
+		{name: "bad syntax", lines: []string{"{{.Name"}, err: "unclosed action"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := expandTemplate(tc.lines, tc.vars)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("expanded %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTemplateBlocks(t *testing.T) {
+	const input = "`app.yaml`\n```yaml\nname: {{.Name}}\n```\n"
+	for _, tc := range []struct {
+		name   string
+		cfg    Config
+		want   string // content of app.yaml; empty when it must not be written
+		failed bool
+	}{
+		{name: "expanded with --template", cfg: Config{Template: true, Vars: map[string]string{"Name": "itf"}}, want: "name: itf\n"},
+		{name: "untouched without --template", cfg: Config{Vars: map[string]string{"Name": "itf"}}, want: "name: {{.Name}}\n"},
+		{name: "a missing variable fails the block", cfg: Config{Template: true}, failed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			s := mustRun(t, tc.cfg, input)
+			if got := len(s.Failed) > 0; got != tc.failed {
+				t.Errorf("failed %q, warnings %q", s.Failed, s.Warnings)
+			}
+			if tc.want == "" {
+				return
+			}
+			if got := readFile(t, "app.yaml"); got != tc.want {
+				t.Errorf("app.yaml = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,15 @@
 package itf
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -16,8 +24,49 @@ var (
 	successStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("78"))
 	deletedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("204"))
 	errorStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("197"))
+	warningStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("214"))
 )
 
+// themeStyles names the styles a theme can recolor.
+var themeStyles = map[string]*lipgloss.Style{
+	"header":   &headerStyle,
+	"created":  &createdStyle,
+	"modified": &successStyle,
+	"renamed":  &renamedStyle,
+	"deleted":  &deletedStyle,
+	"error":    &errorStyle,
+	"warning":  &warningStyle,
+}
+
+var hexColor = regexp.MustCompile(`^#(?:[0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// ApplyTheme recolors the summary from a comma-separated list of name=color
+// pairs, such as "created=#0055aa,error=160", where a color is a hex value
+// or a 256-color number. Names left out keep their color. Nothing changes
+// when spec is invalid.
+func ApplyTheme(spec string) error {
+	colors := make(map[*lipgloss.Style]lipgloss.Color)
+	for item := range strings.SplitSeq(spec, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(item, "=")
+		style, ok := themeStyles[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("unknown theme color %q: want header, created, modified, renamed, deleted, error or warning", strings.TrimSpace(name))
+		}
+		value = strings.TrimSpace(value)
+		if n, err := strconv.Atoi(value); (err != nil || n < 0 || n > 255) && !hexColor.MatchString(value) {
+			return fmt.Errorf("invalid color %q for %s: want #rrggbb, #rgb or 0-255", value, strings.TrimSpace(name))
+		}
+		colors[style] = lipgloss.Color(value)
+	}
+	for style, c := range colors {
+		*style = style.Foreground(c)
+	}
+	return nil
+}
+
 type spinner struct {
 	frames []string
 	index  int
@@ -33,19 +82,37 @@ type TUI struct {
 	spinner     spinner
 	mu          sync.Mutex
 	cur, total  int
+
+	// Quiet suppresses all terminal output. SummaryOut, when set, receives
+	// the summary as plain text as well.
+	Quiet      bool
+	SummaryOut string
+	// ProgressPlain reports progress as PROGRESS lines on stderr instead of
+	// the spinner. It is implied when stdout is not a terminal.
+	ProgressPlain bool
 }
 
 func NewTUI(app *App, noAnimation bool) *TUI {
 	return &TUI{app: app, noAnimation: noAnimation, spinner: newSpinner()}
 }
 
-func (t *TUI) Run() error {
-	if t.noAnimation {
-		summary, err := t.app.Execute()
-		if err == nil {
-			fmt.Print(FormatSummary(summary))
+func (t *TUI) Run(ctx context.Context) (Summary, error) {
+	if t.noAnimation || t.Quiet {
+		summary, err := t.app.ExecuteContext(ctx)
+		if err == nil || errors.Is(err, context.Canceled) {
+			return summary, errors.Join(err, t.report(summary))
 		}
-		return err
+		return summary, err
+	}
+
+	if t.ProgressPlain || !isTerminal(os.Stdout) {
+		p := &plainProgress{w: os.Stderr, interval: 100 * time.Millisecond}
+		t.app.SetProgressCallback(p.update)
+		summary, err := t.app.ExecuteContext(ctx)
+		if err == nil || errors.Is(err, context.Canceled) {
+			return summary, errors.Join(err, t.report(summary))
+		}
+		return summary, err
 	}
 
 	t.app.SetProgressCallback(func(c, tot int) {
@@ -60,6 +127,8 @@ func (t *TUI) Run() error {
 			select {
 			case <-done:
 				return
+			case <-ctx.Done():
+				return
 			case <-time.After(100 * time.Millisecond):
 				t.spinner.tick()
 				t.renderProgress()
@@ -67,14 +136,55 @@ func (t *TUI) Run() error {
 		}
 	}()
 
-	summary, err := t.app.Execute()
+	summary, err := t.app.ExecuteContext(ctx)
 	close(done)
 	fmt.Print("\r\x1b[K")
 
-	if err == nil {
-		fmt.Print(FormatSummary(summary))
+	if err == nil || errors.Is(err, context.Canceled) {
+		return summary, errors.Join(err, t.report(summary))
 	}
-	return err
+	return summary, err
+}
+
+func (t *TUI) report(s Summary) error {
+	if !t.Quiet {
+		fmt.Print(FormatSummary(s))
+	}
+	if t.SummaryOut == "" {
+		return nil
+	}
+	return WriteSummaryFile(t.SummaryOut, s)
+}
+
+// WriteSummaryFile writes the summary without styling to path, creating
+// parent directories as needed.
+func WriteSummaryFile(path string, s Summary) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(formatSummary(s, false)), 0644)
+}
+
+// plainProgress prints progress as "PROGRESS current/total" lines, at most
+// once per interval apart from the final update.
+type plainProgress struct {
+	w        io.Writer
+	interval time.Duration
+	last     time.Time
+}
+
+func (p *plainProgress) update(current, total int) {
+	now := time.Now()
+	if current < total && now.Sub(p.last) < p.interval {
+		return
+	}
+	p.last = now
+	fmt.Fprintf(p.w, "PROGRESS %d/%d\n", current, total)
+}
+
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
 }
 
 func (t *TUI) renderProgress() {
@@ -84,16 +194,26 @@ func (t *TUI) renderProgress() {
 }
 
 func FormatSummary(s Summary) string {
+	return formatSummary(s, true)
+}
+
+func formatSummary(s Summary, styled bool) string {
 	var b strings.Builder
+	render := func(style lipgloss.Style, text string) string {
+		if !styled {
+			return text
+		}
+		return style.Render(text)
+	}
 	if s.Message != "" {
-		b.WriteString(headerStyle.Render(s.Message) + "\n\n")
+		b.WriteString(render(headerStyle, s.Message) + "\n\n")
 	}
 
 	renderList := func(title string, style lipgloss.Style, list []string) {
 		if len(list) == 0 {
 			return
 		}
-		b.WriteString(style.Render(title) + "\n")
+		b.WriteString(render(style, title) + "\n")
 		for _, f := range list {
 			b.WriteString(fmt.Sprintf("  %s\n", f))
 		}
@@ -104,6 +224,89 @@ func FormatSummary(s Summary) string {
 	renderList("Renamed:", renamedStyle, s.Renamed)
 	renderList("Deleted:", deletedStyle, s.Deleted)
 	renderList("Failed:", errorStyle, s.Failed)
+	renderList("Warnings:", warningStyle, s.Warnings)
+
+	return b.String()
+}
+
+// FormatPaths0 lists every affected path separated by NUL bytes, for use with
+// xargs -0. Renames contribute both the old and the new path. Failed paths
+// are left out; see formatFailures.
+func FormatPaths0(s Summary) string {
+	var b strings.Builder
+	write := func(p string) {
+		b.WriteString(p)
+		b.WriteByte(0)
+	}
+
+	for _, list := range [][]string{s.Created, s.Modified, s.Deleted} {
+		for _, p := range list {
+			write(p)
+		}
+	}
+	for _, r := range s.Renamed {
+		oldPath, newPath, _ := strings.Cut(r, " -> ")
+		write(oldPath)
+		write(newPath)
+	}
+	return b.String()
+}
+
+// formatFailures lists the failed paths of s and the warnings that explain
+// them, for stderr when stdout carries FormatPaths0. It is empty when
+// nothing failed.
+func formatFailures(s Summary) string {
+	if len(s.Failed) == 0 {
+		return ""
+	}
+	return formatSummary(Summary{Failed: s.Failed, Warnings: s.Warnings}, false)
+}
+
+// FormatTAP renders each action as a TAP test line, so CI tools that parse
+// TAP can show the outcome. A failure is followed by its reason when one was
+// reported; other warnings are listed as comments at the end.
+func FormatTAP(s Summary) string {
+	type result struct {
+		ok     bool
+		desc   string
+		reason string
+	}
+	var results []result
+	for _, l := range []struct {
+		verb  string
+		paths []string
+	}{
+		{"created", s.Created},
+		{"modified", s.Modified},
+		{"renamed", s.Renamed},
+		{"deleted", s.Deleted},
+	} {
+		for _, p := range l.paths {
+			results = append(results, result{ok: true, desc: l.verb + " " + p})
+		}
+	}
 
+	warnings := slices.Clone(s.Warnings)
+	for _, p := range s.Failed {
+		r := result{desc: "failed " + p, reason: "not applied"}
+		if i := slices.IndexFunc(warnings, func(w string) bool { return strings.HasPrefix(w, p+": ") }); i >= 0 {
+			r.reason = strings.TrimPrefix(warnings[i], p+": ")
+			warnings = slices.Delete(warnings, i, i+1)
+		}
+		results = append(results, r)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "TAP version 13\n1..%d\n", len(results))
+	for i, r := range results {
+		if !r.ok {
+			fmt.Fprintf(&b, "not ok %d - %s\n  # %s\n", i+1, r.desc, r.reason)
+			continue
+		}
+		fmt.Fprintf(&b, "ok %d - %s\n", i+1, r.desc)
+	}
+	for _, w := range warnings {
+		fmt.Fprintf(&b, "# warning: %s\n", w)
+	}
 	return b.String()
 }
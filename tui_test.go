@@ -0,0 +1,187 @@
+package itf
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+func TestFormatPaths0(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		s    Summary
+		want []string
+	}{
+		{name: "nothing", s: Summary{}},
+		{name: "every kind of change",
+			s:    Summary{Created: []string{"new.go"}, Modified: []string{"has space.go"}, Deleted: []string{"old.go"}, Renamed: []string{"a.go -> b.go"}},
+			want: []string{"new.go", "has space.go", "old.go", "a.go", "b.go"}},
+		{name: "failed paths are left out",
+			s:    Summary{Modified: []string{"ok.go"}, Failed: []string{"bad.go"}},
+			want: []string{"ok.go"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := FormatPaths0(tc.s)
+			if out != "" && !strings.HasSuffix(out, "\x00") {
+				t.Errorf("output %q is not NUL-terminated", out)
+			}
+			got := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+			if out == "" {
+				got = nil
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("paths %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrint0ReportsFailures(t *testing.T) {
+	inProject(t)
+	writeFile(t, "exists.txt", "one\n")
+	input := "`new.txt`\n```\nnew\n```\n" +
+		"```diff\n--- a/exists.txt\n+++ b/exists.txt\n@@ -1 +1 @@\n-missing\n+two\n```\n"
+	s, err := runItf(t, Config{DryRun: true}, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := FormatPaths0(s); got != "new.txt\x00" {
+		t.Errorf("stdout %q, want only new.txt", got)
+	}
+	if failures := formatFailures(s); !strings.Contains(failures, "exists.txt") {
+		t.Errorf("stderr %q does not name the failed path", failures)
+	}
+	if ExitCode(s) == ExitOK {
+		t.Error("a failed path must make the exit status non-zero")
+	}
+}
+
+func TestSummaryOut(t *testing.T) {
+	s := Summary{Message: "Done", Created: []string{"new.go"}, Modified: []string{"old.go"}, Failed: []string{"bad.go"}}
+	const want = "Done\n\nCreated:\n  new.go\nModified:\n  old.go\nFailed:\n  bad.go\n"
+	for _, quiet := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "logs", "itf", "summary.txt")
+		tui := &TUI{Quiet: quiet, SummaryOut: path}
+		var err error
+		out := captureStdout(t, func() { err = tui.report(s) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, path); got != want {
+			t.Errorf("quiet=%v: file %q, want %q", quiet, got, want)
+		}
+		if quiet && out != "" {
+			t.Errorf("quiet: stdout %q, want nothing", out)
+		}
+		if !quiet && !strings.Contains(out, "new.go") {
+			t.Errorf("stdout %q does not carry the summary", out)
+		}
+	}
+}
+
+func TestPlainProgressThrottling(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		interval time.Duration
+		want     string
+	}{
+		{name: "within the interval only the first and the final update print", interval: time.Hour,
+			want: "PROGRESS 1/5\nPROGRESS 5/5\n"},
+		{name: "no interval prints every update", want: "PROGRESS 1/5\nPROGRESS 2/5\nPROGRESS 3/5\nPROGRESS 4/5\nPROGRESS 5/5\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b strings.Builder
+			p := &plainProgress{w: &b, interval: tc.interval}
+			for i := 1; i <= 5; i++ {
+				p.update(i, 5)
+			}
+			if b.String() != tc.want {
+				t.Errorf("output %q, want %q", b.String(), tc.want)
+			}
+		})
+	}
+
+	t.Run("an update prints again once the interval has passed", func(t *testing.T) {
+		var b strings.Builder
+		p := &plainProgress{w: &b, interval: time.Hour}
+		p.update(1, 5)
+		p.update(2, 5)
+		p.last = p.last.Add(-time.Hour)
+		p.update(3, 5)
+		if want := "PROGRESS 1/5\nPROGRESS 3/5\n"; b.String() != want {
+			t.Errorf("output %q, want %q", b.String(), want)
+		}
+	})
+}
+
+func TestFormatTAP(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		s    Summary
+		want string
+	}{
+		{name: "nothing", want: "TAP version 13\n1..0\n"},
+		{name: "every kind of change",
+			s: Summary{Created: []string{"new.go"}, Modified: []string{"m.go"}, Renamed: []string{"a.go -> b.go"}, Deleted: []string{"old.go"}},
+			want: "TAP version 13\n1..4\n" +
+				"ok 1 - created new.go\nok 2 - modified m.go\nok 3 - renamed a.go -> b.go\nok 4 - deleted old.go\n"},
+		{name: "failures carry their reason",
+			s: Summary{Modified: []string{"m.go"}, Failed: []string{"x.go", "y.go"},
+				Warnings: []string{"x.go: hunk 1 did not match", "2 blocks had no path"}},
+			want: "TAP version 13\n1..3\n" +
+				"ok 1 - modified m.go\n" +
+				"not ok 2 - failed x.go\n  # hunk 1 did not match\n" +
+				"not ok 3 - failed y.go\n  # not applied\n" +
+				"# warning: 2 blocks had no path\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := FormatTAP(tc.s); got != tc.want {
+				t.Errorf("FormatTAP:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyTheme(t *testing.T) {
+	saved := make(map[*lipgloss.Style]lipgloss.Style)
+	for _, style := range themeStyles {
+		saved[style] = *style
+	}
+	profile := lipgloss.ColorProfile()
+	t.Cleanup(func() {
+		for style, s := range saved {
+			*style = s
+		}
+		lipgloss.SetColorProfile(profile)
+	})
+	lipgloss.SetColorProfile(termenv.TrueColor)
+
+	s := Summary{Created: []string{"new.go"}, Modified: []string{"m.go"}, Failed: []string{"bad.go"}}
+	if err := ApplyTheme("created=#ff0000, error=160"); err != nil {
+		t.Fatal(err)
+	}
+	out := FormatSummary(s)
+	for _, want := range []string{
+		"\x1b[38;2;255;0;0mCreated:", // the custom hex color
+		"\x1b[38;5;160mFailed:",      // the custom 256-color number
+		"\x1b[38;5;78mModified:",     // the default, left alone
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("summary %q does not contain %q", out, want)
+		}
+	}
+
+	for _, spec := range []string{"created=red", "created=256", "unknown=#fff", "modified=#00ff00,error=#12345"} {
+		if err := ApplyTheme(spec); err == nil {
+			t.Errorf("ApplyTheme(%q) accepted", spec)
+		}
+	}
+	if got := FormatSummary(s); got != out {
+		t.Errorf("a rejected theme changed the summary:\n%q\nwant:\n%q", got, out)
+	}
+}
@@ -0,0 +1,66 @@
+package itf
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+)
+
+// changeDetector remembers the hash of the last content it was shown.
+type changeDetector struct {
+	last string
+}
+
+func (d *changeDetector) changed(content string) bool {
+	sum := sha256.Sum256([]byte(content))
+	h := hex.EncodeToString(sum[:])
+	if h == d.last {
+		return false
+	}
+	d.last = h
+	return true
+}
+
+// Watch polls the clipboard every interval and applies its content whenever
+// it changes, passing each result to onApply. Whatever is on the clipboard
+// when watching starts is taken as the baseline and not applied. Watch
+// returns when ctx is cancelled.
+func (a *App) Watch(ctx context.Context, interval time.Duration, onApply func(Summary, error)) error {
+	var d changeDetector
+	baseline := true
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if c, err := a.sourceProvider.readClipboard(); err == nil && isText(c) {
+			c = strings.TrimSpace(c)
+			if d.changed(c) && !baseline && c != "" {
+				onApply(a.applyWatched(ctx, c))
+			}
+			baseline = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyWatched applies clipboard content as a normal run would. A header's
+// allowlist applies to that content only.
+func (a *App) applyWatched(ctx context.Context, content string) (Summary, error) {
+	files := a.cfg.Files
+	defer func() { a.cfg.Files = files }()
+	a.cfg.Files = slices.Clip(files)
+
+	content, err := a.prepareContent(content)
+	if err != nil {
+		return Summary{}, err
+	}
+	return a.applyContent(ctx, content)
+}
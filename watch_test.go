@@ -0,0 +1,90 @@
+package itf
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestChangeDetector(t *testing.T) {
+	var d changeDetector
+	for i, step := range []struct {
+		content string
+		changed bool
+	}{
+		{"a", true},
+		{"a", false},
+		{"b", true},
+		{"a", true},
+		{"", true},
+		{"", false},
+	} {
+		if got := d.changed(step.content); got != step.changed {
+			t.Errorf("step %d: changed(%q) = %v, want %v", i, step.content, got, step.changed)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	const blocks = "`a.txt`\n```\nA\n```\n`b.txt`\n```\nB\n```\n"
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		clip    string
+		a       string // content of a.txt afterwards
+		createB bool
+	}{
+		{name: "blocks", clip: blocks, a: "A\n", createB: true},
+		{name: "itf-files header limits that content", clip: "# itf-files: a.txt\n" + blocks, a: "A\n"},
+		{name: "git diff output", cfg: Config{FromGitDiff: true},
+			clip: "diff --git a/a.txt b/a.txt\n--- a/a.txt\n+++ b/a.txt\n@@ -1 +1 @@\n-a\n+A\n", a: "A\n"},
+		{name: "base64", cfg: Config{Base64: true}, clip: base64.StdEncoding.EncodeToString([]byte(blocks)), a: "A\n", createB: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inProject(t)
+			writeFile(t, "a.txt", "a\n")
+			app, err := NewApp(&tc.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The first read is the baseline, which is not applied
+			reads := []string{"baseline"}
+			app.sourceProvider = &SourceProvider{readClipboard: func() (string, error) {
+				if len(reads) > 0 {
+					c := reads[0]
+					reads = reads[1:]
+					return c, nil
+				}
+				return tc.clip, nil
+			}}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var applied []Summary
+			err = app.Watch(ctx, time.Millisecond, func(s Summary, err error) {
+				if err != nil {
+					t.Error(err)
+				}
+				applied = append(applied, s)
+				cancel()
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != 1 {
+				t.Fatalf("applied %d times, want once", len(applied))
+			}
+			if got := readFile(t, "a.txt"); got != tc.a {
+				t.Errorf("a.txt = %q, want %q", got, tc.a)
+			}
+			if _, err := os.Stat("b.txt"); (err == nil) != tc.createB {
+				t.Errorf("b.txt created: %v, want %v", err == nil, tc.createB)
+			}
+			if len(app.cfg.Files) != 0 {
+				t.Errorf("allowlist %q outlived the content it came with", app.cfg.Files)
+			}
+		})
+	}
+}